@@ -0,0 +1,4 @@
+-- Users for go test -tags integration ./pkg/pg, see pg_hba.conf
+CREATE ROLE any_ssl LOGIN;
+CREATE ROLE ssl_only LOGIN;
+CREATE ROLE nossl_only LOGIN;
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/term"
+)
+
+// clientEnvVar overrides the default database client, like $PAGER for git
+const clientEnvVar = "RDS_AUTH_PROXY_CLIENT"
+
+var connectCommand = &cobra.Command{
+	Use:   "connect <target> [-- client args]",
+	Short: "Opens a database client through a temporary tunnel",
+	Long: `Starts the client proxy on a free local port, and runs psql (or the client set
+with --client / $` + clientEnvVar + `) against it. The tunnel is closed when the client exits.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Keep the log quiet, it shares the terminal with the client
+		if err := setupClientLogger(zapcore.WarnLevel); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		client, err := cmd.Flags().GetString("client")
+		if err != nil {
+			return err
+		}
+		if client == "" {
+			client = os.Getenv(clientEnvVar)
+		}
+		if client == "" {
+			client = "psql"
+		}
+		clientArgs := strings.Fields(client)
+
+		user, err := cmd.Flags().GetString("user")
+		if err != nil {
+			return err
+		}
+
+		t, err := startTunnel(ctx, cmd, args[0], "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+
+		env := append(os.Environ(), t.Env()...)
+		if user != "" {
+			env = append(env, fmt.Sprintf("PGUSER=%s", user))
+		}
+		err = runClient(clientArgs[0], append(clientArgs[1:], args[1:]...), env)
+		// The process exits as soon as this returns, so close the tunnel first
+		cancel()
+		t.Wait()
+		return err
+	},
+}
+
+// runClient runs a command attached to the terminal, and waits for it to exit
+func runClient(name string, args []string, env []string) error {
+	child := exec.Command(name, args...)
+	child.Env = env
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+
+	if err := child.Start(); err != nil {
+		return err
+	}
+
+	// Ctrl-C already reaches the child (ex: psql cancels the running query), don't
+	// tear the tunnel down from under it. SIGTERM is passed on, so the child can
+	// shut down before the tunnel does. Without a terminal, SIGINT only reaches
+	// the child if it's passed on too (ex: a CI runner signaling our PID).
+	forwardInterrupt := !term.IsTerminal(int(os.Stdin.Fd()))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	// signal.Stop doesn't close the channel, so the goroutine is told to
+	// stop once the child has exited
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGTERM || forwardInterrupt {
+					_ = child.Process.Signal(sig)
+				}
+			case <-exited:
+				return
+			}
+		}
+	}()
+
+	return child.Wait()
+}
+
+func init() {
+	connectCommand.PersistentFlags().String("proxy-target", "default", "Name of the proxy target in the configfile")
+	connectCommand.PersistentFlags().String("configfile", "", "Path to the proxy config file")
+	connectCommand.PersistentFlags().String("client", "", "Database client to run, defaults to $"+clientEnvVar+" or psql")
+	connectCommand.PersistentFlags().StringP("user", "U", "", "Database user to connect as")
+	rootCmd.AddCommand(connectCommand)
+}
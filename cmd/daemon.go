@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/daemon"
+	"github.com/mothership/rds-auth-proxy/pkg/file"
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const defaultSocketPath = "$HOME/.rds-auth-proxy.sock"
+
+var daemonCommand = &cobra.Command{
+	Use:   "daemon",
+	Short: "Runs the client proxy in the background",
+	Long: `Runs the client proxy as a long-lived daemon, serving a control socket. Use
+"up", "down" and "status" to open and close tunnels through it. Every tunnel
+shares the daemon's AWS config and port-forward to the upstream proxy.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupClientLogger(zapcore.InfoLevel); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		path, err := socketPath(cmd)
+		if err != nil {
+			return err
+		}
+
+		env, err := newTunnelEnv(ctx, cmd)
+		if err != nil {
+			return err
+		}
+
+		listener, err := daemon.Listen(path)
+		if err != nil {
+			return err
+		}
+		// The daemon runs for days, pick up new and removed targets
+		RefreshTargets(ctx, env.discoveryClient, 1*time.Minute)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			cancel()
+		}()
+
+		log.Info("daemon listening", zap.String("socket", path))
+		server := daemon.NewServer(func(ctx context.Context, target, listenAddr string) (string, error) {
+			t, err := env.openTunnel(ctx, target, listenAddr)
+			if err != nil {
+				return "", err
+			}
+			return t.listenAddr, nil
+		})
+		return server.Serve(ctx, listener)
+	},
+}
+
+var upCommand = &cobra.Command{
+	Use:   "up <target>",
+	Short: "Opens a tunnel through the daemon",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listenAddr, err := cmd.Flags().GetString("listen-addr")
+		if err != nil {
+			return err
+		}
+		return sendDaemonRequest(cmd, daemon.Request{Command: daemon.CommandUp, Target: args[0], ListenAddr: listenAddr})
+	},
+}
+
+var downCommand = &cobra.Command{
+	Use:   "down [target]",
+	Short: "Closes a tunnel opened through the daemon, or every tunnel",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		req := daemon.Request{Command: daemon.CommandDown}
+		if len(args) > 0 {
+			req.Target = args[0]
+		}
+		return sendDaemonRequest(cmd, req)
+	},
+}
+
+var statusCommand = &cobra.Command{
+	Use:   "status",
+	Short: "Lists the tunnels open through the daemon",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendDaemonRequest(cmd, daemon.Request{Command: daemon.CommandStatus})
+	},
+}
+
+// sendDaemonRequest sends a request to the daemon, and prints the open tunnels
+func sendDaemonRequest(cmd *cobra.Command, req daemon.Request) error {
+	path, err := socketPath(cmd)
+	if err != nil {
+		return err
+	}
+	res, err := daemon.Send(path, req)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tLISTEN ADDR\tUP SINCE")
+	for _, t := range res.Tunnels {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", t.Target, t.ListenAddr, t.Started.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func socketPath(cmd *cobra.Command) (string, error) {
+	path, err := cmd.Flags().GetString("socket")
+	if err != nil {
+		return "", err
+	}
+	return file.ExpandPath(path)
+}
+
+func init() {
+	daemonCommand.PersistentFlags().String("proxy-target", "default", "Name of the proxy target in the configfile")
+	daemonCommand.PersistentFlags().String("configfile", "", "Path to the proxy config file")
+	upCommand.PersistentFlags().String("listen-addr", "", "Local address for the tunnel, defaults to the target's local port or the proxy listen_addr")
+	for _, c := range []*cobra.Command{daemonCommand, upCommand, downCommand, statusCommand} {
+		c.PersistentFlags().String("socket", defaultSocketPath, "Path to the daemon's control socket")
+		rootCmd.AddCommand(c)
+	}
+}
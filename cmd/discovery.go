@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/mothership/rds-auth-proxy/pkg/aws"
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/discovery"
+	discoveryFactory "github.com/mothership/rds-auth-proxy/pkg/discovery/factory"
+	"github.com/spf13/cobra"
+)
+
+// loadDiscovery loads the config file from the --configfile flag, and
+// returns it along with a refreshed discovery client
+func loadDiscovery(ctx context.Context, cmd *cobra.Command, rdsClient aws.RDSClient) (config.ConfigFile, discovery.Client, error) {
+	filepath, err := cmd.Flags().GetString("configfile")
+	if err != nil {
+		return config.ConfigFile{}, nil, err
+	}
+	cfg, err := config.LoadConfig(filepath)
+	if err != nil {
+		return cfg, nil, err
+	}
+	discoveryClient := discoveryFactory.FromConfig(rdsClient, &cfg)
+	if err := discoveryClient.Refresh(ctx); err != nil {
+		return cfg, nil, err
+	}
+	return cfg, discoveryClient, nil
+}
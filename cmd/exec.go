@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap/zapcore"
+)
+
+var execCommand = &cobra.Command{
+	Use:   "exec --target <target> -- <command> [args]",
+	Short: "Runs a command with a temporary tunnel",
+	Long: `Starts the client proxy on a free local port, and runs a command with the libpq
+environment variables (PGHOST, PGPORT, ...) and DATABASE_URL pointing at it. The
+tunnel is closed when the command exits, and its exit code is passed through.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupClientLogger(zapcore.WarnLevel); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		targetName, err := cmd.Flags().GetString("target")
+		if err != nil {
+			return err
+		}
+		if targetName == "" {
+			return fmt.Errorf("--target is required")
+		}
+
+		user, err := cmd.Flags().GetString("user")
+		if err != nil {
+			return err
+		}
+		if user == "" {
+			user = os.Getenv("PGUSER")
+		}
+
+		t, err := startTunnel(ctx, cmd, targetName, "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+
+		env := append(os.Environ(), t.Env()...)
+		if user != "" {
+			env = append(env, fmt.Sprintf("PGUSER=%s", user))
+		}
+		env = append(env, fmt.Sprintf("DATABASE_URL=%s", t.URL(user)))
+
+		err = runClient(args[0], args[1:], env)
+		// Close the tunnel before exiting, deferred calls don't run on os.Exit
+		cancel()
+		t.Wait()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitCode(exitErr))
+		}
+		return err
+	},
+}
+
+// exitCode returns the command's exit code, or like a shell, 128 plus the
+// signal that killed it. ExitCode is -1 then, which os.Exit turns into 255.
+func exitCode(exitErr *exec.ExitError) int {
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+func init() {
+	execCommand.PersistentFlags().String("proxy-target", "default", "Name of the proxy target in the configfile")
+	execCommand.PersistentFlags().String("target", "", "Name of the target, or db instance identifier that you wish to connect to")
+	execCommand.PersistentFlags().String("configfile", "", "Path to the proxy config file")
+	execCommand.PersistentFlags().StringP("user", "U", "", "Database user for DATABASE_URL and PGUSER, defaults to $PGUSER")
+	rootCmd.AddCommand(execCommand)
+}
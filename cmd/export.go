@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/mothership/rds-auth-proxy/pkg/aws"
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/file"
+	"github.com/mothership/rds-auth-proxy/pkg/pgservice"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var exportCommand = &cobra.Command{
+	Use:   "export",
+	Short: "Exports connection details for other tools",
+	Long:  `Exports connection details for the targets, for use with other tools.`,
+}
+
+var exportPgServiceCommand = &cobra.Command{
+	Use:   "pg-service",
+	Short: "Writes a pg_service.conf section for each target",
+	Long: `Writes a section for each target to ~/.pg_service.conf (or $PGSERVICEFILE), pointing
+at the address the client proxy listens on for it. Other sections are left alone.
+
+Once written, connect with: psql service=<target>`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		path, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			path = os.Getenv("PGSERVICEFILE")
+		}
+		if path == "" {
+			path = "$HOME/.pg_service.conf"
+		}
+		path, err = file.ExpandPath(path)
+		if err != nil {
+			return err
+		}
+		targetNames, err := cmd.Flags().GetStringSlice("target")
+		if err != nil {
+			return err
+		}
+
+		rdsClient, err := aws.NewRDSClient(ctx)
+		if err != nil {
+			return err
+		}
+		cfg, discoveryClient, err := loadDiscovery(ctx, cmd, rdsClient)
+		if err != nil {
+			return err
+		}
+
+		var targets []config.Target
+		if len(targetNames) == 0 {
+			targets = discoveryClient.GetTargets()
+		} else {
+			for _, name := range targetNames {
+				target, err := lookupTarget(discoveryClient, name)
+				if err != nil {
+					return err
+				}
+				targets = append(targets, target)
+			}
+		}
+
+		fs := file.GetFileSystem()
+		existing, err := afero.ReadFile(fs, path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		services, err := pgservice.Parse(bytes.NewReader(existing))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		sslMode := "disable"
+		if cfg.Proxy.SSL.Enabled {
+			sslMode = "require"
+		}
+		for _, target := range targets {
+			section, err := pgServiceSection(cfg.Proxy.ListenAddr, sslMode, target)
+			if err != nil {
+				return err
+			}
+			services.Set(section)
+		}
+
+		writer := file.NewFileWriter()
+		if _, err := services.WriteTo(writer); err != nil {
+			return err
+		}
+		if err := writer.Save(path); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d services to %s\n", len(targets), path)
+		return nil
+	},
+}
+
+// pgServiceSection returns the pg_service.conf section for connecting to
+// target through the client proxy
+func pgServiceSection(defaultAddr string, sslMode string, target config.Target) (pgservice.Section, error) {
+	listenAddr, err := target.GetListenAddr(defaultAddr)
+	if err != nil {
+		return pgservice.Section{}, err
+	}
+	host, port, err := libpqHostPort(listenAddr)
+	if err != nil {
+		return pgservice.Section{}, err
+	}
+	params := map[string]string{
+		"host":    host,
+		"port":    port,
+		"sslmode": sslMode,
+	}
+	if target.DefaultDatabase != nil && *target.DefaultDatabase != "" {
+		params["dbname"] = *target.DefaultDatabase
+	}
+	return pgservice.Section{Name: target.Name, Params: params}, nil
+}
+
+func init() {
+	exportPgServiceCommand.PersistentFlags().String("configfile", "", "Path to the proxy config file")
+	exportPgServiceCommand.PersistentFlags().String("file", "", "Path to the service file, defaults to $PGSERVICEFILE or ~/.pg_service.conf")
+	exportPgServiceCommand.PersistentFlags().StringSlice("target", []string{}, "Name of a target to export, can be repeated. Defaults to every target")
+	exportCommand.AddCommand(exportPgServiceCommand)
+	rootCmd.AddCommand(exportCommand)
+}
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
+	"strings"
 
 	"github.com/mothership/rds-auth-proxy/pkg/cert"
 	"github.com/mothership/rds-auth-proxy/pkg/file"
@@ -11,51 +13,249 @@ import (
 var genCertsCommand = &cobra.Command{
 	Use:   "gen-cert",
 	Short: "Generates a self-signed certificate",
-	Long:  `Generates a self-signed certificate`,
+	Long: `Generates a self-signed certificate, or with a subcommand, a CA and certificates
+signed by it`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		keyPath, err := cmd.Flags().GetString("key")
+		certPath, keyPath, err := getOutputPaths(cmd, true)
 		if err != nil {
 			return err
 		}
-		if keyPath == "" {
-			return fmt.Errorf("Key path must not be empty")
-		}
 
-		certPath, err := cmd.Flags().GetString("certificate")
+		hosts, err := cmd.Flags().GetString("hosts")
 		if err != nil {
 			return err
 		}
-		if certPath == "" {
-			return fmt.Errorf("Certificate path must not be empty")
+
+		certBytes, keyBytes, err := cert.GenerateSelfSignedCert(hosts, false)
+		if err != nil {
+			return err
 		}
+		return saveCertificate(certPath, certBytes, keyPath, keyBytes)
+	},
+}
 
-		if file.Exists(certPath) || file.Exists(keyPath) {
-			return fmt.Errorf("certificate/key already exists at this location")
+var genCACommand = &cobra.Command{
+	Use:   "ca",
+	Short: "Generates a certificate authority",
+	Long: `Generates a self-signed certificate authority, to sign server and client certificates
+with. Use it as a target's root_certificate, or the server proxy's client_ca.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		certPath, keyPath, err := getOutputPaths(cmd, true)
+		if err != nil {
+			return err
+		}
+		opts, err := getCertOptions(cmd)
+		if err != nil {
+			return err
+		}
+		certBytes, keyBytes, err := cert.GenerateCA(opts)
+		if err != nil {
+			return err
 		}
+		return saveCertificate(certPath, certBytes, keyPath, keyBytes)
+	},
+}
 
-		hosts, err := cmd.Flags().GetString("hosts")
+var genServerCertCommand = &cobra.Command{
+	Use:   "server",
+	Short: "Generates a server certificate signed by a CA",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return issueCertificate(cmd, false)
+	},
+}
+
+var genClientCertCommand = &cobra.Command{
+	Use:   "client",
+	Short: "Generates a client certificate signed by a CA",
+	Long: `Generates a client certificate signed by a CA, for mTLS. The common name is what
+rds-auth-proxy:allowed-clients and allowed_clients match against.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return issueCertificate(cmd, true)
+	},
+}
+
+var signCSRCommand = &cobra.Command{
+	Use:   "sign-csr",
+	Short: "Signs a certificate request with a CA",
+	Long: `Signs a pem-encoded certificate request with a CA. The common name and hosts come
+from the request, unless --common-name, --organization, or --hosts are set.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		certPath, _, err := getOutputPaths(cmd, false)
+		if err != nil {
+			return err
+		}
+		ca, err := loadCA(cmd)
+		if err != nil {
+			return err
+		}
+		opts, err := getCertOptions(cmd)
+		if err != nil {
+			return err
+		}
+		opts.ClientAuth, err = cmd.Flags().GetBool("client")
 		if err != nil {
 			return err
 		}
 
-		certBytes, keyBytes, err := cert.GenerateSelfSignedCert(hosts, false)
+		csrPath, err := cmd.Flags().GetString("csr")
+		if err != nil {
+			return err
+		}
+		csrBytes, err := ioutil.ReadFile(csrPath)
 		if err != nil {
 			return err
 		}
-		err = cert.Save(certPath, certBytes)
+		certBytes, err := ca.SignCSR(csrBytes, opts)
 		if err != nil {
 			return err
 		}
-		return cert.Save(keyPath, keyBytes)
+		return cert.Save(certPath, certBytes)
 	},
 }
 
+// issueCertificate generates a key and certificate signed by the CA
+func issueCertificate(cmd *cobra.Command, clientAuth bool) error {
+	certPath, keyPath, err := getOutputPaths(cmd, true)
+	if err != nil {
+		return err
+	}
+	ca, err := loadCA(cmd)
+	if err != nil {
+		return err
+	}
+	opts, err := getCertOptions(cmd)
+	if err != nil {
+		return err
+	}
+	opts.ClientAuth = clientAuth
+
+	certBytes, keyBytes, err := ca.Issue(opts)
+	if err != nil {
+		return err
+	}
+	return saveCertificate(certPath, certBytes, keyPath, keyBytes)
+}
+
+// getOutputPaths returns the certificate and key paths, which must not exist yet
+func getOutputPaths(cmd *cobra.Command, needKey bool) (string, string, error) {
+	certPath, err := cmd.Flags().GetString("certificate")
+	if err != nil {
+		return "", "", err
+	}
+	if certPath == "" {
+		return "", "", fmt.Errorf("Certificate path must not be empty")
+	}
+	if file.Exists(certPath) {
+		return "", "", fmt.Errorf("certificate already exists at this location")
+	}
+	if !needKey {
+		return certPath, "", nil
+	}
+
+	keyPath, err := cmd.Flags().GetString("key")
+	if err != nil {
+		return "", "", err
+	}
+	if keyPath == "" {
+		return "", "", fmt.Errorf("Key path must not be empty")
+	}
+	if file.Exists(keyPath) {
+		return "", "", fmt.Errorf("key already exists at this location")
+	}
+	return certPath, keyPath, nil
+}
+
+func getCertOptions(cmd *cobra.Command) (cert.Options, error) {
+	opts := cert.Options{}
+	var err error
+	if opts.CommonName, err = cmd.Flags().GetString("common-name"); err != nil {
+		return opts, err
+	}
+	if opts.Organization, err = cmd.Flags().GetString("organization"); err != nil {
+		return opts, err
+	}
+	if opts.Validity, err = cmd.Flags().GetDuration("validity"); err != nil {
+		return opts, err
+	}
+	if cmd.Flags().Lookup("key-type") != nil {
+		keyType, err := cmd.Flags().GetString("key-type")
+		if err != nil {
+			return opts, err
+		}
+		opts.KeyType = cert.KeyType(keyType)
+	}
+	if cmd.Flags().Lookup("hosts") != nil {
+		hosts, err := cmd.Flags().GetString("hosts")
+		if err != nil {
+			return opts, err
+		}
+		if hosts != "" {
+			opts.Hosts = strings.Split(hosts, ",")
+		}
+	}
+	return opts, nil
+}
+
+func loadCA(cmd *cobra.Command) (*cert.CA, error) {
+	caCertPath, err := cmd.Flags().GetString("ca-cert")
+	if err != nil {
+		return nil, err
+	}
+	caKeyPath, err := cmd.Flags().GetString("ca-key")
+	if err != nil {
+		return nil, err
+	}
+	certBytes, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := ioutil.ReadFile(caKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return cert.LoadCA(certBytes, keyBytes)
+}
+
+func saveCertificate(certPath string, certBytes []byte, keyPath string, keyBytes []byte) error {
+	if err := cert.Save(certPath, certBytes); err != nil {
+		return err
+	}
+	return cert.Save(keyPath, keyBytes)
+}
+
 func init() {
 	rootCmd.AddCommand(genCertsCommand)
 	genCertsCommand.PersistentFlags().String("certificate", "", "Path to generate the certificate")
 	_ = genCertsCommand.MarkPersistentFlagRequired("certificate")
 	genCertsCommand.PersistentFlags().String("key", "", "Path to generate the private key")
-	_ = genCertsCommand.MarkPersistentFlagRequired("key")
 
-	genCertsCommand.PersistentFlags().String("hosts", "rds-auth-proxy", "Comma separated list of hosts to add to the certificate")
+	genCertsCommand.Flags().String("hosts", "rds-auth-proxy", "Comma separated list of hosts to add to the certificate")
+
+	for _, command := range []*cobra.Command{genCACommand, genServerCertCommand, genClientCertCommand, signCSRCommand} {
+		genCertsCommand.AddCommand(command)
+		command.Flags().String("common-name", "", "Subject common name, defaults to the first host")
+		if command != signCSRCommand {
+			command.Flags().String("organization", cert.DefaultOrganization, "Subject organization")
+			command.Flags().String("key-type", string(cert.KeyTypeECDSA), "Type of private key to generate, one of rsa, ecdsa, or ed25519")
+		}
+		if command != genCACommand {
+			command.Flags().String("ca-cert", "", "Path to the pem-encoded CA certificate to sign with")
+			_ = command.MarkFlagRequired("ca-cert")
+			command.Flags().String("ca-key", "", "Path to the pem-encoded CA private key to sign with")
+			_ = command.MarkFlagRequired("ca-key")
+		}
+	}
+
+	genCACommand.Flags().Duration("validity", cert.DefaultCAValidity, "How long the CA is valid for")
+	genServerCertCommand.Flags().Duration("validity", cert.DefaultValidity, "How long the certificate is valid for")
+	genServerCertCommand.Flags().String("hosts", "rds-auth-proxy", "Comma separated list of hosts to add to the certificate")
+	genClientCertCommand.Flags().Duration("validity", cert.DefaultValidity, "How long the certificate is valid for")
+	genClientCertCommand.Flags().String("hosts", "", "Comma separated list of hosts to add to the certificate")
+
+	signCSRCommand.Flags().Duration("validity", cert.DefaultValidity, "How long the certificate is valid for")
+	signCSRCommand.Flags().String("hosts", "", "Comma separated list of hosts to add to the certificate, instead of the request's")
+	signCSRCommand.Flags().String("organization", "", "Subject organization, instead of the request's")
+	signCSRCommand.Flags().String("csr", "", "Path to the pem-encoded certificate request")
+	_ = signCSRCommand.MarkFlagRequired("csr")
+	signCSRCommand.Flags().Bool("client", false, "Sign a client certificate, for mTLS, instead of a server certificate")
 }
@@ -2,23 +2,25 @@ package cmd
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/mothership/rds-auth-proxy/pkg/aws"
+	"github.com/mothership/rds-auth-proxy/pkg/cert"
 	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+	credentialsFactory "github.com/mothership/rds-auth-proxy/pkg/credentials/factory"
 	"github.com/mothership/rds-auth-proxy/pkg/discovery"
-	discoveryFactory "github.com/mothership/rds-auth-proxy/pkg/discovery/factory"
 	"github.com/mothership/rds-auth-proxy/pkg/kubernetes"
 	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"github.com/mothership/rds-auth-proxy/pkg/pg"
 	"github.com/mothership/rds-auth-proxy/pkg/proxy"
+	"github.com/mothership/rds-auth-proxy/pkg/sshtunnel"
+	"github.com/mothership/rds-auth-proxy/pkg/upstream"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -29,32 +31,27 @@ var proxyClientCommand = &cobra.Command{
 	Short: "Launches the localhost proxy",
 	Long:  `Runs a localhost proxy service in-cluster for connecting to RDS.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		logCfg := zap.NewDevelopmentConfig()
-		logCfg.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
-		logCfg.Development = false
-		logger, err := logCfg.Build(zap.WithCaller(false))
-		if err != nil {
+		if err := setupClientLogger(zapcore.InfoLevel); err != nil {
 			return err
 		}
-		log.SetLogger(logger)
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		rdsClient, err := aws.NewRDSClient(ctx)
+		awsClient, err := aws.NewRDSClient(ctx)
 		if err != nil {
 			return err
 		}
-		filepath, err := cmd.Flags().GetString("configfile")
+		// GUI tools tend to open several connections at once, reuse tokens
+		// rather than signing a new one for each
+		rdsClient := aws.NewTokenCache(awsClient, aws.DefaultTokenMaxAge)
+		cfg, discoveryClient, err := loadDiscovery(ctx, cmd, rdsClient)
 		if err != nil {
 			return err
 		}
-		cfg, err := config.LoadConfig(filepath)
+
+		credentialProviders, err := credentialsFactory.FromTargets(ctx, cfg.Targets)
 		if err != nil {
 			return err
 		}
-		discoveryClient := discoveryFactory.FromConfig(rdsClient, &cfg)
-		if err := discoveryClient.Refresh(ctx); err != nil {
-			return err
-		}
 
 		// Look up the proxy target
 		proxyTarget, err := getProxyTarget(cmd, cfg.ProxyTargets)
@@ -62,113 +59,288 @@ var proxyClientCommand = &cobra.Command{
 			return err
 		}
 
-		// Look up the real target name in the target list
-		target, err := getTarget(cmd, discoveryClient)
+		// Optionally grab the password
+		pass, err := cmd.Flags().GetString("password")
 		if err != nil {
 			return err
 		}
-		// Override local port if needed
-		if target.LocalPort != nil {
-			addr, err := net.ResolveTCPAddr("tcp", cfg.Proxy.ListenAddr)
-			if err != nil {
-				return err
-			}
-			cfg.Proxy.ListenAddr = fmt.Sprintf("%s:%s", addr.IP, *target.LocalPort)
-		}
 
-		// Optionally grab the password
-		pass, err := cmd.Flags().GetString("password")
+		routed, err := cmd.Flags().GetBool("routed")
 		if err != nil {
 			return err
 		}
 
-		err = printConnectionString(cfg.Proxy.ListenAddr, target)
+		hostPool, err := newHostPool(ctx, proxyTarget, cfg.Proxy.SSL)
 		if err != nil {
 			return err
 		}
 
-		if proxyTarget.PortForward != nil {
-			// setup port-forward
-			prtCmd, err := kubernetes.BuildPortForwardCommand(ctx, proxyTarget.PortForward.KubeConfigFilePath, kubernetes.PortForwardOptions{
-				Namespace:  proxyTarget.PortForward.Namespace,
-				Deployment: proxyTarget.PortForward.DeploymentName,
-				Ports:      []string{fmt.Sprintf("%s:%s", proxyTarget.PortForward.GetLocalPort(), proxyTarget.PortForward.RemotePort)},
-				Context:    proxyTarget.PortForward.Context,
-			})
+		var listeners []clientListener
+		if routed {
+			// One port for every target, picked per connection
+			err = printRoutedConnectionString(cfg.Proxy.ListenAddr)
 			if err != nil {
 				return err
 			}
-
-			go func() {
-				if err := kubernetes.ForwardPort(ctx, prtCmd); err != nil {
-					// TODO: blow this up gracefully
-					log.Error("k8s port-forward caught error", zap.Error(err), zap.String("listen_addr", proxyTarget.GetHost()))
-					panic(err)
-				}
-				log.Info("k8s port-forward exited", zap.String("listen_addr", proxyTarget.GetHost()))
-			}()
-			<-prtCmd.ReadyChannel
-			ports, err := prtCmd.PortForwarder.GetPorts()
+			RefreshTargets(ctx, discoveryClient, 1*time.Minute)
+			listeners = []clientListener{{
+				name:        "routed",
+				listenAddr:  cfg.Proxy.ListenAddr,
+				interceptor: routedCredentialInterceptor(ctx, rdsClient, discoveryClient, proxyTarget, hostPool, pass, credentialProviders),
+			}}
+		} else {
+			// Look up the real target names in the target list
+			targets, err := getTargets(cmd, discoveryClient, cfg.Sessions)
+			if err != nil {
+				return err
+			}
+			listenAddrs, err := targetListenAddrs(cfg.Proxy.ListenAddr, targets)
 			if err != nil {
 				return err
 			}
-			portUsed := fmt.Sprintf("%d", ports[0].Local)
-			proxyTarget.PortForward.LocalPort = &portUsed
-			log.Info("started k8s port-forward", zap.String("listen_addr", proxyTarget.GetHost()))
+			for idx, target := range targets {
+				err = printConnectionString(listenAddrs[idx], target)
+				if err != nil {
+					return err
+				}
+				listeners = append(listeners, clientListener{
+					name:        target.Name,
+					listenAddr:  listenAddrs[idx],
+					interceptor: clientCredentialInterceptor(ctx, rdsClient, proxyTarget, hostPool, target, pass, credentialProviders),
+				})
+			}
 		}
 
-		log.Info("starting client proxy", zap.String("listen_addr", cfg.Proxy.ListenAddr))
-		opts, err := proxySSLOptions(cfg.Proxy.SSL)
-		if err != nil {
+		if _, err := startUpstreamTunnel(ctx, proxyTarget); err != nil {
 			return err
 		}
 
-		manager, err := proxy.NewManager(proxy.MergeOptions(opts, []proxy.Option{
-			proxy.WithListenAddress(cfg.Proxy.ListenAddr),
-			proxy.WithMode(proxy.ClientSide),
-			proxy.WithCredentialInterceptor(func(creds *proxy.Credentials) error {
-				// Send this connection to the proxy host
-				creds.Host = proxyTarget.GetHost()
-				// But tell the server proxy to forward to the target host
-				creds.Options["host"] = target.Host
-
-				// Use provided password, or generate an RDS password to forward through
-				if pass != "" {
-					creds.Password = pass
-				} else if target.IsRDS {
-					authToken, err := rdsClient.NewAuthToken(ctx, target.Host, target.Region, creds.Username)
-					if err != nil {
-						return err
-					}
-					creds.Password = authToken
-				}
-
-				return overrideSSLConfig(creds, proxyTarget.SSL)
-			})})...,
-		)
+		opts, err := proxySSLOptions(ctx, cfg.Proxy.SSL)
 		if err != nil {
 			return err
 		}
 
-		// Shutdown app on SIGINT/SIGTERM
+		// One proxy per listener, all sharing the same upstream proxy and port-forward
+		managers := make([]*proxy.Manager, 0, len(listeners))
+		for _, listener := range listeners {
+			log.Info("starting client proxy", zap.String("listen_addr", listener.listenAddr), zap.String("target", listener.name))
+			manager, err := proxy.NewManager(proxy.MergeOptions(opts, []proxy.Option{
+				proxy.WithListenAddress(listener.listenAddr),
+				proxy.WithMode(proxy.ClientSide),
+				proxy.WithCredentialInterceptor(listener.interceptor),
+			})...)
+			if err != nil {
+				return err
+			}
+			managers = append(managers, manager)
+		}
+
+		// Shutdown app on SIGINT/SIGTERM, or if any proxy fails to start
+		errs := make(chan error, len(managers))
+		for _, manager := range managers {
+			go func(manager *proxy.Manager) {
+				errs <- manager.Start(ctx)
+			}(manager)
+		}
 		signals := make(chan os.Signal, 1)
-		go func() {
-			_ = manager.Start(ctx)
-			close(signals)
-		}()
 		signal.Notify(signals, os.Interrupt)
-		<-signals
-		cancel()
-		return nil
+		select {
+		case <-signals:
+			return nil
+		case err := <-errs:
+			return err
+		}
 	},
 }
 
+// clientListener is a local address and how connections to it are routed
+type clientListener struct {
+	name        string
+	listenAddr  string
+	interceptor proxy.CredentialInterceptor
+}
+
+// routedCredentialInterceptor looks up the target for each connection from
+// its startup message, and then routes it like a single target connection
+func routedCredentialInterceptor(ctx context.Context, rdsClient aws.RDSClient, discoveryClient discovery.Client, proxyTarget *config.ProxyTarget, hostPool proxy.HostPool, pass string, providers map[string]credentials.Provider) proxy.CredentialInterceptor {
+	return func(creds *proxy.Credentials) error {
+		name := proxy.ExtractTargetName(creds)
+		if name == "" {
+			return pg.NewAuthFailedError(fmt.Errorf("no target given, connect to database \"<target>/<database>\" or set options=\"-c target=<target>\""))
+		}
+		target, err := discoveryClient.LookupTargetByName(name)
+		if err != nil {
+			log.Warn("client asked for unknown target", zap.String("target", name))
+			return pg.NewAuthFailedError(fmt.Errorf("target %q not found", name))
+		}
+		log.Info("routing connection", zap.String("target", target.Name), zap.String("database", creds.Database))
+		return clientCredentialInterceptor(ctx, rdsClient, proxyTarget, hostPool, target, pass, providers)(creds)
+	}
+}
+
+// clientCredentialInterceptor sends connections for target through the upstream
+// proxy, or through one of the hosts in hostPool when it has several
+func clientCredentialInterceptor(ctx context.Context, rdsClient aws.RDSClient, proxyTarget *config.ProxyTarget, hostPool proxy.HostPool, target config.Target, pass string, providers map[string]credentials.Provider) proxy.CredentialInterceptor {
+	return func(creds *proxy.Credentials) error {
+		// Send this connection to the proxy host
+		creds.Host = proxyTarget.GetHost()
+		creds.HostPool = hostPool
+		// But tell the server proxy to forward to the target host, or one of
+		// its replicas. IAM tokens are only valid for the host they were made
+		// for, so the replica is picked here rather than by the server proxy.
+		hosts, err := sessionReplicas.hosts(target, creds)
+		if err != nil {
+			return err
+		}
+
+		// Use provided password, or generate an RDS password to forward through
+		sign := false
+		if pass != "" {
+			creds.Password = pass
+		} else if provider, ok := providers[target.Name]; ok {
+			if err := applyCredentials(ctx, provider, creds); err != nil {
+				return err
+			}
+		} else {
+			sign = target.IsRDS
+		}
+		setHost := func(host string) error {
+			creds.Options["host"] = host
+			if !sign {
+				return nil
+			}
+			authToken, err := rdsClient.NewAuthToken(ctx, host, target.Region, creds.Username)
+			if err != nil {
+				return err
+			}
+			creds.Password = authToken
+			return nil
+		}
+		if err := setHost(hosts[0]); err != nil {
+			return err
+		}
+		// The server proxy tells us when it can't reach the replica, so move
+		// on to the next one, or the writer
+		if len(hosts) > 1 {
+			creds.Retry = sessionReplicas.retry(target, hosts, setHost)
+		}
+
+		return overrideSSLConfig(creds, proxyTarget.SSL)
+	}
+}
+
+// startUpstreamTunnel opens the port-forward or SSH tunnel to the upstream
+// proxy, if it needs one. The returned channel is closed once it's shut down
+// after ctx is canceled, and is nil without a tunnel.
+func startUpstreamTunnel(ctx context.Context, proxyTarget *config.ProxyTarget) (<-chan struct{}, error) {
+	if proxyTarget.PortForward != nil && proxyTarget.SSH != nil {
+		return nil, fmt.Errorf("proxy target %q can't set both port_forward and ssh", proxyTarget.Name)
+	}
+	if proxyTarget.PortForward != nil {
+		return startPortForward(ctx, proxyTarget)
+	}
+	if proxyTarget.SSH != nil {
+		return startSSHTunnel(ctx, proxyTarget)
+	}
+	return nil, nil
+}
+
+// newHostPool returns a pool of the upstream proxy's hosts, probed until ctx
+// is canceled, or nil if it only has one host. Probes present the proxy's
+// client certificate, if it has one, for upstream proxies with a client CA.
+func newHostPool(ctx context.Context, proxyTarget *config.ProxyTarget, ssl config.ServerSSL) (proxy.HostPool, error) {
+	if len(proxyTarget.Hosts) > 0 && (proxyTarget.PortForward != nil || proxyTarget.SSH != nil) {
+		return nil, fmt.Errorf("proxy target %q can't set hosts with port_forward or ssh", proxyTarget.Name)
+	}
+	hosts := proxyTarget.GetHosts()
+	if len(hosts) < 2 {
+		return nil, nil
+	}
+	pool, err := upstream.NewPool(hosts, upstream.Strategy(proxyTarget.Strategy))
+	if err != nil {
+		return nil, fmt.Errorf("proxy target %q: %w", proxyTarget.Name, err)
+	}
+	if ssl.ClientCertificatePath != nil && ssl.ClientPrivateKeyPath != nil {
+		keyPair, err := cert.DefaultStore.KeyPair(*ssl.ClientCertificatePath, *ssl.ClientPrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		pool.GetClientCertificate = keyPair.GetClientCertificate
+	}
+	go pool.Probe(ctx, proxyTarget.HealthCheckInterval)
+	log.Info("using upstream proxy hosts", zap.Strings("hosts", hosts), zap.String("strategy", proxyTarget.Strategy))
+	return pool, nil
+}
+
+// startSSHTunnel opens an SSH tunnel to the upstream proxy through a bastion,
+// and updates its local port once the tunnel is ready
+func startSSHTunnel(ctx context.Context, proxyTarget *config.ProxyTarget) (<-chan struct{}, error) {
+	opts, err := sshtunnel.FromConfig(proxyTarget.SSH)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := sshtunnel.Start(ctx, opts, fmt.Sprintf("127.0.0.1:%s", proxyTarget.SSH.GetLocalPort()), proxyTarget.Host)
+	if err != nil {
+		return nil, err
+	}
+	portUsed := fmt.Sprintf("%d", tunnel.Addr().(*net.TCPAddr).Port)
+	proxyTarget.SSH.LocalPort = &portUsed
+	log.Info("started ssh tunnel", zap.String("listen_addr", proxyTarget.GetHost()), zap.String("bastion", opts.Bastion.Addr))
+	return tunnel.Done(), nil
+}
+
+// startPortForward opens a port-forward to the upstream proxy, and updates
+// its local port once the tunnel is ready. The port-forward reconnects on
+// the same local port if it drops, until ctx is canceled.
+func startPortForward(ctx context.Context, proxyTarget *config.ProxyTarget) (<-chan struct{}, error) {
+	supervisor, err := kubernetes.NewSupervisor(proxyTarget.PortForward.KubeConfigFilePath, kubernetes.PortForwardOptions{
+		Namespace:  proxyTarget.PortForward.Namespace,
+		Deployment: proxyTarget.PortForward.DeploymentName,
+		Selector:   proxyTarget.PortForward.Selector,
+		Service:    proxyTarget.PortForward.ServiceName,
+		Pod:        proxyTarget.PortForward.PodName,
+		Ports:      []string{fmt.Sprintf("%s:%s", proxyTarget.PortForward.GetLocalPort(), proxyTarget.PortForward.RemotePort)},
+		Context:    proxyTarget.PortForward.Context,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ports, err := supervisor.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	portUsed := fmt.Sprintf("%d", ports[0])
+	proxyTarget.PortForward.LocalPort = &portUsed
+	log.Info("started k8s port-forward", zap.String("listen_addr", proxyTarget.GetHost()))
+	return supervisor.Done(), nil
+}
+
+// targetListenAddrs returns the local listen address for each target, and
+// errors if two targets would share an address
+func targetListenAddrs(defaultAddr string, targets []config.Target) ([]string, error) {
+	addrs := make([]string, 0, len(targets))
+	used := make(map[string]string, len(targets))
+	for _, target := range targets {
+		listenAddr, err := target.GetListenAddr(defaultAddr)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := used[listenAddr]; ok {
+			return nil, fmt.Errorf("targets %q and %q would both listen on %s, set a local_port for one of them", other, target.Name, listenAddr)
+		}
+		used[listenAddr] = target.Name
+		addrs = append(addrs, listenAddr)
+	}
+	return addrs, nil
+}
+
 func printConnectionString(listenAddr string, target config.Target) error {
-	addr, err := net.ResolveTCPAddr("tcp", listenAddr)
+	host, port, err := libpqHostPort(listenAddr)
 	if err != nil {
 		return err
 	}
-	start := fmt.Sprintf("psql -h %s -p %d", addr.IP, addr.Port)
+	start := fmt.Sprintf("psql -h %s -p %s", host, port)
 	if target.DefaultDatabase != nil && *target.DefaultDatabase != "" {
 		start += fmt.Sprintf(" -d %s", *target.DefaultDatabase)
 	} else {
@@ -179,6 +351,16 @@ func printConnectionString(listenAddr string, target config.Target) error {
 	return nil
 }
 
+func printRoutedConnectionString(listenAddr string) error {
+	host, port, err := libpqHostPort(listenAddr)
+	if err != nil {
+		return err
+	}
+	start := fmt.Sprintf("psql -h %s -p %s -d {target}/{your_database} -U {your user}", host, port)
+	fmt.Printf("Setting up a tunnel to every target\n\nGive this a second, then in a new shell, connect with:\n\n\t%s\n\n", start)
+	return nil
+}
+
 func getProxyTarget(cmd *cobra.Command, targets map[string]*config.ProxyTarget) (*config.ProxyTarget, error) {
 	// Look up the proxy target
 	proxyName, err := cmd.Flags().GetString("proxy-target")
@@ -187,7 +369,7 @@ func getProxyTarget(cmd *cobra.Command, targets map[string]*config.ProxyTarget)
 	}
 	proxyTarget, ok := targets[proxyName]
 	if ok {
-		return proxyTarget, nil
+		return proxyTarget, validateProxyTarget(proxyTarget)
 	}
 
 	opts := make([]string, 0, len(targets))
@@ -206,18 +388,45 @@ func getProxyTarget(cmd *cobra.Command, targets map[string]*config.ProxyTarget)
 	}
 	proxyTarget, ok = targets[proxyName]
 	if ok {
-		return proxyTarget, nil
+		return proxyTarget, validateProxyTarget(proxyTarget)
 	}
 	return nil, fmt.Errorf("couldn't find a proxy target")
 }
 
-func getTarget(cmd *cobra.Command, discoveryClient discovery.Client) (config.Target, error) {
-	targetName, err := cmd.Flags().GetString("target")
+// validateProxyTarget checks settings that would otherwise only fail on the
+// first connection
+func validateProxyTarget(proxyTarget *config.ProxyTarget) error {
+	if err := proxyTarget.SSL.Validate(); err != nil {
+		return fmt.Errorf("proxy target %q: %w", proxyTarget.Name, err)
+	}
+	return nil
+}
+
+// getTargets returns the targets passed with --target, or the sessions in the
+// config file, or prompts for a single target if neither are set
+func getTargets(cmd *cobra.Command, discoveryClient discovery.Client, sessions []config.Session) ([]config.Target, error) {
+	targetNames, err := cmd.Flags().GetStringSlice("target")
 	if err != nil {
-		return config.Target{}, err
+		return nil, err
 	}
 
-	if targetName == "" {
+	if len(targetNames) == 0 && len(sessions) > 0 {
+		targets := make([]config.Target, 0, len(sessions))
+		for _, session := range sessions {
+			target, err := lookupTarget(discoveryClient, session.Target)
+			if err != nil {
+				return nil, err
+			}
+			if session.LocalPort != nil {
+				target.LocalPort = session.LocalPort
+			}
+			targets = append(targets, target)
+		}
+		return targets, nil
+	}
+
+	if len(targetNames) == 0 {
+		var targetName string
 		targets := discoveryClient.GetTargets()
 		opts := make([]string, 0, len(targets))
 		for _, target := range targets {
@@ -229,42 +438,94 @@ func getTarget(cmd *cobra.Command, discoveryClient discovery.Client) (config.Tar
 		}
 
 		if err := survey.AskOne(prompt, &targetName); err != nil {
-			return config.Target{}, err
+			return nil, err
+		}
+		targetNames = []string{targetName}
+	}
+
+	targets := make([]config.Target, 0, len(targetNames))
+	for _, name := range targetNames {
+		target, err := lookupTarget(discoveryClient, name)
+		if err != nil {
+			return nil, err
 		}
+		targets = append(targets, target)
 	}
-	return discoveryClient.LookupTargetByName(targetName)
+	return targets, nil
 }
 
+func lookupTarget(discoveryClient discovery.Client, name string) (config.Target, error) {
+	target, err := discoveryClient.LookupTargetByName(name)
+	if err != nil {
+		return target, fmt.Errorf("target %q: %w", name, err)
+	}
+	return target, nil
+}
+
+// applyCredentials sets the password, and optionally the username, from a
+// target's credential provider
+func applyCredentials(ctx context.Context, provider credentials.Provider, creds *proxy.Credentials) error {
+	targetCreds, err := provider.Credentials(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look up credentials: %w", err)
+	}
+	if targetCreds.Username != "" {
+		creds.Username = targetCreds.Username
+	}
+	creds.Password = targetCreds.Password
+	return nil
+}
+
+// overrideSSLConfig sets the upstream SSL settings for a target. Certificates
+// come from the store, so they're read once and reloaded when they change.
 func overrideSSLConfig(creds *proxy.Credentials, ssl config.SSL) error {
-	creds.SSLMode = ssl.Mode
+	creds.SSL.Mode = ssl.Mode
+	creds.SSL.Negotiation = ssl.Negotiation
 	// If the config wants us to use a specific SSL client cert, load it
 	if ssl.ClientCertificatePath != nil {
-		// TODO: load sooner / cache
-		cert, err := tls.LoadX509KeyPair(*ssl.ClientCertificatePath, *ssl.ClientPrivateKeyPath)
+		keyPair, err := cert.DefaultStore.KeyPair(*ssl.ClientCertificatePath, *ssl.ClientPrivateKeyPath)
 		if err != nil {
 			return err
 		}
-		creds.ClientCertificate = &cert
+		creds.SSL.ClientCertificate = keyPair.Certificate()
 	}
 
-	// If the config wants us to validate the cert chain goes to a specific root cert for the server proxy
-	// load it, and set it
-	if ssl.RootCertificatePath != nil {
-		rootCABytes, err := ioutil.ReadFile(*ssl.RootCertificatePath)
-		if err != nil {
-			return err
-		}
-		decoded, _ := pem.Decode(rootCABytes)
-		cert, err := x509.ParseCertificate(decoded.Bytes)
-		if err != nil {
-			return err
+	// If the config wants us to validate the cert chain goes to specific root certs, load them.
+	// The system's CAs are only trusted without them, or if "system" is listed.
+	creds.SSL.SystemRoots = false
+	for _, root := range ssl.RootCertificates() {
+		switch root {
+		case pg.SSLRootCertSystem:
+			creds.SSL.SystemRoots = true
+		case config.RootCertificateRDS:
+			creds.SSL.RootCertificates = append(creds.SSL.RootCertificates, aws.RDSCertificates()...)
+		default:
+			bundle, err := cert.DefaultStore.Bundle(root)
+			if err != nil {
+				return err
+			}
+			creds.SSL.RootCertificates = append(creds.SSL.RootCertificates, bundle.Certificates()...)
 		}
-		creds.RootCertificate = cert
 	}
+
+	pins, err := pg.ParsePublicKeyPins(ssl.PinnedPublicKeys)
+	if err != nil {
+		return err
+	}
+	creds.SSL.PinnedPublicKeys = pins
 	return nil
 }
 
-func proxySSLOptions(ssl config.ServerSSL) ([]proxy.Option, error) {
+// certificateExpiryInterval is how often the days until each certificate
+// expires are logged
+const certificateExpiryInterval = 24 * time.Hour
+
+// proxySSLOptions returns the proxy's certificate options, and starts
+// reloading certificates when their files change until ctx is canceled
+func proxySSLOptions(ctx context.Context, ssl config.ServerSSL) ([]proxy.Option, error) {
+	if err := cert.DefaultStore.Watch(ctx, certificateExpiryInterval); err != nil {
+		return nil, err
+	}
 	opts := make([]proxy.Option, 0, 2)
 	if ssl.Enabled {
 		if ssl.CertificatePath == nil && ssl.PrivateKeyPath == nil {
@@ -274,6 +535,11 @@ func proxySSLOptions(ssl config.ServerSSL) ([]proxy.Option, error) {
 		} else {
 			return opts, fmt.Errorf("bad options: when ssl is enabled, either both a certificate and key must be provided, or neither provided")
 		}
+		if ssl.ClientCAPath != nil {
+			opts = append(opts, proxy.WithClientCAs(*ssl.ClientCAPath))
+		}
+	} else if ssl.ClientCAPath != nil {
+		return opts, fmt.Errorf("bad options: a client CA requires ssl to be enabled")
 	}
 
 	if ssl.ClientCertificatePath == nil && ssl.ClientPrivateKeyPath == nil {
@@ -289,9 +555,10 @@ func proxySSLOptions(ssl config.ServerSSL) ([]proxy.Option, error) {
 
 func init() {
 	proxyClientCommand.PersistentFlags().String("proxy-target", "default", "Name of the proxy target in the configfile")
-	proxyClientCommand.PersistentFlags().String("target", "", "Name of the target, or db instance identifier that you wish to connect to")
+	proxyClientCommand.PersistentFlags().StringSlice("target", []string{}, "Name of the target, or db instance identifier that you wish to connect to. Can be repeated to open several tunnels")
 	proxyClientCommand.PersistentFlags().String("configfile", "", "Path to the proxy config file")
 	_ = proxyClientCommand.MarkPersistentFlagDirname("configfile")
+	proxyClientCommand.PersistentFlags().Bool("routed", false, "Listen on a single port, and pick the target for each connection from the database name (<target>/<database>) or options (-c target=<target>)")
 	proxyClientCommand.PersistentFlags().String("password", "", "Password for the user if IAM auth is not set up")
 	rootCmd.AddCommand(proxyClientCommand)
 }
@@ -2,15 +2,21 @@ package cmd
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"net"
+	"net/http"
 	"time"
 
 	"github.com/mothership/rds-auth-proxy/pkg/aws"
 	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+	credentialsFactory "github.com/mothership/rds-auth-proxy/pkg/credentials/factory"
 	"github.com/mothership/rds-auth-proxy/pkg/discovery"
-	discoveryFactory "github.com/mothership/rds-auth-proxy/pkg/discovery/factory"
 	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"github.com/mothership/rds-auth-proxy/pkg/pg"
 	"github.com/mothership/rds-auth-proxy/pkg/proxy"
+	"github.com/mothership/rds-auth-proxy/pkg/proxyproto"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -25,50 +31,222 @@ var proxyServerCommand = &cobra.Command{
 		defer cancel()
 
 		logger := log.NewLogger()
-		filepath, err := cmd.Flags().GetString("configfile")
+		awsClient, err := aws.NewRDSClient(ctx)
 		if err != nil {
 			return err
 		}
-		rdsClient, err := aws.NewRDSClient(ctx)
+		rdsClient := aws.NewTokenCache(awsClient, aws.DefaultTokenMaxAge)
+		cfg, discoveryClient, err := loadDiscovery(ctx, cmd, rdsClient)
 		if err != nil {
 			return err
 		}
-		cfg, err := config.LoadConfig(filepath)
+
+		credentialProviders, err := credentialsFactory.FromTargets(ctx, cfg.Targets)
 		if err != nil {
 			return err
 		}
-		discoveryClient := discoveryFactory.FromConfig(rdsClient, &cfg)
-		if err := discoveryClient.Refresh(ctx); err != nil {
-			return err
+
+		for name, target := range cfg.Targets {
+			if err := target.SSL.Validate(); err != nil {
+				return fmt.Errorf("target %q: %w", name, err)
+			}
 		}
 
-		opts, err := proxySSLOptions(cfg.Proxy.SSL)
+		opts, err := proxySSLOptions(ctx, cfg.Proxy.SSL)
 		if err != nil {
 			return err
 		}
+		if cfg.Proxy.MetricsAddr != "" {
+			if err := serveMetrics(ctx, cfg.Proxy.MetricsAddr); err != nil {
+				return err
+			}
+		}
 		logger.Info("starting server", zap.String("listen_addr", cfg.Proxy.ListenAddr))
 		manager, err := proxy.NewManager(proxy.MergeOptions(opts, []proxy.Option{
 			proxy.WithListenAddress(cfg.Proxy.ListenAddr),
 			proxy.WithMode(proxy.ServerSide),
-			proxy.WithCredentialInterceptor(func(creds *proxy.Credentials) error {
-				hostConfig, err := discoveryClient.LookupTargetByHost(creds.Host)
-				if err != nil {
-					logger.Warn("client attempted to login to unknown host", zap.String("host", creds.Host))
-					return fmt.Errorf("host not allowed by ACL, or not configured for this proxy")
-				}
-				return overrideSSLConfig(creds, hostConfig.SSL)
-			})})...,
-		)
+			proxy.WithProxyProtocol(cfg.Proxy.ProxyProtocol.TrustedCIDRs),
+			proxy.WithCredentialInterceptor(serverCredentialInterceptor(ctx, logger, cfg.Proxy, rdsClient, discoveryClient, credentialProviders)),
+		})...)
 		if err != nil {
 			return err
 		}
 		// TODO: periodic refresh of discovery client
 		RefreshTargets(ctx, discoveryClient, 1*time.Minute)
+		sessionReplicas.probe(ctx, cfg.Proxy.ReplicaHealthCheckInterval)
 		err = manager.Start(ctx)
 		return err
 	},
 }
 
+// serverCredentialInterceptor checks the target a client asked for is allowed, and
+// sets up the credentials for the upstream login
+func serverCredentialInterceptor(ctx context.Context, logger *zap.Logger, proxyCfg config.Proxy, rdsClient aws.RDSClient, discoveryClient discovery.Client, providers map[string]credentials.Provider) proxy.CredentialInterceptor {
+	return func(creds *proxy.Credentials) error {
+		if err := proxyCfg.ClientCIDRs.IsAllowed(creds.ClientAddr); err != nil {
+			logger.Warn("client address refused", zap.Stringer("client_address", creds.ClientAddr), zap.Error(err))
+			return pg.NewAuthFailedError(err)
+		}
+		// Client proxies tell us which host to connect to, direct clients
+		// (ex: psql over a VPN) pick their target by name instead
+		direct := creds.Host == ""
+		var hostConfig config.Target
+		var hosts []string
+		var err error
+		if direct {
+			if !proxyCfg.AllowDirectClients {
+				logger.Warn("direct client connection refused, direct clients are not enabled")
+				return pg.NewAuthFailedError(fmt.Errorf("connect through the rds-auth-proxy client"))
+			}
+			name := proxy.ExtractDirectTargetName(creds)
+			hostConfig, err = discoveryClient.LookupTargetByName(name)
+			if err != nil {
+				logger.Warn("client attempted to login to unknown target", zap.String("target", name))
+				return pg.NewAuthFailedError(fmt.Errorf("target %q not allowed by ACL, or not configured for this proxy", name))
+			}
+			// Client proxies pick the replica themselves
+			hosts, err = sessionReplicas.hosts(hostConfig, creds)
+			if err != nil {
+				logger.Warn("client asked for an unavailable session type", zap.String("target", name), zap.Error(err))
+				return err
+			}
+			creds.Host = hosts[0]
+		} else {
+			hostConfig, err = discoveryClient.LookupTargetByHost(creds.Host)
+			if err != nil {
+				logger.Warn("client attempted to login to unknown host", zap.String("host", creds.Host))
+				return fmt.Errorf("host not allowed by ACL, or not configured for this proxy")
+			}
+		}
+		if err := hostConfig.IsAddrAllowed(creds.ClientAddr); err != nil {
+			logger.Warn("client address not allowed on target",
+				zap.String("host", creds.Host),
+				zap.Stringer("client_address", creds.ClientAddr),
+				zap.Error(err),
+			)
+			return pg.NewAuthFailedError(err)
+		}
+		// The user the client asked for, the target's credentials may replace
+		// it below with one the operator picked
+		if err := hostConfig.IsAllowed(creds.Username, creds.Database); err != nil {
+			logger.Warn("client attempted to login with a disallowed user or database",
+				zap.String("host", creds.Host),
+				zap.String("user", creds.Username),
+				zap.String("database", creds.Database),
+				zap.Error(err),
+			)
+			return pg.NewAuthFailedError(err)
+		}
+		if err := hostConfig.IsClientAllowed(creds.ClientIdentity.Names()); err != nil {
+			logger.Warn("client identity not allowed on target",
+				zap.String("host", creds.Host),
+				zap.Strings("client_identity", creds.ClientIdentity.Names()),
+				zap.Error(err),
+			)
+			return pg.NewAuthFailedError(err)
+		}
+
+		creds.SendProxyHeader = proxyproto.Version(hostConfig.SendProxyProtocol)
+
+		// Whether the password is an IAM auth token the proxy signs, and can
+		// sign again for another host
+		sign := false
+		provider, hasProvider := providers[hostConfig.Name]
+		// Direct clients haven't proven who they are to anyone, so they only
+		// get the target's own credentials with a certificate bound to the user
+		if direct && hasProvider && !clientBoundToUser(hostConfig, creds) {
+			hasProvider = false
+		}
+		if hasProvider {
+			// Log in with the target's own credentials, if it has any
+			if err := applyCredentials(ctx, provider, creds); err != nil {
+				logger.Error("credential lookup failed", zap.String("host", creds.Host), zap.Error(err))
+				return err
+			}
+		} else if direct && creds.Password == "" {
+			sign = signsForClient(hostConfig, creds)
+			if err := directClientPassword(ctx, rdsClient, hostConfig, creds); err != nil {
+				logger.Warn("direct client authentication failed", zap.String("host", creds.Host), zap.Error(err))
+				return pg.NewAuthFailedError(err)
+			}
+		}
+		// Move on to the next replica, or the writer, when one can't be
+		// reached. Not when the client gave us its own IAM auth token, that's
+		// only valid for the first host.
+		if len(hosts) > 1 && (sign || hasProvider || !hostConfig.IsRDS) {
+			creds.Retry = sessionReplicas.retry(hostConfig, hosts, func(host string) error {
+				creds.Host = host
+				if !sign {
+					return nil
+				}
+				authToken, err := rdsClient.NewAuthToken(ctx, host, hostConfig.Region, creds.Username)
+				if err != nil {
+					return err
+				}
+				creds.Password = authToken
+				return nil
+			})
+		}
+		return overrideSSLConfig(creds, hostConfig.SSL)
+	}
+}
+
+// directClientPassword sets the upstream password for a direct client. Clients
+// with a certificate bound to the user on an RDS target are logged in with the
+// server's own IAM identity, everyone else is asked for their password (ex: an
+// IAM auth token).
+func directClientPassword(ctx context.Context, rdsClient aws.RDSClient, target config.Target, creds *proxy.Credentials) error {
+	if signsForClient(target, creds) {
+		authToken, err := rdsClient.NewAuthToken(ctx, creds.Host, target.Region, creds.Username)
+		if err != nil {
+			return err
+		}
+		creds.Password = authToken
+		return nil
+	}
+	password, err := creds.PromptPassword()
+	if err != nil {
+		return err
+	}
+	creds.Password = password
+	return nil
+}
+
+// signsForClient returns whether the server's own IAM identity logs in for
+// the client, because its certificate is bound to the user on an RDS target
+func signsForClient(target config.Target, creds *proxy.Credentials) bool {
+	return target.IsRDS && clientBoundToUser(target, creds)
+}
+
+// clientBoundToUser returns whether the client presented a certificate bound
+// to the user it's logging in as
+func clientBoundToUser(target config.Target, creds *proxy.Credentials) bool {
+	return creds.ClientIdentity != nil && target.IsClientBoundToUser(creds.ClientIdentity.Names(), creds.Username) == nil
+}
+
+// serveMetrics serves the expvars (ex: certificate_expiry_days) at
+// /debug/vars until ctx is canceled
+func serveMetrics(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics_addr: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		log.Info("serving metrics", zap.String("metrics_addr", addr))
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Error("metrics server failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
 func RefreshTargets(ctx context.Context, client discovery.Client, period time.Duration) {
 	go func() {
 		t := time.NewTicker(period)
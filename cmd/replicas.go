@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"github.com/mothership/rds-auth-proxy/pkg/pg"
+	"github.com/mothership/rds-auth-proxy/pkg/proxy"
+	"github.com/mothership/rds-auth-proxy/pkg/upstream"
+	"go.uber.org/zap"
+)
+
+// sessionReplicas is shared by every listener in the process, so replicas
+// that fail on one connection are skipped on the next
+var sessionReplicas = newReplicaPools()
+
+// replicaPools balances read-only sessions across each target's replicas
+type replicaPools struct {
+	lock  sync.Mutex
+	pools map[string]*replicaPool
+	// probeCtx is set when this process can reach the replicas itself, so
+	// their pools are probed every probeInterval until it's canceled
+	probeCtx      context.Context
+	probeInterval time.Duration
+}
+
+type replicaPool struct {
+	replicas string
+	pool     *upstream.Pool
+	cancel   context.CancelFunc
+}
+
+// fallbackPool tries the healthy hosts in the pool, then the fallback host,
+// then the pool's ejected hosts
+type fallbackPool struct {
+	*upstream.Pool
+	fallback string
+}
+
+func (f fallbackPool) Hosts() []string {
+	var healthy, ejected []string
+	for _, host := range f.Pool.Hosts() {
+		if f.IsEjected(host) {
+			ejected = append(ejected, host)
+		} else {
+			healthy = append(healthy, host)
+		}
+	}
+	return append(append(healthy, f.fallback), ejected...)
+}
+
+func newReplicaPools() *replicaPools {
+	return &replicaPools{pools: map[string]*replicaPool{}}
+}
+
+// probe health checks every replica pool each interval until ctx is
+// canceled. Only for the server proxy, client proxies can't reach the
+// replicas, and rely on the server proxy telling them when one is down.
+func (r *replicaPools) probe(ctx context.Context, interval time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.probeCtx = ctx
+	r.probeInterval = interval
+	for _, existing := range r.pools {
+		existing.cancel = r.startProbe(existing.pool)
+	}
+}
+
+func (r *replicaPools) startProbe(pool *upstream.Pool) context.CancelFunc {
+	if r.probeCtx == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(r.probeCtx)
+	go pool.Probe(ctx, r.probeInterval)
+	return cancel
+}
+
+// route returns the hosts a session on target should try, from the
+// target_session_attrs the client asked for or the target's read-only users.
+// Returns nil for sessions that go to the writer.
+func (r *replicaPools) route(target config.Target, creds *proxy.Credentials) (proxy.HostPool, error) {
+	route, err := target.SessionRoute(creds.Username, proxy.ExtractSessionAttrs(creds))
+	if err != nil {
+		return nil, pg.NewAuthFailedError(err)
+	}
+	switch route {
+	case config.RouteReplica:
+		return r.pool(target), nil
+	case config.RoutePreferReplica:
+		return fallbackPool{Pool: r.pool(target), fallback: target.Host}, nil
+	}
+	return nil, nil
+}
+
+// hosts returns the hosts a session on target should try, in order
+func (r *replicaPools) hosts(target config.Target, creds *proxy.Credentials) ([]string, error) {
+	pool, err := r.route(target, creds)
+	if err != nil || pool == nil {
+		return []string{target.Host}, err
+	}
+	return pool.Hosts(), nil
+}
+
+// retry returns a proxy.Credentials.Retry that reports each host that
+// couldn't be reached to target's replica pool, and calls setHost with the
+// next of hosts. setHost updates the credentials for it, like signing a new
+// IAM auth token, since those are only valid for one host.
+func (r *replicaPools) retry(target config.Target, hosts []string, setHost func(host string) error) func(err error) bool {
+	pool := r.pool(target)
+	current := 0
+	return func(err error) bool {
+		pool.Report(hosts[current], err)
+		for current+1 < len(hosts) {
+			current++
+			if err := setHost(hosts[current]); err != nil {
+				log.Warn("failed to set up the next host", zap.String("host", hosts[current]), zap.Error(err))
+				continue
+			}
+			return true
+		}
+		return false
+	}
+}
+
+// pool returns the target's replica pool, replacing it when discovery
+// found a different set of replicas
+func (r *replicaPools) pool(target config.Target) *upstream.Pool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	replicas := strings.Join(target.Replicas, ",")
+	existing, ok := r.pools[target.Name]
+	if ok && existing.replicas == replicas {
+		return existing.pool
+	}
+	if ok {
+		existing.cancel()
+	}
+	// XXX: can't error, SessionRoute only picks replicas when there are some
+	pool, _ := upstream.NewPool(target.Replicas, upstream.StrategyRandom)
+	r.pools[target.Name] = &replicaPool{replicas: replicas, pool: pool, cancel: r.startProbe(pool)}
+	return pool
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mothership/rds-auth-proxy/pkg/aws"
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/discovery"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// targetListing is a target as printed by `targets list`
+type targetListing struct {
+	Name            string `json:"name" yaml:"name"`
+	Host            string `json:"host" yaml:"host"`
+	Region          string `json:"region,omitempty" yaml:"region,omitempty"`
+	IsRDS           bool   `json:"is_rds" yaml:"is_rds"`
+	DefaultDatabase string `json:"default_database,omitempty" yaml:"default_database,omitempty"`
+	LocalPort       string `json:"local_port,omitempty" yaml:"local_port,omitempty"`
+	SSLMode         string `json:"ssl_mode" yaml:"ssl_mode"`
+	Excluded        string `json:"excluded,omitempty" yaml:"excluded,omitempty"`
+}
+
+var targetsCommand = &cobra.Command{
+	Use:   "targets",
+	Short: "Inspects the databases the proxy can reach",
+	Long:  `Inspects the databases the proxy can reach, from the config file and RDS discovery.`,
+}
+
+var targetsListCommand = &cobra.Command{
+	Use:   "list",
+	Short: "Lists discovered databases",
+	Long: `Lists the databases in the config file, and those discovered in RDS.
+
+Use --all to include RDS instances that were excluded, along with the reason.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		if output != "table" && output != "json" && output != "yaml" {
+			return fmt.Errorf("unknown output format %q, expected one of table, json or yaml", output)
+		}
+		namePattern, err := cmd.Flags().GetString("name")
+		if err != nil {
+			return err
+		}
+		if _, err := path.Match(namePattern, ""); err != nil {
+			return fmt.Errorf("bad name pattern %q: %w", namePattern, err)
+		}
+		tagFlags, err := cmd.Flags().GetStringSlice("tag")
+		if err != nil {
+			return err
+		}
+		tags, err := parseTagFlags(tagFlags)
+		if err != nil {
+			return err
+		}
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			return err
+		}
+
+		rdsClient, err := aws.NewRDSClient(ctx)
+		if err != nil {
+			return err
+		}
+		_, discoveryClient, err := loadDiscovery(ctx, cmd, rdsClient)
+		if err != nil {
+			return err
+		}
+
+		listings := []targetListing{}
+		for _, target := range discoveryClient.GetTargets() {
+			if matchesFilters(target, namePattern, tags) {
+				listings = append(listings, newTargetListing(target, ""))
+			}
+		}
+		if reporter, ok := discoveryClient.(discovery.ExclusionReporter); ok && all {
+			for _, exclusion := range reporter.GetExclusions() {
+				if matchesFilters(exclusion.Target, namePattern, tags) {
+					listings = append(listings, newTargetListing(exclusion.Target, exclusion.Reason))
+				}
+			}
+		}
+		sort.Slice(listings, func(i, j int) bool {
+			return listings[i].Name < listings[j].Name
+		})
+
+		return printTargetListings(os.Stdout, output, listings)
+	},
+}
+
+func newTargetListing(target config.Target, excluded string) targetListing {
+	listing := targetListing{
+		Name:     target.Name,
+		Host:     target.Host,
+		Region:   target.Region,
+		IsRDS:    target.IsRDS,
+		SSLMode:  string(target.SSL.Mode),
+		Excluded: excluded,
+	}
+	if target.DefaultDatabase != nil {
+		listing.DefaultDatabase = *target.DefaultDatabase
+	}
+	if target.LocalPort != nil {
+		listing.LocalPort = *target.LocalPort
+	}
+	return listing
+}
+
+func matchesFilters(target config.Target, namePattern string, tags config.TagList) bool {
+	if matched, _ := path.Match(namePattern, target.Name); !matched {
+		return false
+	}
+	return target.HasTags(tags)
+}
+
+// parseTagFlags turns key=value flags into a tag list
+func parseTagFlags(flags []string) (config.TagList, error) {
+	tags := make(config.TagList, 0, len(flags))
+	for _, flag := range flags {
+		parts := strings.SplitN(flag, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad tag %q, expected key=value", flag)
+		}
+		tags = append(tags, &config.Tag{Name: parts[0], Value: parts[1]})
+	}
+	return tags, nil
+}
+
+func printTargetListings(out io.Writer, format string, listings []targetListing) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(listings)
+	case "yaml":
+		return yaml.NewEncoder(out).Encode(listings)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHOST\tREGION\tRDS\tDATABASE\tLOCAL PORT\tSSL MODE\tEXCLUDED")
+	for _, l := range listings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\t%s\t%s\n",
+			l.Name, l.Host, valueOrDash(l.Region), l.IsRDS, valueOrDash(l.DefaultDatabase),
+			valueOrDash(l.LocalPort), l.SSLMode, valueOrDash(l.Excluded))
+	}
+	return w.Flush()
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func init() {
+	targetsListCommand.PersistentFlags().String("configfile", "", "Path to the proxy config file")
+	targetsListCommand.PersistentFlags().StringP("output", "o", "table", "Output format, one of table, json or yaml")
+	targetsListCommand.PersistentFlags().String("name", "*", "Only list targets with names matching this pattern, supports \"*\" wildcards")
+	targetsListCommand.PersistentFlags().StringSlice("tag", []string{}, "Only list targets with this tag, as key=value. Can be repeated")
+	targetsListCommand.PersistentFlags().Bool("all", false, "Include RDS instances excluded by the ACL, with the reason")
+	targetsCommand.AddCommand(targetsListCommand)
+	rootCmd.AddCommand(targetsCommand)
+}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mothership/rds-auth-proxy/pkg/aws"
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+	credentialsFactory "github.com/mothership/rds-auth-proxy/pkg/credentials/factory"
+	"github.com/mothership/rds-auth-proxy/pkg/discovery"
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"github.com/mothership/rds-auth-proxy/pkg/pg"
+	"github.com/mothership/rds-auth-proxy/pkg/proxy"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// tunnel is a client proxy to a single target, running in-process
+type tunnel struct {
+	target config.Target
+	// listenAddr is the address in use, with the port filled in when
+	// listening on port 0
+	listenAddr string
+	// host and port are what libpq connects to
+	host string
+	port string
+	// ssl is true when the local listener requires SSL
+	ssl bool
+	// stopped is closed once the proxy has shut down
+	stopped chan struct{}
+	// upstreamDone is closed once the port-forward or SSH tunnel to the
+	// upstream proxy has shut down, nil without one
+	upstreamDone <-chan struct{}
+}
+
+// Wait blocks until the proxy, and the port-forward or SSH tunnel to the
+// upstream proxy, have shut down after the tunnel's ctx was canceled
+func (t *tunnel) Wait() {
+	<-t.stopped
+	if t.upstreamDone != nil {
+		<-t.upstreamDone
+	}
+}
+
+// setupClientLogger sets up the console logger used by client side commands
+func setupClientLogger(defaultLevel zapcore.Level) error {
+	logCfg := zap.NewDevelopmentConfig()
+	logCfg.Level = log.EnvLevel(defaultLevel)
+	logCfg.Development = false
+	logger, err := logCfg.Build(zap.WithCaller(false))
+	if err != nil {
+		return err
+	}
+	log.SetLogger(logger)
+	return nil
+}
+
+// tunnelEnv is everything needed to open tunnels, loaded once and shared by
+// every tunnel: the config, AWS clients, and the port-forward to the upstream proxy
+type tunnelEnv struct {
+	cfg             config.ConfigFile
+	rdsClient       aws.RDSClient
+	discoveryClient discovery.Client
+	providers       map[string]credentials.Provider
+	proxyTarget     *config.ProxyTarget
+	hostPool        proxy.HostPool
+	sslOptions      []proxy.Option
+	upstreamDone    <-chan struct{}
+}
+
+// newTunnelEnv loads the config from the command's flags, and opens the
+// port-forward to the upstream proxy, which is closed when ctx is canceled
+func newTunnelEnv(ctx context.Context, cmd *cobra.Command) (*tunnelEnv, error) {
+	awsClient, err := aws.NewRDSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rdsClient := aws.NewTokenCache(awsClient, aws.DefaultTokenMaxAge)
+	cfg, discoveryClient, err := loadDiscovery(ctx, cmd, rdsClient)
+	if err != nil {
+		return nil, err
+	}
+
+	credentialProviders, err := credentialsFactory.FromTargets(ctx, cfg.Targets)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyTarget, err := getProxyTarget(cmd, cfg.ProxyTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := proxySSLOptions(ctx, cfg.Proxy.SSL)
+	if err != nil {
+		return nil, err
+	}
+
+	hostPool, err := newHostPool(ctx, proxyTarget, cfg.Proxy.SSL)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamDone, err := startUpstreamTunnel(ctx, proxyTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tunnelEnv{
+		cfg:             cfg,
+		rdsClient:       rdsClient,
+		discoveryClient: discoveryClient,
+		providers:       credentialProviders,
+		proxyTarget:     proxyTarget,
+		hostPool:        hostPool,
+		sslOptions:      opts,
+		upstreamDone:    upstreamDone,
+	}, nil
+}
+
+// startTunnel starts a client proxy for the named target on listenAddr, along
+// with the port-forward to the upstream proxy. It returns once the proxy is
+// listening, and everything is torn down when ctx is canceled.
+func startTunnel(ctx context.Context, cmd *cobra.Command, targetName, listenAddr string) (*tunnel, error) {
+	env, err := newTunnelEnv(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return env.openTunnel(ctx, targetName, listenAddr)
+}
+
+// openTunnel starts a client proxy for the named target on listenAddr. It returns
+// once the proxy is listening, and stops accepting connections when ctx is canceled.
+func (e *tunnelEnv) openTunnel(ctx context.Context, targetName, listenAddr string) (*tunnel, error) {
+	target, err := lookupTarget(e.discoveryClient, targetName)
+	if err != nil {
+		return nil, err
+	}
+	if listenAddr == "" {
+		listenAddr, err = target.GetListenAddr(e.cfg.Proxy.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manager, err := proxy.NewManager(proxy.MergeOptions(e.sslOptions, []proxy.Option{
+		proxy.WithListenAddress(listenAddr),
+		proxy.WithMode(proxy.ClientSide),
+		proxy.WithCredentialInterceptor(clientCredentialInterceptor(ctx, e.rdsClient, e.proxyTarget, e.hostPool, target, "", e.providers)),
+	})...)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := manager.Listen()
+	if err != nil {
+		return nil, err
+	}
+	if unixAddr, ok := addr.(*net.UnixAddr); ok {
+		listenAddr = pg.UnixSocketPrefix + unixAddr.Name
+	} else {
+		listenAddr = addr.String()
+	}
+	host, port, err := libpqHostPort(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("started client proxy", zap.String("listen_addr", listenAddr), zap.String("target", target.Name))
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := manager.Start(ctx); err != nil {
+			log.Error("client proxy stopped", zap.Error(err), zap.String("target", target.Name))
+		}
+	}()
+
+	return &tunnel{
+		target:       target,
+		listenAddr:   listenAddr,
+		host:         host,
+		port:         port,
+		ssl:          e.cfg.Proxy.SSL.Enabled,
+		stopped:      stopped,
+		upstreamDone: e.upstreamDone,
+	}, nil
+}
+
+// libpqHostPort returns the host and port libpq should connect to for a listen
+// address. Unix sockets are found by their directory, and the port in their name.
+func libpqHostPort(listenAddr string) (host string, port string, err error) {
+	if strings.HasPrefix(listenAddr, pg.UnixSocketPrefix) {
+		return pg.SplitSocketPath(strings.TrimPrefix(listenAddr, pg.UnixSocketPrefix))
+	}
+	addr, err := net.ResolveTCPAddr("tcp", listenAddr)
+	if err != nil {
+		return "", "", err
+	}
+	host = "localhost"
+	if addr.IP != nil && !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	return host, strconv.Itoa(addr.Port), nil
+}
+
+// sslMode is the libpq sslmode for connecting to the local listener
+func (t *tunnel) sslMode() string {
+	if t.ssl {
+		return "require"
+	}
+	return "disable"
+}
+
+// Env returns the libpq environment variables for connecting through the tunnel
+func (t *tunnel) Env() []string {
+	env := []string{
+		fmt.Sprintf("PGHOST=%s", t.host),
+		fmt.Sprintf("PGPORT=%s", t.port),
+		fmt.Sprintf("PGSSLMODE=%s", t.sslMode()),
+	}
+	if t.target.DefaultDatabase != nil && *t.target.DefaultDatabase != "" {
+		env = append(env, fmt.Sprintf("PGDATABASE=%s", *t.target.DefaultDatabase))
+	}
+	return env
+}
+
+// URL returns a postgres connection URL for the tunnel, for tools that don't read
+// the libpq environment variables
+func (t *tunnel) URL(user string) string {
+	query := url.Values{"sslmode": []string{t.sslMode()}}
+	u := url.URL{
+		Scheme: "postgres",
+		Path:   "/",
+	}
+	if strings.HasPrefix(t.listenAddr, pg.UnixSocketPrefix) {
+		// libpq takes the socket directory as a host parameter
+		query.Set("host", t.host)
+		query.Set("port", t.port)
+	} else {
+		u.Host = net.JoinHostPort(t.host, t.port)
+	}
+	u.RawQuery = query.Encode()
+	if user != "" {
+		u.User = url.User(user)
+	}
+	if t.target.DefaultDatabase != nil {
+		u.Path += *t.target.DefaultDatabase
+	}
+	return u.String()
+}
@@ -8,12 +8,18 @@ require (
 	github.com/aws/aws-sdk-go-v2/config v1.8.2
 	github.com/aws/aws-sdk-go-v2/feature/rds/auth v1.1.7
 	github.com/aws/aws-sdk-go-v2/service/rds v1.9.0
+	github.com/aws/aws-sdk-go-v2/service/secretsmanager v1.6.1
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/imdario/mergo v0.3.8 // indirect
 	github.com/jackc/pgproto3/v2 v2.1.1
 	github.com/spf13/afero v1.6.0
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/viper v1.8.1
 	go.uber.org/zap v1.19.1
+	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
+	golang.org/x/term v0.0.0-20210503060354-a79de5458b56
+	gopkg.in/yaml.v2 v2.4.0
+	k8s.io/api v0.22.2
 	k8s.io/apimachinery v0.22.2
 	k8s.io/client-go v0.22.2
 )
@@ -0,0 +1,79 @@
+//go:build ignore
+// +build ignore
+
+// gen_rds_ca downloads the RDS CA bundle, and writes it to rds_ca_bundle.go
+// so it's built into the proxy. Pass a path to use a bundle already on disk.
+//
+//	go generate ./pkg/aws
+//	go run gen_rds_ca.go ~/Downloads/global-bundle.pem
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mothership/rds-auth-proxy/pkg/aws"
+	"github.com/mothership/rds-auth-proxy/pkg/cert"
+)
+
+const output = "rds_ca_bundle.go"
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var bundle []byte
+	var err error
+	if len(os.Args) > 1 {
+		bundle, err = ioutil.ReadFile(os.Args[1])
+	} else {
+		bundle, err = download(aws.RDSCABundleURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	certificates, err := cert.ParseCertificates(bundle)
+	if err != nil {
+		return err
+	}
+	if err := aws.CheckRDSCertificates(certificates); err != nil {
+		return err
+	}
+	// Backquotes can't be escaped in a raw string, and never appear in PEM
+	if bytes.ContainsRune(bundle, '`') {
+		return fmt.Errorf("unexpected backquote in the bundle")
+	}
+
+	var src strings.Builder
+	fmt.Fprintf(&src, "// Code generated by gen_rds_ca.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "package aws\n\n")
+	fmt.Fprintf(&src, "// rdsCABundle is RDSCABundleURL, with %d certificates\n", len(certificates))
+	fmt.Fprintf(&src, "const rdsCABundle = `%s`\n", bundle)
+	formatted, err := format.Source([]byte(src.String()))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, formatted, 0644)
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -28,6 +28,7 @@ type DBInstanceResult struct {
 // mock this for testing
 type RDSClient interface {
 	GetPostgresInstances(ctx context.Context) <-chan DBInstanceResult
+	GetPostgresClusters(ctx context.Context) ([]types.DBCluster, error)
 	NewAuthToken(ctx context.Context, host, region, user string) (string, error)
 	RegionForInstance(inst types.DBInstance) (string, error)
 }
@@ -72,6 +73,30 @@ func (r *rdsClient) GetPostgresInstances(ctx context.Context) <-chan DBInstanceR
 	return resChan
 }
 
+// GetPostgresClusters lists the aurora-postgresql clusters, for finding which
+// instances are writers and which are readers
+func (r *rdsClient) GetPostgresClusters(ctx context.Context) ([]types.DBCluster, error) {
+	clusters := []types.DBCluster{}
+	paginator := rds.NewDescribeDBClustersPaginator(r.svc, &rds.DescribeDBClustersInput{
+		Filters: []types.Filter{
+			{
+				Name:   strPtr(filterEngine),
+				Values: []string{engineAuroraPostgres},
+			},
+		},
+	}, func(o *rds.DescribeDBClustersPaginatorOptions) {
+		o.Limit = 100
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, page.DBClusters...)
+	}
+	return clusters, nil
+}
+
 func (r *rdsClient) rdsPaginator(filters []types.Filter) (paginator *rds.DescribeDBInstancesPaginator) {
 	paginator = rds.NewDescribeDBInstancesPaginator(r.svc, &rds.DescribeDBInstancesInput{
 		Filters: filters,
@@ -0,0 +1,67 @@
+package aws
+
+//go:generate go run gen_rds_ca.go
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mothership/rds-auth-proxy/pkg/cert"
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"go.uber.org/zap"
+)
+
+// RDSCABundleURL is where AWS publishes the CAs for every region, including
+// the rds-ca-rsa2048-g1, rds-ca-rsa4096-g1, and rds-ca-ecc384-g1 roots
+const RDSCABundleURL = "https://truststore.pki.rds.amazonaws.com/global/global-bundle.pem"
+
+// rdsRoots are the common name suffixes of the roots each region has, the
+// rds-ca-rsa2048-g1, rds-ca-rsa4096-g1, and rds-ca-ecc384-g1 CAs (ex: Amazon
+// RDS us-east-1 Root CA RSA2048 G1)
+var rdsRoots = []string{"Root CA RSA2048 G1", "Root CA RSA4096 G1", "Root CA ECC384 G1"}
+
+var (
+	rdsCertificatesOnce sync.Once
+	rdsCertificates     []*x509.Certificate
+)
+
+// RDSCertificates returns the CAs built into the proxy from RDSCABundleURL,
+// so RDS servers can be verified without them in the system's trust store
+// (ex: distroless containers). The bundle is parsed once.
+func RDSCertificates() []*x509.Certificate {
+	rdsCertificatesOnce.Do(func() {
+		certificates, err := cert.ParseCertificates([]byte(rdsCABundle))
+		if err != nil {
+			log.Warn("failed to parse the built in RDS CA bundle", zap.Error(err))
+			return
+		}
+		if len(certificates) == 0 {
+			// Built without running go generate, only the system's CAs and
+			// any other root certificates are trusted
+			log.Warn("no RDS CAs built in, set proxy.rds_ca_bundle to a copy of the bundle", zap.String("url", RDSCABundleURL))
+			return
+		}
+		rdsCertificates = certificates
+	})
+	return rdsCertificates
+}
+
+// CheckRDSCertificates returns an error unless the bundle has each of the
+// current RDS roots, so an old or truncated bundle isn't built in
+func CheckRDSCertificates(certificates []*x509.Certificate) error {
+	for _, root := range rdsRoots {
+		found := false
+		for _, certificate := range certificates {
+			if certificate.IsCA && strings.HasSuffix(certificate.Subject.CommonName, root) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no %q CA in the RDS CA bundle", root)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package aws_test
+
+import (
+	"testing"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/aws"
+)
+
+// TestRDSCertificates fails until the bundle is built in, run go generate
+// ./pkg/aws to download it
+func TestRDSCertificates(t *testing.T) {
+	certificates := RDSCertificates()
+	if len(certificates) == 0 {
+		t.Fatalf("no RDS CAs built in, run go generate ./pkg/aws")
+	}
+	for idx, certificate := range certificates {
+		if !certificate.IsCA {
+			t.Errorf("[Case %d] expected %q to be a CA", idx, certificate.Subject)
+		}
+	}
+	if err := CheckRDSCertificates(certificates); err != nil {
+		t.Error(err)
+	}
+
+	// The rds-ca-rsa2048-g1 and rds-ca-ecc384-g1 roots, for one region
+	subjects := map[string]bool{}
+	for _, certificate := range certificates {
+		subjects[certificate.Subject.CommonName] = true
+	}
+	for idx, name := range []string{
+		"Amazon RDS us-east-1 Root CA RSA2048 G1",
+		"Amazon RDS us-east-1 Root CA ECC384 G1",
+	} {
+		if !subjects[name] {
+			t.Errorf("[Case %d] expected %q in the bundle", idx, name)
+		}
+	}
+}
+
+func TestCheckRDSCertificates(t *testing.T) {
+	// Case 0: an empty bundle
+	if err := CheckRDSCertificates(nil); err == nil {
+		t.Errorf("[Case 0] expected an error for an empty bundle")
+	}
+}
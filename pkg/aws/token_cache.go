@@ -0,0 +1,99 @@
+package aws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// AuthTokenLifetime is how long RDS accepts an IAM auth token
+	AuthTokenLifetime = 15 * time.Minute
+	// DefaultTokenMaxAge is how long a cached token is reused before it's
+	// regenerated, leaving plenty of headroom before it expires
+	DefaultTokenMaxAge = 10 * time.Minute
+)
+
+type tokenKey struct {
+	host   string
+	region string
+	user   string
+}
+
+type cachedToken struct {
+	lock      sync.Mutex
+	token     string
+	createdAt time.Time
+}
+
+// TokenCache wraps an RDSClient, and caches IAM auth tokens in memory so
+// parallel connections don't each have to sign a new token
+type TokenCache struct {
+	RDSClient
+	maxAge    time.Duration
+	cacheLock sync.Mutex
+	tokens    map[tokenKey]*cachedToken
+}
+
+var _ RDSClient = (*TokenCache)(nil)
+
+// NewTokenCache returns a TokenCache that reuses tokens until they are
+// maxAge old
+func NewTokenCache(client RDSClient, maxAge time.Duration) *TokenCache {
+	return &TokenCache{
+		RDSClient: client,
+		maxAge:    maxAge,
+		tokens:    map[tokenKey]*cachedToken{},
+	}
+}
+
+// NewAuthToken returns a cached token for the host, region and user, or
+// generates a new one if it is missing or too old
+func (c *TokenCache) NewAuthToken(ctx context.Context, host, region, user string) (string, error) {
+	key := tokenKey{host: host, region: region, user: user}
+	c.cacheLock.Lock()
+	entry, ok := c.tokens[key]
+	if !ok {
+		entry = &cachedToken{}
+		c.tokens[key] = entry
+	}
+	c.cacheLock.Unlock()
+
+	// Lock the entry while generating, so concurrent connections for the
+	// same key wait for one token instead of each signing their own
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	fields := []zap.Field{zap.String("host", host), zap.String("region", region), zap.String("user", user)}
+	age := time.Since(entry.createdAt)
+	if entry.token != "" && age < c.maxAge {
+		log.Debug("auth token cache hit", append(fields,
+			zap.Duration("age", age),
+			zap.Duration("expires_in", AuthTokenLifetime-age),
+		)...)
+		return entry.token, nil
+	}
+
+	if entry.token == "" {
+		log.Debug("auth token cache miss", fields...)
+	} else {
+		log.Debug("auth token cache refresh", append(fields, zap.Duration("age", age))...)
+	}
+	token, err := c.RDSClient.NewAuthToken(ctx, host, region, user)
+	if err != nil {
+		return "", err
+	}
+	entry.token = token
+	entry.createdAt = time.Now()
+	log.Debug("auth token cached", append(fields, zap.Int("cached_tokens", c.size()))...)
+	return token, nil
+}
+
+func (c *TokenCache) size() int {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	return len(c.tokens)
+}
@@ -0,0 +1,146 @@
+package aws_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	. "github.com/mothership/rds-auth-proxy/pkg/aws"
+)
+
+func TestTokenCacheReusesTokens(t *testing.T) {
+	type request struct {
+		Host   string
+		Region string
+		User   string
+	}
+	cases := []struct {
+		Requests      []request
+		ExpectedCalls int64
+	}{
+		// Case 0: same key is only signed once
+		{
+			Requests: []request{
+				{Host: "db-1:5432", Region: "us-west-2", User: "app"},
+				{Host: "db-1:5432", Region: "us-west-2", User: "app"},
+			},
+			ExpectedCalls: 1,
+		},
+		// Case 1: different users get different tokens
+		{
+			Requests: []request{
+				{Host: "db-1:5432", Region: "us-west-2", User: "app"},
+				{Host: "db-1:5432", Region: "us-west-2", User: "readonly"},
+			},
+			ExpectedCalls: 2,
+		},
+		// Case 2: different hosts and regions get different tokens
+		{
+			Requests: []request{
+				{Host: "db-1:5432", Region: "us-west-2", User: "app"},
+				{Host: "db-2:5432", Region: "us-west-2", User: "app"},
+				{Host: "db-1:5432", Region: "us-east-1", User: "app"},
+			},
+			ExpectedCalls: 3,
+		},
+	}
+
+	for idx, test := range cases {
+		client := &mockTokenClient{}
+		cache := NewTokenCache(client, DefaultTokenMaxAge)
+		for _, req := range test.Requests {
+			token, err := cache.NewAuthToken(context.Background(), req.Host, req.Region, req.User)
+			if err != nil {
+				t.Fatalf("[Case %d] unexpected error: %s", idx, err)
+			}
+			expected := fmt.Sprintf("%s/%s/%s", req.Host, req.Region, req.User)
+			if token != expected {
+				t.Errorf("[Case %d] expected token %q, got %q", idx, expected, token)
+			}
+		}
+		if client.Calls != test.ExpectedCalls {
+			t.Errorf("[Case %d] expected %d calls, got %d", idx, test.ExpectedCalls, client.Calls)
+		}
+	}
+}
+
+func TestTokenCacheRefreshesOldTokens(t *testing.T) {
+	client := &mockTokenClient{}
+	cache := NewTokenCache(client, time.Nanosecond)
+	for i := 0; i < 2; i++ {
+		if _, err := cache.NewAuthToken(context.Background(), "db-1:5432", "us-west-2", "app"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if client.Calls != 2 {
+		t.Errorf("expected 2 calls, got %d", client.Calls)
+	}
+}
+
+func TestTokenCacheDoesNotCacheErrors(t *testing.T) {
+	client := &mockTokenClient{Error: fmt.Errorf("no credentials")}
+	cache := NewTokenCache(client, DefaultTokenMaxAge)
+	for i := 0; i < 2; i++ {
+		if _, err := cache.NewAuthToken(context.Background(), "db-1:5432", "us-west-2", "app"); err == nil {
+			t.Fatalf("expected an error")
+		}
+	}
+	if client.Calls != 2 {
+		t.Errorf("expected 2 calls, got %d", client.Calls)
+	}
+}
+
+func TestTokenCacheConcurrentRequests(t *testing.T) {
+	client := &mockTokenClient{Delay: 10 * time.Millisecond}
+	cache := NewTokenCache(client, DefaultTokenMaxAge)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.NewAuthToken(context.Background(), "db-1:5432", "us-west-2", "app"); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if client.Calls != 1 {
+		t.Errorf("expected 1 call, got %d", client.Calls)
+	}
+}
+
+type mockTokenClient struct {
+	Calls int64
+	Delay time.Duration
+	Error error
+}
+
+var _ RDSClient = (*mockTokenClient)(nil)
+
+func (m *mockTokenClient) GetPostgresInstances(ctx context.Context) <-chan DBInstanceResult {
+	retChan := make(chan DBInstanceResult)
+	close(retChan)
+	return retChan
+}
+
+func (m *mockTokenClient) GetPostgresClusters(ctx context.Context) ([]types.DBCluster, error) {
+	return nil, nil
+}
+
+func (m *mockTokenClient) NewAuthToken(ctx context.Context, host, region, user string) (string, error) {
+	atomic.AddInt64(&m.Calls, 1)
+	time.Sleep(m.Delay)
+	if m.Error != nil {
+		return "", m.Error
+	}
+	return fmt.Sprintf("%s/%s/%s", host, region, user), nil
+}
+
+func (m *mockTokenClient) RegionForInstance(d types.DBInstance) (string, error) {
+	return "us-west-2", nil
+}
@@ -0,0 +1,320 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// KeyType is the algorithm of a generated private key
+type KeyType string
+
+const (
+	// KeyTypeRSA is a 2048 bit RSA key
+	KeyTypeRSA KeyType = "rsa"
+	// KeyTypeECDSA is a P-256 ECDSA key
+	KeyTypeECDSA KeyType = "ecdsa"
+	// KeyTypeEd25519 is an Ed25519 key
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+const (
+	// DefaultCAValidity is how long a generated CA is valid for, 10 years
+	DefaultCAValidity = 10 * 365 * 24 * time.Hour
+	// DefaultValidity is how long an issued certificate is valid for, 1 year
+	DefaultValidity = 365 * 24 * time.Hour
+	// DefaultOrganization is the subject organization when none is set
+	DefaultOrganization = "Mothership"
+)
+
+// Options are the settings for a generated certificate
+type Options struct {
+	// CommonName is the subject common name, defaults to the first host
+	CommonName string
+	// Organization is the subject organization, defaults to
+	// DefaultOrganization
+	Organization string
+	// Hosts are added as DNS or IP SANs
+	Hosts []string
+	// KeyType of the generated key, defaults to ECDSA
+	KeyType KeyType
+	// Validity is how long the certificate is valid for from now
+	Validity time.Duration
+	// ClientAuth issues a client certificate, for mTLS, instead of a server
+	// certificate
+	ClientAuth bool
+}
+
+// CA is a certificate authority that signs certificates
+type CA struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// GenerateKey generates a private key of the given type
+func GenerateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeECDSA, "":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unknown key type %q, expected rsa, ecdsa, or ed25519", keyType)
+}
+
+// GenerateCA creates a self-signed CA and returns the pem-encoded certificate
+// and private key
+func GenerateCA(opts Options) ([]byte, []byte, error) {
+	if opts.Validity == 0 {
+		opts.Validity = DefaultCAValidity
+	}
+	if opts.CommonName == "" {
+		opts.CommonName = "rds-auth-proxy CA"
+	}
+	priv, err := GenerateKey(opts.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = nil
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBytes, err := EncodePrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), keyBytes, nil
+}
+
+// LoadCA parses a pem-encoded CA certificate and private key
+func LoadCA(certPEM, keyPEM []byte) (*CA, error) {
+	certificate, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !certificate.IsCA {
+		return nil, fmt.Errorf("certificate %q is not a CA", certificate.Subject.CommonName)
+	}
+	key, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Certificate: certificate, Key: key}, nil
+}
+
+// Issue generates a key, and a certificate for it signed by the CA. Returns
+// the pem-encoded certificate and private key.
+func (ca *CA) Issue(opts Options) ([]byte, []byte, error) {
+	priv, err := GenerateKey(opts.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBytes, err := ca.sign(priv.Public(), opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBytes, err := EncodePrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certBytes, keyBytes, nil
+}
+
+// SignCSR signs a pem-encoded certificate request, and returns the
+// pem-encoded certificate. The subject and SANs come from the request,
+// unless opts sets them.
+func (ca *CA) SignCSR(csrPEM []byte, opts Options) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no pem-encoded certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %w", err)
+	}
+
+	if opts.CommonName == "" {
+		opts.CommonName = csr.Subject.CommonName
+	}
+	if opts.Organization == "" && len(csr.Subject.Organization) > 0 {
+		opts.Organization = csr.Subject.Organization[0]
+	}
+	if len(opts.Hosts) == 0 {
+		opts.Hosts = append(opts.Hosts, csr.DNSNames...)
+		for _, ip := range csr.IPAddresses {
+			opts.Hosts = append(opts.Hosts, ip.String())
+		}
+	}
+	return ca.sign(csr.PublicKey, opts)
+}
+
+func (ca *CA) sign(pub crypto.PublicKey, opts Options) ([]byte, error) {
+	if opts.Validity == 0 {
+		opts.Validity = DefaultValidity
+	}
+	template, err := newTemplate(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ClientAuth {
+		if template.Subject.CommonName == "" {
+			return nil, fmt.Errorf("client certificates need a common name")
+		}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else if len(template.DNSNames) == 0 && len(template.IPAddresses) == 0 {
+		return nil, fmt.Errorf("server certificates need at least one host")
+	}
+	// Key encipherment only applies to RSA key exchange
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	// Don't outlive the CA, clients would reject the chain anyhow
+	if template.NotAfter.After(ca.Certificate.NotAfter) {
+		template.NotAfter = ca.Certificate.NotAfter
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, pub, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), nil
+}
+
+// newTemplate returns a leaf certificate template for opts
+func newTemplate(opts Options) (*x509.Certificate, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Organization == "" {
+		opts.Organization = DefaultOrganization
+	}
+	notBefore := time.Now()
+	template := &x509.Certificate{
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(opts.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		SerialNumber:          serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{opts.Organization},
+			CommonName:   opts.CommonName,
+		},
+	}
+	addHosts(template, opts.Hosts)
+	if template.Subject.CommonName == "" && len(opts.Hosts) > 0 {
+		template.Subject.CommonName = strings.TrimSpace(opts.Hosts[0])
+	}
+	return template, nil
+}
+
+// newSerialNumber returns a random 128 bit serial number
+func newSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
+
+// addHosts adds each host to the template as an IP or DNS SAN
+func addHosts(template *x509.Certificate, hosts []string) {
+	for _, h := range hosts {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+}
+
+// ParseCertificate parses the first pem-encoded certificate
+func ParseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no pem-encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ParseCertificates parses every certificate in a PEM bundle, skipping other
+// blocks
+func ParseCertificates(bundlePEM []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	rest := bundlePEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certificates, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+}
+
+// ParsePrivateKey parses a pem-encoded PKCS#1, PKCS#8, or EC private key
+func ParsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no pem-encoded private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// EncodePrivateKey pem-encodes a private key as PKCS#8
+func EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+}
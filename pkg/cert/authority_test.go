@@ -0,0 +1,256 @@
+package cert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/cert"
+)
+
+func newCA(t *testing.T) *CA {
+	certBytes, keyBytes, err := GenerateCA(Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := LoadCA(certBytes, keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// verify checks certificate chains up to the CA for the given usage
+func verify(ca *CA, certificate *x509.Certificate, usage x509.ExtKeyUsage) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+	_, err := certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}})
+	return err
+}
+
+func TestIssue(t *testing.T) {
+	ca := newCA(t)
+
+	cases := []struct {
+		Options          Options
+		ExpectedCN       string
+		ExpectedOrg      string
+		ExpectedDNSNames []string
+		ExpectedIPs      []string
+		ExpectedUsage    x509.ExtKeyUsage
+		ExpectedKey      interface{}
+		Error            error
+	}{
+		// Case 0: server certificate, ECDSA by default
+		{
+			Options:          Options{Hosts: []string{"proxy.internal", "127.0.0.1"}},
+			ExpectedCN:       "proxy.internal",
+			ExpectedOrg:      DefaultOrganization,
+			ExpectedDNSNames: []string{"proxy.internal"},
+			ExpectedIPs:      []string{"127.0.0.1"},
+			ExpectedUsage:    x509.ExtKeyUsageServerAuth,
+			ExpectedKey:      &ecdsa.PublicKey{},
+		},
+		// Case 1: client certificate with an Ed25519 key, and an organization
+		{
+			Options:       Options{CommonName: "alice", Organization: "Example Corp", KeyType: KeyTypeEd25519, ClientAuth: true},
+			ExpectedCN:    "alice",
+			ExpectedOrg:   "Example Corp",
+			ExpectedUsage: x509.ExtKeyUsageClientAuth,
+			ExpectedKey:   ed25519.PublicKey{},
+		},
+		// Case 2: RSA server certificate
+		{
+			Options:          Options{Hosts: []string{"proxy.internal"}, KeyType: KeyTypeRSA},
+			ExpectedCN:       "proxy.internal",
+			ExpectedOrg:      DefaultOrganization,
+			ExpectedDNSNames: []string{"proxy.internal"},
+			ExpectedUsage:    x509.ExtKeyUsageServerAuth,
+			ExpectedKey:      &rsa.PublicKey{},
+		},
+		// Case 3: server certificates need a host
+		{
+			Options: Options{CommonName: "proxy"},
+			Error:   fmt.Errorf("server certificates need at least one host"),
+		},
+		// Case 4: client certificates need a name
+		{
+			Options: Options{ClientAuth: true},
+			Error:   fmt.Errorf("client certificates need a common name"),
+		},
+		// Case 5: unknown key type
+		{
+			Options: Options{Hosts: []string{"proxy.internal"}, KeyType: "dsa"},
+			Error:   fmt.Errorf("unknown key type \"dsa\""),
+		},
+	}
+
+	for idx, test := range cases {
+		certBytes, keyBytes, err := ca.Issue(test.Options)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if err != nil {
+			continue
+		}
+		certificate, err := ParseCertificate(certBytes)
+		if err != nil {
+			t.Fatalf("[Case %d] %+v", idx, err)
+		}
+		if _, err := ParsePrivateKey(keyBytes); err != nil {
+			t.Errorf("[Case %d] expected a valid private key, got %+v", idx, err)
+		}
+		if certificate.Subject.CommonName != test.ExpectedCN {
+			t.Errorf("[Case %d] expected common name %q, got %q", idx, test.ExpectedCN, certificate.Subject.CommonName)
+		}
+		if org := strings.Join(certificate.Subject.Organization, ","); org != test.ExpectedOrg {
+			t.Errorf("[Case %d] expected organization %q, got %q", idx, test.ExpectedOrg, org)
+		}
+		if strings.Join(certificate.DNSNames, ",") != strings.Join(test.ExpectedDNSNames, ",") {
+			t.Errorf("[Case %d] expected DNS names %v, got %v", idx, test.ExpectedDNSNames, certificate.DNSNames)
+		}
+		ips := []string{}
+		for _, ip := range certificate.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		if strings.Join(ips, ",") != strings.Join(test.ExpectedIPs, ",") {
+			t.Errorf("[Case %d] expected IPs %v, got %v", idx, test.ExpectedIPs, ips)
+		}
+		if fmt.Sprintf("%T", certificate.PublicKey) != fmt.Sprintf("%T", test.ExpectedKey) {
+			t.Errorf("[Case %d] expected a %T key, got %T", idx, test.ExpectedKey, certificate.PublicKey)
+		}
+		if err := verify(ca, certificate, test.ExpectedUsage); err != nil {
+			t.Errorf("[Case %d] expected certificate to verify, got %+v", idx, err)
+		}
+	}
+}
+
+func TestIssueValidity(t *testing.T) {
+	ca := newCA(t)
+
+	certBytes, _, err := ca.Issue(Options{Hosts: []string{"proxy.internal"}, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := ParseCertificate(certBytes)
+	if validity := certificate.NotAfter.Sub(certificate.NotBefore); validity != time.Hour {
+		t.Errorf("expected 1h validity, got %s", validity)
+	}
+
+	// Certificates can't outlive the CA
+	certBytes, _, err = ca.Issue(Options{Hosts: []string{"proxy.internal"}, Validity: 2 * DefaultCAValidity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ = ParseCertificate(certBytes)
+	if certificate.NotAfter.After(ca.Certificate.NotAfter) {
+		t.Errorf("expected certificate to expire by %s, got %s", ca.Certificate.NotAfter, certificate.NotAfter)
+	}
+}
+
+func TestSignCSR(t *testing.T) {
+	ca := newCA(t)
+	key, err := GenerateKey(KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "db.internal", Organization: []string{"Example Corp"}},
+		DNSNames:    []string{"db.internal"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.5")},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+
+	cases := []struct {
+		CSR              []byte
+		Options          Options
+		ExpectedCN       string
+		ExpectedOrg      string
+		ExpectedDNSNames []string
+		ExpectedUsage    x509.ExtKeyUsage
+		Error            error
+	}{
+		// Case 0: names come from the request
+		{
+			CSR:              csrPEM,
+			ExpectedCN:       "db.internal",
+			ExpectedOrg:      "Example Corp",
+			ExpectedDNSNames: []string{"db.internal"},
+			ExpectedUsage:    x509.ExtKeyUsageServerAuth,
+		},
+		// Case 1: options override the request
+		{
+			CSR:              csrPEM,
+			Options:          Options{CommonName: "bob", Organization: "Other Corp", Hosts: []string{"bob.internal"}, ClientAuth: true},
+			ExpectedCN:       "bob",
+			ExpectedOrg:      "Other Corp",
+			ExpectedDNSNames: []string{"bob.internal"},
+			ExpectedUsage:    x509.ExtKeyUsageClientAuth,
+		},
+		// Case 2: not a request
+		{
+			CSR:   []byte("not a csr"),
+			Error: fmt.Errorf("no pem-encoded certificate request found"),
+		},
+	}
+
+	for idx, test := range cases {
+		certBytes, err := ca.SignCSR(test.CSR, test.Options)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if err != nil {
+			continue
+		}
+		certificate, err := ParseCertificate(certBytes)
+		if err != nil {
+			t.Fatalf("[Case %d] %+v", idx, err)
+		}
+		if certificate.Subject.CommonName != test.ExpectedCN {
+			t.Errorf("[Case %d] expected common name %q, got %q", idx, test.ExpectedCN, certificate.Subject.CommonName)
+		}
+		if org := strings.Join(certificate.Subject.Organization, ","); org != test.ExpectedOrg {
+			t.Errorf("[Case %d] expected organization %q, got %q", idx, test.ExpectedOrg, org)
+		}
+		if strings.Join(certificate.DNSNames, ",") != strings.Join(test.ExpectedDNSNames, ",") {
+			t.Errorf("[Case %d] expected DNS names %v, got %v", idx, test.ExpectedDNSNames, certificate.DNSNames)
+		}
+		if err := verify(ca, certificate, test.ExpectedUsage); err != nil {
+			t.Errorf("[Case %d] expected certificate to verify, got %+v", idx, err)
+		}
+	}
+}
+
+func TestLoadCA(t *testing.T) {
+	certBytes, keyBytes, err := GenerateSelfSignedCert("localhost", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCA(certBytes, keyBytes); !errorContains(err, fmt.Errorf("is not a CA")) {
+		t.Errorf("expected leaf certificates to be rejected, got %+v", err)
+	}
+	if _, err := ParsePrivateKey(keyBytes); err != nil {
+		t.Errorf("expected PKCS#1 keys to parse, got %+v", err)
+	}
+}
+
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
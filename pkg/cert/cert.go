@@ -6,8 +6,6 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
-	"math/big"
-	"net"
 	"strings"
 	"time"
 
@@ -29,8 +27,7 @@ func GenerateSelfSignedCert(host string, isCA bool) ([]byte, []byte, error) {
 		return nil, nil, err
 	}
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := newSerialNumber()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -43,18 +40,11 @@ func GenerateSelfSignedCert(host string, isCA bool) ([]byte, []byte, error) {
 		BasicConstraintsValid: true,
 		SerialNumber:          serialNumber,
 		Subject: pkix.Name{
-			Organization: []string{"Mothership"},
+			Organization: []string{DefaultOrganization},
 		},
 	}
 
-	hosts := strings.Split(host, ",")
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
-		}
-	}
+	addHosts(&template, strings.Split(host, ","))
 
 	if isCA {
 		template.IsCA = true
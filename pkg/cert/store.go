@@ -0,0 +1,322 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"go.uber.org/zap"
+)
+
+// ExpiryWarning is how close to expiry a certificate has to be before it's
+// logged as a warning
+const ExpiryWarning = 30 * 24 * time.Hour
+
+// expiryDays is the days until each loaded certificate expires, by path,
+// exposed with the other expvars
+var expiryDays = expvar.NewMap("certificate_expiry_days")
+
+// DefaultStore is shared by everything in the process that loads
+// certificates, so each file is only read and watched once
+var DefaultStore = NewStore()
+
+// KeyPair is a certificate and private key, which is swapped out when the
+// files it was loaded from change
+type KeyPair struct {
+	certPath string
+	keyPath  string
+	// raw is the pem the current certificate was parsed from
+	raw     []byte
+	current atomic.Value
+}
+
+// NewKeyPair returns a key pair that is never reloaded, for generated
+// certificates
+func NewKeyPair(certificate tls.Certificate) *KeyPair {
+	k := &KeyPair{}
+	k.current.Store(&certificate)
+	return k
+}
+
+// Certificate returns the current certificate
+func (k *KeyPair) Certificate() *tls.Certificate {
+	return k.current.Load().(*tls.Certificate)
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// GetClientCertificate returns the current certificate, for tls.Config
+func (k *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// load reads the files, and swaps in the certificate if they changed.
+// Returns true if the certificate was swapped.
+func (k *KeyPair) load() (bool, error) {
+	certPEM, err := ioutil.ReadFile(k.certPath)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(k.keyPath)
+	if err != nil {
+		return false, err
+	}
+	raw := append(append([]byte{}, certPEM...), keyPEM...)
+	if k.raw != nil && bytes.Equal(raw, k.raw) {
+		return false, nil
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	k.raw = raw
+	k.current.Store(&certificate)
+	return true, nil
+}
+
+// Bundle is a set of pem-encoded CA certificates, which is swapped out when
+// the file it was loaded from changes
+type Bundle struct {
+	path    string
+	raw     []byte
+	current atomic.Value
+}
+
+type bundleContents struct {
+	certificates []*x509.Certificate
+	pool         *x509.CertPool
+}
+
+// Certificates returns the current certificates, in the order they're in
+// the file
+func (b *Bundle) Certificates() []*x509.Certificate {
+	return b.current.Load().(bundleContents).certificates
+}
+
+// Pool returns the current certificates as a pool
+func (b *Bundle) Pool() *x509.CertPool {
+	return b.current.Load().(bundleContents).pool
+}
+
+// load reads the file, and swaps in the certificates if it changed. Returns
+// true if the certificates were swapped.
+func (b *Bundle) load() (bool, error) {
+	raw, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return false, err
+	}
+	if b.raw != nil && bytes.Equal(raw, b.raw) {
+		return false, nil
+	}
+	certificates, err := ParseCertificates(raw)
+	if err != nil {
+		return false, err
+	}
+	contents := bundleContents{certificates: certificates, pool: x509.NewCertPool()}
+	for _, certificate := range certificates {
+		contents.pool.AddCert(certificate)
+	}
+	if len(contents.certificates) == 0 {
+		return false, fmt.Errorf("no certificates found in %q", b.path)
+	}
+	b.raw = raw
+	b.current.Store(contents)
+	return true, nil
+}
+
+// Store caches certificates loaded from disk, so they aren't read on every
+// connection, and reloads them when the files change (ex: cert-manager
+// rotating a secret)
+type Store struct {
+	lock     sync.Mutex
+	keyPairs map[string]*KeyPair
+	bundles  map[string]*Bundle
+	watcher  *fsnotify.Watcher
+}
+
+// NewStore returns an empty store
+func NewStore() *Store {
+	return &Store{
+		keyPairs: map[string]*KeyPair{},
+		bundles:  map[string]*Bundle{},
+	}
+}
+
+// KeyPair loads a certificate and private key, or returns the cached one
+func (s *Store) KeyPair(certPath, keyPath string) (*KeyPair, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := certPath + ":" + keyPath
+	if keyPair, ok := s.keyPairs[id]; ok {
+		return keyPair, nil
+	}
+	keyPair := &KeyPair{certPath: certPath, keyPath: keyPath}
+	if _, err := keyPair.load(); err != nil {
+		return nil, err
+	}
+	s.keyPairs[id] = keyPair
+	s.watch(certPath, keyPath)
+	logExpiry(certPath, keyPair.Certificate().Leaf)
+	return keyPair, nil
+}
+
+// Bundle loads a pem-encoded bundle of CA certificates, or returns the
+// cached one
+func (s *Store) Bundle(path string) (*Bundle, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if bundle, ok := s.bundles[path]; ok {
+		return bundle, nil
+	}
+	bundle := &Bundle{path: path}
+	if _, err := bundle.load(); err != nil {
+		return nil, err
+	}
+	s.bundles[path] = bundle
+	s.watch(path)
+	logExpiry(path, bundle.Certificates()...)
+	return bundle, nil
+}
+
+// Watch reloads certificates when their files change, and logs how long
+// until they expire every interval, until ctx is canceled. Only the first
+// call starts watching.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.watcher != nil {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	s.watcher = watcher
+	for _, keyPair := range s.keyPairs {
+		s.watch(keyPair.certPath, keyPair.keyPath)
+	}
+	for _, bundle := range s.bundles {
+		s.watch(bundle.path)
+	}
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				s.lock.Lock()
+				if s.watcher == watcher {
+					s.watcher = nil
+				}
+				s.lock.Unlock()
+				return
+			case <-watcher.Events:
+				s.Reload()
+			case err := <-watcher.Errors:
+				log.Warn("certificate watch failed", zap.Error(err))
+			case <-t.C:
+				s.LogExpiry()
+			}
+		}
+	}()
+	return nil
+}
+
+// watch adds the directories of paths to the watcher, if there is one.
+// Directories are watched rather than the files, since secrets in
+// kubernetes are swapped in with a symlink.
+func (s *Store) watch(paths ...string) {
+	if s.watcher == nil {
+		return
+	}
+	for _, path := range paths {
+		if err := s.watcher.Add(filepath.Dir(path)); err != nil {
+			log.Warn("failed to watch certificate", zap.String("path", path), zap.Error(err))
+		}
+	}
+}
+
+// Reload reads every certificate again, and swaps in the ones that changed.
+// Certificates that fail to load (ex: the key was written before the
+// certificate) are kept until the next reload.
+func (s *Store) Reload() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, keyPair := range s.keyPairs {
+		reloaded, err := keyPair.load()
+		if err != nil {
+			log.Warn("failed to reload certificate, keeping the current one", zap.String("path", keyPair.certPath), zap.Error(err))
+		} else if reloaded {
+			log.Info("reloaded certificate", zap.String("path", keyPair.certPath))
+			logExpiry(keyPair.certPath, keyPair.Certificate().Leaf)
+		}
+	}
+	for _, bundle := range s.bundles {
+		reloaded, err := bundle.load()
+		if err != nil {
+			log.Warn("failed to reload CA bundle, keeping the current one", zap.String("path", bundle.path), zap.Error(err))
+		} else if reloaded {
+			log.Info("reloaded CA bundle", zap.String("path", bundle.path))
+			logExpiry(bundle.path, bundle.Certificates()...)
+		}
+	}
+}
+
+// LogExpiry logs how long until each certificate expires, and updates the
+// certificate_expiry_days metric
+func (s *Store) LogExpiry() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, keyPair := range s.keyPairs {
+		logExpiry(keyPair.certPath, keyPair.Certificate().Leaf)
+	}
+	for _, bundle := range s.bundles {
+		logExpiry(bundle.path, bundle.Certificates()...)
+	}
+}
+
+// logExpiry logs how long until each certificate expires, as a warning when
+// it's close, and sets the metric for path to the one that expires first
+func logExpiry(path string, certificates ...*x509.Certificate) {
+	soonest := time.Duration(math.MaxInt64)
+	for _, certificate := range certificates {
+		remaining := time.Until(certificate.NotAfter)
+		if remaining < soonest {
+			soonest = remaining
+		}
+		fields := []zap.Field{
+			zap.String("path", path),
+			zap.String("subject", certificate.Subject.String()),
+			zap.Time("not_after", certificate.NotAfter),
+			zap.Int("days_until_expiry", int(remaining.Hours()/24)),
+		}
+		if remaining < ExpiryWarning {
+			log.Warn("certificate expires soon", fields...)
+		} else {
+			log.Info("certificate expiry", fields...)
+		}
+	}
+	days := new(expvar.Float)
+	days.Set(soonest.Hours() / 24)
+	expiryDays.Set(path, days)
+}
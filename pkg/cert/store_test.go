@@ -0,0 +1,146 @@
+package cert_test
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/cert"
+)
+
+// writeCert writes a new certificate for host, and its key, to dir
+func writeCert(t *testing.T, dir, host string) (string, string) {
+	certBytes, keyBytes, err := GenerateSelfSignedCert(host, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, certBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestStoreKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeCert(t, dir, "first.internal")
+
+	store := NewStore()
+	keyPair, err := store.KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := store.KeyPair(certPath, keyPath); cached != keyPair {
+		t.Errorf("expected the key pair to be cached")
+	}
+	if name := keyPair.Certificate().Leaf.DNSNames[0]; name != "first.internal" {
+		t.Errorf("expected first.internal, got %s", name)
+	}
+	if days, ok := expvar.Get("certificate_expiry_days").(*expvar.Map).Get(certPath).(*expvar.Float); !ok || days.Value() < 5*364 {
+		t.Errorf("expected about 5 years until expiry, got %v", days)
+	}
+
+	// A half written rotation keeps the current certificate
+	if err := ioutil.WriteFile(keyPath, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store.Reload()
+	if name := keyPair.Certificate().Leaf.DNSNames[0]; name != "first.internal" {
+		t.Errorf("expected first.internal to be kept, got %s", name)
+	}
+
+	writeCert(t, dir, "second.internal")
+	store.Reload()
+	if name := keyPair.Certificate().Leaf.DNSNames[0]; name != "second.internal" {
+		t.Errorf("expected second.internal after a reload, got %s", name)
+	}
+}
+
+func TestStoreWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeCert(t, dir, "first.internal")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewStore()
+	if err := store.Watch(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	keyPair, err := store.KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeCert(t, dir, "second.internal")
+	deadline := time.Now().Add(5 * time.Second)
+	for keyPair.Certificate().Leaf.DNSNames[0] != "second.internal" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected second.internal once the files changed, got %s", keyPair.Certificate().Leaf.DNSNames[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoreBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, _, err := GenerateCA(Options{CommonName: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := GenerateCA(Options{CommonName: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundlePath := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(bundlePath, append(first, second...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewStore()
+	bundle, err := store.Bundle(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, certificate := range bundle.Certificates() {
+		names = append(names, certificate.Subject.CommonName)
+	}
+	if strings.Join(names, ",") != "first,second" {
+		t.Errorf("expected first,second, got %v", names)
+	}
+	if bundle.Pool() == nil {
+		t.Errorf("expected a cert pool")
+	}
+
+	if _, err := store.Bundle(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("expected an error for a missing bundle")
+	}
+	emptyPath := filepath.Join(dir, "empty.pem")
+	_ = ioutil.WriteFile(emptyPath, []byte{}, 0600)
+	expected := fmt.Errorf("no certificates found")
+	if _, err := store.Bundle(emptyPath); !errorContains(err, expected) {
+		t.Errorf("expected %+v, got %+v", expected, err)
+	}
+}
@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/mothership/rds-auth-proxy/pkg/netutil"
 )
 
 // ACL represents rds instance tags allowed, or blocked by the proxy
@@ -51,3 +53,62 @@ func (a *ACL) IsAllowed(tagList []types.Tag) error {
 	}
 	return nil
 }
+
+// CIDRACL allows or denies clients by their address. Denied networks win over
+// allowed ones, and an empty allow list allows every address.
+type CIDRACL struct {
+	Allowed []string `mapstructure:"allowed"`
+	Denied  []string `mapstructure:"denied"`
+	// The parsed lists, so they aren't parsed again on every connection
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+	parsed  bool
+}
+
+// Parse parses the lists, returning an error if any of the CIDRs are invalid.
+// Called once when the config or target is loaded, before IsAllowed.
+func (c *CIDRACL) Parse() error {
+	allowed, err := netutil.ParseCIDRs(c.Allowed)
+	if err != nil {
+		return err
+	}
+	denied, err := netutil.ParseCIDRs(c.Denied)
+	if err != nil {
+		return err
+	}
+	c.allowed, c.denied, c.parsed = allowed, denied, true
+	return nil
+}
+
+// IsAllowed returns an error if the client address is denied, or not in the
+// allow list. Only TCP addresses can match. Lists that weren't parsed deny
+// every address.
+func (c CIDRACL) IsAllowed(addr net.Addr) error {
+	if len(c.Allowed) == 0 && len(c.Denied) == 0 {
+		return nil
+	}
+	if !c.parsed {
+		return fmt.Errorf("client CIDRs weren't parsed")
+	}
+	if netutil.Contains(c.denied, addr) {
+		return fmt.Errorf("client address %s is denied", addrHost(addr))
+	}
+	if len(c.allowed) == 0 {
+		return nil
+	}
+	if !netutil.Contains(c.allowed, addr) {
+		return fmt.Errorf("client address %s is not allowed", addrHost(addr))
+	}
+	return nil
+}
+
+// addrHost returns the IP of a TCP address, without the port
+func addrHost(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	if addr == nil {
+		return "unknown"
+	}
+	return addr.String()
+}
@@ -1,6 +1,8 @@
 package config_test
 
 import (
+	"fmt"
+	"net"
 	"testing"
 
 	. "github.com/mothership/rds-auth-proxy/pkg/config"
@@ -17,3 +19,71 @@ func TestACLInit(t *testing.T) {
 		t.Errorf("Expected blocked tags not to be nil")
 	}
 }
+
+func TestCIDRACLIsAllowed(t *testing.T) {
+	vpnOnly := CIDRACL{
+		Allowed: []string{"10.8.0.0/16", "2001:db8::/32"},
+		Denied:  []string{"10.8.99.0/24"},
+	}
+	cases := []struct {
+		ACL   CIDRACL
+		Addr  net.Addr
+		Error error
+	}{
+		// Case 0: empty lists allow every address
+		{ACL: CIDRACL{}, Addr: tcpAddr("203.0.113.7")},
+		// Case 1: in the allowed range
+		{ACL: vpnOnly, Addr: tcpAddr("10.8.1.20")},
+		{ACL: vpnOnly, Addr: tcpAddr("2001:db8::20")},
+		// Case 3: outside the allowed range
+		{ACL: vpnOnly, Addr: tcpAddr("203.0.113.7"), Error: fmt.Errorf("client address 203.0.113.7 is not allowed")},
+		// Case 4: denied wins over allowed
+		{ACL: vpnOnly, Addr: tcpAddr("10.8.99.3"), Error: fmt.Errorf("client address 10.8.99.3 is denied")},
+		// Case 5: deny list only
+		{ACL: CIDRACL{Denied: []string{"203.0.113.0/24"}}, Addr: tcpAddr("10.8.1.20")},
+		// Case 6: unix sockets can't match an allow list
+		{ACL: vpnOnly, Addr: &net.UnixAddr{Name: "/tmp/.s.PGSQL.5432", Net: "unix"}, Error: fmt.Errorf("is not allowed")},
+	}
+
+	for idx, test := range cases {
+		acl := test.ACL
+		if err := acl.Parse(); err != nil {
+			t.Fatalf("[Case %d] unexpected error: %+v", idx, err)
+		}
+		err := acl.IsAllowed(test.Addr)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func TestCIDRACLUnparsed(t *testing.T) {
+	// Lists that weren't parsed fail closed
+	acl := CIDRACL{Denied: []string{"203.0.113.0/24"}}
+	if err := acl.IsAllowed(tcpAddr("10.8.1.20")); !errorContains(err, fmt.Errorf("client CIDRs weren't parsed")) {
+		t.Errorf("expected an unparsed error, got %+v", err)
+	}
+	// Empty lists don't need parsing
+	if err := (CIDRACL{}).IsAllowed(tcpAddr("10.8.1.20")); err != nil {
+		t.Errorf("expected no error, got %+v", err)
+	}
+}
+
+func TestCIDRACLParse(t *testing.T) {
+	acl := CIDRACL{Allowed: []string{"10.0.0.0/8"}, Denied: []string{"10.0.0.1"}}
+	if err := acl.Parse(); err != nil {
+		t.Errorf("expected no error, got %+v", err)
+	}
+	acl = CIDRACL{Denied: []string{"vpn.internal"}}
+	if err := acl.Parse(); !errorContains(err, fmt.Errorf("invalid IP")) {
+		t.Errorf("expected invalid IP error, got %+v", err)
+	}
+	acl = CIDRACL{Allowed: []string{"10.8.0.0/33"}}
+	if err := acl.Parse(); !errorContains(err, fmt.Errorf("invalid CIDR")) {
+		t.Errorf("expected invalid CIDR error, got %+v", err)
+	}
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}
+}
@@ -1,12 +1,16 @@
 package config
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/mothership/rds-auth-proxy/pkg/pg"
 	"github.com/spf13/viper"
 )
 
 const (
 	defaultKubeConfigPath = "$HOME/.kube/config"
+	defaultKnownHostsPath = "$HOME/.ssh/known_hosts"
 	defaultListenAddr     = "0.0.0.0:8000"
 )
 
@@ -14,12 +18,46 @@ type ConfigFile struct {
 	Proxy        Proxy                   `mapstructure:"proxy"`
 	Targets      map[string]*Target      `mapstructure:"targets"`
 	ProxyTargets map[string]*ProxyTarget `mapstructure:"upstream_proxies"`
+	// Targets the client proxy opens tunnels to when no --target is passed
+	Sessions []Session `mapstructure:"sessions"`
+}
+
+// Session is a target the client proxy should open a tunnel to
+type Session struct {
+	Target string `mapstructure:"target"`
+	// Optional, overrides the target's local port
+	LocalPort *string `mapstructure:"local_port,omitempty"`
 }
 
 type Proxy struct {
 	ListenAddr string    `mapstructure:"listen_addr"`
 	SSL        ServerSSL `mapstructure:"ssl"`
 	ACL        ACL       `mapstructure:"target_acl"`
+	// Allow clients without a client proxy (ex: psql, JDBC) to connect to
+	// the server proxy, picking their target by name. Server proxy only.
+	AllowDirectClients bool `mapstructure:"allow_direct_clients"`
+	// Read the real client address from a PROXY protocol header, when the
+	// proxy is behind a load balancer. Server proxy only.
+	ProxyProtocol ProxyProtocol `mapstructure:"proxy_protocol"`
+	// Client addresses allowed to connect to any target, checked before each
+	// target's own list. Server proxy only.
+	ClientCIDRs CIDRACL `mapstructure:"client_cidrs"`
+	// Optional address to serve metrics on, at /debug/vars. Server proxy only.
+	MetricsAddr string `mapstructure:"metrics_addr"`
+	// Optional time between health checks of each target's replicas (ex:
+	// 1m), defaults to 30s. Server proxy only.
+	ReplicaHealthCheckInterval time.Duration `mapstructure:"replica_health_check_interval"`
+	// Optional path to a copy of the RDS CA bundle, used instead of the one
+	// built into the proxy to verify discovered RDS instances (ex: when AWS
+	// adds a region or rotates its CAs)
+	RDSCABundle *string `mapstructure:"rds_ca_bundle,omitempty"`
+}
+
+// ProxyProtocol configures which sources send a PROXY protocol header
+type ProxyProtocol struct {
+	// Sources that must send the header (ex: the load balancer's subnet),
+	// as CIDRs or IPs. Empty disables the PROXY protocol.
+	TrustedCIDRs []string `mapstructure:"trusted_cidrs"`
 }
 
 func LoadConfig(filepath string) (ConfigFile, error) {
@@ -39,9 +77,26 @@ func LoadConfig(filepath string) (ConfigFile, error) {
 		return config, err
 	}
 	config.Init()
+	if err := config.ParseCIDRs(); err != nil {
+		return config, err
+	}
 	return config, nil
 }
 
+// ParseCIDRs parses client_cidrs and every target's CIDRs, once at load
+// instead of on every connection, returning an error if any are invalid
+func (c *ConfigFile) ParseCIDRs() error {
+	if err := c.Proxy.ClientCIDRs.Parse(); err != nil {
+		return fmt.Errorf("invalid client_cidrs: %w", err)
+	}
+	for _, target := range c.Targets {
+		if err := target.ParseCIDRs(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Init sets up defaults for the config file
 func (c *ConfigFile) Init() {
 	if c.Targets == nil {
@@ -61,9 +116,7 @@ func (c *ConfigFile) Init() {
 	for key, target := range c.Targets {
 		target.Name = key
 		// if no SSL keys
-		if target.SSL.Mode == "" {
-			target.SSL.Mode = pg.SSLRequired
-		}
+		target.SSL.init(pg.SSLRequired)
 		if target.SSL.Mode != pg.SSLDisabled && target.SSL.ClientCertificatePath == nil {
 			target.SSL.ClientCertificatePath = c.Proxy.SSL.ClientCertificatePath
 			target.SSL.ClientPrivateKeyPath = c.Proxy.SSL.ClientPrivateKeyPath
@@ -79,10 +132,18 @@ func (c *ConfigFile) Init() {
 				target.SSL.Mode = pg.SSLDisabled
 			}
 		}
-
-		if target.SSL.Mode == "" {
-			target.SSL.Mode = pg.SSLRequired
+		if target.SSH != nil {
+			if target.SSH.KnownHostsPath == nil {
+				knownHosts := defaultKnownHostsPath
+				target.SSH.KnownHostsPath = &knownHosts
+			}
+			// Like a port-forward, the tunnel is already encrypted
+			if target.SSL.Mode == "" {
+				target.SSL.Mode = pg.SSLDisabled
+			}
 		}
+
+		target.SSL.init(pg.SSLRequired)
 		// if no SSL keys
 		if target.SSL.Mode != pg.SSLDisabled && target.SSL.ClientCertificatePath == nil {
 			target.SSL.ClientCertificatePath = c.Proxy.SSL.ClientCertificatePath
@@ -2,8 +2,12 @@ package config_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/mothership/rds-auth-proxy/pkg/config"
 	"github.com/mothership/rds-auth-proxy/pkg/pg"
@@ -31,6 +35,69 @@ func TestProxyConfigLoad(t *testing.T) {
 	}
 }
 
+func TestProxyConfigLoadHealthCheckIntervals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	contents := `
+proxy:
+  replica_health_check_interval: 2m
+upstream_proxies:
+  default:
+    hosts: ["proxy-a:8000", "proxy-b:8000"]
+    health_check_interval: 45s
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if cfg.Proxy.ReplicaHealthCheckInterval != 2*time.Minute {
+		t.Errorf("expected a 2m replica health check interval, got %s", cfg.Proxy.ReplicaHealthCheckInterval)
+	}
+	if interval := cfg.ProxyTargets["default"].HealthCheckInterval; interval != 45*time.Second {
+		t.Errorf("expected a 45s health check interval, got %s", interval)
+	}
+}
+
+func TestProxyConfigLoadInvalidCIDRs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		Contents string
+		Error    error
+	}{
+		{
+			Contents: "proxy:\n  client_cidrs:\n    allowed: [\"10.0.0.0/33\"]\n",
+			Error:    fmt.Errorf("invalid client_cidrs: invalid CIDR \"10.0.0.0/33\""),
+		},
+		{
+			Contents: "targets:\n  orders:\n    host: orders:5432\n    denied_cidrs: [\"vpn.internal\"]\n",
+			Error:    fmt.Errorf("invalid CIDRs on target \"orders\": invalid IP \"vpn.internal\""),
+		},
+	}
+	for idx, test := range cases {
+		path := filepath.Join(dir, fmt.Sprintf("config-%d.yaml", idx))
+		if err := ioutil.WriteFile(path, []byte(test.Contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(path)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
 func TestConfigInit(t *testing.T) {
 	var cfg ConfigFile
 	cfg.Init()
@@ -97,6 +164,10 @@ func TestProxyTargetsGetDefault(t *testing.T) {
 			"portforward": {
 				PortForward: &PortForward{},
 			},
+			"ssh": {
+				Host: "10.0.0.5:8000",
+				SSH:  &SSHTunnel{Host: "bastion.example.com"},
+			},
 			"override": {
 				Host: "1",
 				SSL: SSL{
@@ -131,6 +202,18 @@ func TestProxyTargetsGetDefault(t *testing.T) {
 	if cfg.ProxyTargets["portforward"].SSL.Mode != pg.SSLDisabled {
 		t.Errorf("Expected SSL to be disabled on portforward if not set")
 	}
+
+	if cfg.ProxyTargets["ssh"].SSL.Mode != pg.SSLDisabled {
+		t.Errorf("Expected SSL to be disabled on ssh if not set")
+	}
+
+	if cfg.ProxyTargets["ssh"].SSH.KnownHostsPath == nil || *cfg.ProxyTargets["ssh"].SSH.KnownHostsPath != "$HOME/.ssh/known_hosts" {
+		t.Errorf("Expected ssh known_hosts to default to ~/.ssh/known_hosts")
+	}
+
+	if cfg.ProxyTargets["ssh"].GetHost() != "127.0.0.1:0" {
+		t.Errorf("Expected ssh host to be the local end of the tunnel, got %s", cfg.ProxyTargets["ssh"].GetHost())
+	}
 }
 
 // errorContains checks if the error message in out contains the text in
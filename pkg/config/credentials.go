@@ -0,0 +1,32 @@
+package config
+
+// CredentialSource configures where a target's credentials are looked up,
+// only one source may be set
+type CredentialSource struct {
+	SecretsManager *SecretsManagerSource `mapstructure:"secrets_manager,omitempty"`
+	Vault          *VaultSource          `mapstructure:"vault,omitempty"`
+	// Path to a file containing the password, or a JSON object with a
+	// username and password
+	File *string `mapstructure:"file,omitempty"`
+	// Command to run, its output is read the same way as File
+	Exec []string `mapstructure:"exec,omitempty"`
+}
+
+// SecretsManagerSource reads credentials from an AWS Secrets Manager secret
+type SecretsManagerSource struct {
+	// Secret name or ARN
+	SecretID string `mapstructure:"secret_id"`
+	// Optional, if not set the region is taken from the ARN, or the AWS config
+	Region string `mapstructure:"region,omitempty"`
+}
+
+// VaultSource reads dynamic database credentials from HashiCorp Vault
+type VaultSource struct {
+	// Optional, if not set VAULT_ADDR is used
+	Address string `mapstructure:"address,omitempty"`
+	// Path to read credentials from, ex: database/creds/readonly
+	Path string `mapstructure:"path"`
+	// Optional path to a file holding the Vault token, if not set
+	// VAULT_TOKEN is used
+	TokenPath *string `mapstructure:"token_file,omitempty"`
+}
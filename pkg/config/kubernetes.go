@@ -2,8 +2,12 @@ package config
 
 // PortForward represents kubernetes port-forward config for tunneling a connection to the server-side proxy
 type PortForward struct {
-	Namespace      string `mapstructure:"namespace"`
+	Namespace string `mapstructure:"namespace"`
+	// One of deployment, selector, service, or pod picks the pod to forward to
 	DeploymentName string `mapstructure:"deployment"`
+	Selector       string `mapstructure:"selector"`
+	ServiceName    string `mapstructure:"service"`
+	PodName        string `mapstructure:"pod"`
 	RemotePort     string `mapstructure:"remote_port"`
 	// Optional, if not set "0" is used
 	LocalPort          *string `mapstructure:"local_port"`
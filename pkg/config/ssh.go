@@ -0,0 +1,27 @@
+package config
+
+// SSHTunnel is config for reaching the server proxy through an SSH bastion,
+// only useful for client-side proxy targets
+type SSHTunnel struct {
+	// Bastion host, as host or host:port. The port defaults to 22.
+	Host string `mapstructure:"host"`
+	User string `mapstructure:"user"`
+	// Path to a private key, the SSH agent is used if this isn't set
+	PrivateKeyPath *string `mapstructure:"private_key"`
+	// Use the SSH agent at $SSH_AUTH_SOCK
+	Agent bool `mapstructure:"agent"`
+	// Defaults to ~/.ssh/known_hosts
+	KnownHostsPath *string `mapstructure:"known_hosts"`
+	// Hosts to jump through before the bastion, in order, as [user@]host[:port]
+	JumpHosts []string `mapstructure:"jump_hosts"`
+	// Optional, if not set "0" is used
+	LocalPort *string `mapstructure:"local_port"`
+}
+
+// GetLocalPort returns the local port to be used for the tunnel
+func (s *SSHTunnel) GetLocalPort() string {
+	if s.LocalPort != nil {
+		return *s.LocalPort
+	}
+	return "0"
+}
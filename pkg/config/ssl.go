@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+
 	"github.com/mothership/rds-auth-proxy/pkg/pg"
 )
 
@@ -10,11 +12,88 @@ type SSL struct {
 	ClientCertificatePath *string `mapstructure:"client_certificate,omitempty"`
 	// Optional client private key to use
 	ClientPrivateKeyPath *string `mapstructure:"client_private_key,omitempty"`
-	// SSL mode to verify upstream connection, defaults to "verify-full"
+	// SSL mode to verify upstream connection, with the same meaning as
+	// libpq's sslmode, defaults to "require"
 	Mode pg.SSLMode `mapstructure:"mode,omitempty"`
+	// How to start SSL, "postgres" (the default) or "direct", like libpq's
+	// sslnegotiation
+	Negotiation pg.SSLNegotiation `mapstructure:"negotiation,omitempty"`
 	// Path to a root certificate if the certificate is
-	// not already in the system roots
+	// not already in the system roots, or "system"
 	RootCertificatePath *string `mapstructure:"root_certificate"`
+	// More root certificates, as paths, "system", or "rds" for the CAs
+	// built into the proxy
+	RootCertificatePaths []string `mapstructure:"root_certificates,omitempty"`
+	// Optional pins for the server's public key, as sha256/<base64 hash>.
+	// Checked in every SSL mode.
+	PinnedPublicKeys []string `mapstructure:"pinned_public_keys,omitempty"`
+}
+
+// RootCertificateRDS trusts the RDS CAs built into the proxy
+const RootCertificateRDS = "rds"
+
+// RootCertificates returns root_certificate and root_certificates together
+func (s SSL) RootCertificates() []string {
+	roots := make([]string, 0, len(s.RootCertificatePaths)+1)
+	if s.RootCertificatePath != nil {
+		roots = append(roots, *s.RootCertificatePath)
+	}
+	return append(roots, s.RootCertificatePaths...)
+}
+
+// trustsSystem is true if "system" is one of the root certificates
+func (s SSL) trustsSystem() bool {
+	for _, root := range s.RootCertificates() {
+		if root == pg.SSLRootCertSystem {
+			return true
+		}
+	}
+	return false
+}
+
+// init normalizes the mode, and sets it to defaultMode if it isn't set
+func (s *SSL) init(defaultMode pg.SSLMode) {
+	if s.Mode == "" && s.trustsSystem() {
+		// Like libpq, trusting the system's CAs implies checking the hostname
+		s.Mode = pg.SSLVerifyFull
+	}
+	if s.Mode == "" {
+		s.Mode = defaultMode
+	}
+	if mode, err := pg.ParseSSLMode(string(s.Mode)); err == nil {
+		s.Mode = mode
+	}
+}
+
+// Validate checks the settings make sense together, with the same rules as
+// libpq
+func (s SSL) Validate() error {
+	if _, err := pg.ParseSSLMode(string(s.Mode)); err != nil {
+		return err
+	}
+	if (s.ClientCertificatePath == nil) != (s.ClientPrivateKeyPath == nil) {
+		return fmt.Errorf("client_certificate and client_private_key must be set together")
+	}
+	switch s.Negotiation {
+	case "", pg.SSLNegotiationPostgres:
+	case pg.SSLNegotiationDirect:
+		if !s.Mode.RequiresSSL() {
+			return fmt.Errorf("negotiation %q requires an ssl mode of require, verify-ca, or verify-full", s.Negotiation)
+		}
+	default:
+		return fmt.Errorf("invalid negotiation %q, expected postgres or direct", s.Negotiation)
+	}
+	if s.trustsSystem() && s.Mode != pg.SSLVerifyFull {
+		return fmt.Errorf("root_certificate %q requires an ssl mode of verify-full", pg.SSLRootCertSystem)
+	}
+	if len(s.PinnedPublicKeys) == 0 {
+		return nil
+	}
+	if !s.Mode.RequiresSSL() {
+		return fmt.Errorf("pinned_public_keys requires an ssl mode of require, verify-ca, or verify-full")
+	}
+	_, err := pg.ParsePublicKeyPins(s.PinnedPublicKeys)
+	return err
 }
 
 // ServerSSL is SSL settings for the proxy server
@@ -24,4 +103,7 @@ type ServerSSL struct {
 	PrivateKeyPath        *string `mapstructure:"private_key,omitempty"`
 	ClientCertificatePath *string `mapstructure:"client_certificate,omitempty"`
 	ClientPrivateKeyPath  *string `mapstructure:"client_private_key,omitempty"`
+	// Optional pem-encoded CA bundle, if set clients must present a
+	// certificate signed by one of these CAs
+	ClientCAPath *string `mapstructure:"client_ca,omitempty"`
 }
@@ -0,0 +1,86 @@
+package config_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/pg"
+)
+
+func TestSSLValidate(t *testing.T) {
+	pin := "sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	cases := []struct {
+		SSL   SSL
+		Error error
+	}{
+		// Case 0: no pins
+		{SSL: SSL{Mode: pg.SSLDisabled}},
+		// Case 1: pins with require
+		{SSL: SSL{Mode: pg.SSLRequired, PinnedPublicKeys: []string{pin}}},
+		// Case 2: pins can't be checked without SSL
+		{
+			SSL:   SSL{Mode: pg.SSLDisabled, PinnedPublicKeys: []string{pin}},
+			Error: fmt.Errorf("pinned_public_keys requires an ssl mode"),
+		},
+		// Case 3: bad pin
+		{
+			SSL:   SSL{Mode: pg.SSLVerifyFull, PinnedPublicKeys: []string{"sha1/abc"}},
+			Error: fmt.Errorf("invalid public key pin \"sha1/abc\""),
+		},
+		// Case 4: direct negotiation skips the SSLRequest, so can't fall back
+		{
+			SSL:   SSL{Mode: pg.SSLPrefer, Negotiation: pg.SSLNegotiationDirect},
+			Error: fmt.Errorf("negotiation \"direct\" requires an ssl mode"),
+		},
+		// Case 5: direct negotiation with require
+		{SSL: SSL{Mode: pg.SSLRequired, Negotiation: pg.SSLNegotiationDirect}},
+		// Case 6: unknown negotiation
+		{
+			SSL:   SSL{Mode: pg.SSLRequired, Negotiation: "starttls"},
+			Error: fmt.Errorf("invalid negotiation \"starttls\""),
+		},
+		// Case 7: the system trust store only makes sense when verifying
+		{
+			SSL:   SSL{Mode: pg.SSLRequired, RootCertificatePath: strPtr(pg.SSLRootCertSystem)},
+			Error: fmt.Errorf("root_certificate \"system\" requires an ssl mode of verify-full"),
+		},
+		// Case 8: a client certificate without its key
+		{
+			SSL:   SSL{Mode: pg.SSLVerifyFull, ClientCertificatePath: strPtr("cert.pem")},
+			Error: fmt.Errorf("client_certificate and client_private_key must be set together"),
+		},
+		// Case 9: an unknown mode
+		{
+			SSL:   SSL{Mode: "required"},
+			Error: fmt.Errorf("invalid sslmode \"required\""),
+		},
+		// Case 10: "system" in the list of root certificates
+		{
+			SSL:   SSL{Mode: pg.SSLRequired, RootCertificatePaths: []string{"ca.pem", pg.SSLRootCertSystem}},
+			Error: fmt.Errorf("root_certificate \"system\" requires an ssl mode of verify-full"),
+		},
+		// Case 11: the RDS CAs along with a file
+		{SSL: SSL{Mode: pg.SSLVerifyCA, RootCertificatePaths: []string{RootCertificateRDS, "ca.pem"}}},
+	}
+
+	for idx, test := range cases {
+		err := test.SSL.Validate()
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func TestSSLRootCertificates(t *testing.T) {
+	ssl := SSL{
+		RootCertificatePath:  strPtr("ca.pem"),
+		RootCertificatePaths: []string{RootCertificateRDS, "other-ca.pem"},
+	}
+	expected := []string{"ca.pem", RootCertificateRDS, "other-ca.pem"}
+	if roots := ssl.RootCertificates(); !reflect.DeepEqual(roots, expected) {
+		t.Errorf("expected %+v, got %+v", expected, roots)
+	}
+}
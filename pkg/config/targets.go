@@ -1,15 +1,33 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/pg"
+)
 
 // ProxyTarget is a config block specifying an upstream proxy
 type ProxyTarget struct {
 	Name string
 	Host string `mapstructure:"host"`
-	SSL  SSL    `mapstructure:"ssl"`
+	// Optional list of server proxies to pick from instead of Host, only for
+	// proxies reached directly (not port-forwarded or over SSH)
+	Hosts []string `mapstructure:"hosts,omitempty"`
+	// How to pick from Hosts: failover (default), random, or least-latency
+	Strategy string `mapstructure:"strategy,omitempty"`
+	// Optional time between health checks of Hosts (ex: 1m), defaults to 30s
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval,omitempty"`
+	SSL                 SSL           `mapstructure:"ssl"`
 	// For tunneling the connection through a kubernetes port-forward, only useful
 	// for client-side proxy targets
 	PortForward *PortForward `mapstructure:"port_forward,omitempty"`
+	// For tunneling the connection through an SSH bastion, Host is then
+	// the server proxy's address as seen from the bastion
+	SSH *SSHTunnel `mapstructure:"ssh,omitempty"`
 }
 
 // Target is the actual DB server we're connecting to
@@ -20,6 +38,41 @@ type Target struct {
 	DefaultDatabase *string `mapstructure:"database,omitempty"`
 	// LocalPort to use instead of the proxy's default ListenAddr port
 	LocalPort *string `mapstructure:"local_port,omitempty"`
+	// Optional list of database users allowed to connect through the proxy,
+	// supports "*" wildcards. An empty list allows all users.
+	AllowedUsers []string `mapstructure:"allowed_users,omitempty"`
+	// Optional list of database names allowed through the proxy, supports "*"
+	// wildcards. An empty list allows all databases.
+	AllowedDatabases []string `mapstructure:"allowed_databases,omitempty"`
+	// Optional list of client certificate names (common name or SAN) allowed
+	// to connect, supports "*" wildcards. An empty list allows all clients.
+	AllowedClients []string `mapstructure:"allowed_clients,omitempty"`
+	// Optional database users each client certificate name may log in as
+	// with the server proxy's own IAM identity, for direct clients on RDS
+	// targets. Clients without a binding are asked for a password.
+	ClientUsers []ClientUser `mapstructure:"client_users,omitempty"`
+	// Optional lists of client networks (ex: the VPN's admin range) allowed
+	// to connect, and denied from connecting. Denied networks win, and an
+	// empty allow list allows all addresses.
+	AllowedCIDRs []string `mapstructure:"allowed_cidrs,omitempty"`
+	DeniedCIDRs  []string `mapstructure:"denied_cidrs,omitempty"`
+	// addrACL is AllowedCIDRs and DeniedCIDRs, parsed by ParseCIDRs
+	addrACL CIDRACL
+	// Optional source for the username/password used to log in, for targets
+	// without IAM auth
+	Credentials *CredentialSource `mapstructure:"credentials,omitempty"`
+	// Optional read replicas of this target, as host:port. Read-only sessions
+	// are sent to one of these instead of Host. Filled in by discovery for RDS
+	// read replicas and Aurora readers.
+	Replicas []string `mapstructure:"replicas,omitempty"`
+	// Optional list of database users whose sessions go to a replica unless
+	// they ask for the writer, supports "*" wildcards
+	ReadOnlyUsers []string `mapstructure:"read_only_users,omitempty"`
+	// Optional PROXY protocol header to send, "v1" or "v2", when the target
+	// is another proxy (ex: pgbouncer) that should see the real client address
+	SendProxyProtocol string `mapstructure:"send_proxy_protocol,omitempty"`
+	// Tags on the RDS instance, or set in the config file, for filtering
+	Tags map[string]string `mapstructure:"tags,omitempty"`
 	// Name in target list, or RDS db instance identifier
 	Name string
 	// Only set for RDS instances
@@ -28,11 +81,24 @@ type Target struct {
 	IsRDS bool
 }
 
+// ClientUser binds client certificate names to the database users they may
+// log in as, both support "*" wildcards
+type ClientUser struct {
+	Client string   `mapstructure:"client"`
+	Users  []string `mapstructure:"users"`
+}
+
 // GetHost returns the correct host + port combo for the proxy target
 // if the target is port-forwarded, this is a localhost address
 // otherwise, it's exposed over a VPN or by some other means.
 func (p *ProxyTarget) GetHost() string {
+	if p.SSH != nil {
+		return fmt.Sprintf("127.0.0.1:%s", p.SSH.GetLocalPort())
+	}
 	if p.PortForward == nil {
+		if p.Host == "" && len(p.Hosts) > 0 {
+			return p.Hosts[0]
+		}
 		return p.Host
 	}
 	if p.PortForward.LocalPort == nil {
@@ -41,7 +107,218 @@ func (p *ProxyTarget) GetHost() string {
 	return fmt.Sprintf("0.0.0.0:%s", *p.PortForward.LocalPort)
 }
 
+// GetHosts returns every host the client proxy can connect to for this
+// proxy target, which is only ever one host when tunneling
+func (p *ProxyTarget) GetHosts() []string {
+	if p.SSH != nil || p.PortForward != nil || len(p.Hosts) == 0 {
+		return []string{p.GetHost()}
+	}
+	return p.Hosts
+}
+
 // IsPortForward returns true if this proxy target requires a port-forward connection
 func (p *ProxyTarget) IsPortForward() bool {
 	return p.PortForward != nil
 }
+
+// GetListenAddr returns the address the client proxy should listen on for
+// this target, the default address with the target's local port if set
+func (t *Target) GetListenAddr(defaultAddr string) (string, error) {
+	if t.LocalPort == nil {
+		return defaultAddr, nil
+	}
+	// Each target gets its own socket, next to the default one
+	if strings.HasPrefix(defaultAddr, pg.UnixSocketPrefix) {
+		dir, _, err := pg.SplitSocketPath(strings.TrimPrefix(defaultAddr, pg.UnixSocketPrefix))
+		if err != nil {
+			return "", err
+		}
+		return pg.UnixSocketPrefix + pg.SocketPath(dir, *t.LocalPort), nil
+	}
+	host, _, err := net.SplitHostPort(defaultAddr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, *t.LocalPort), nil
+}
+
+// IsAllowed returns an error if the user or database is not allowed
+// on this target. Postgres defaults the database to the user name, so
+// an empty database is checked as the user name.
+func (t *Target) IsAllowed(user, database string) error {
+	if database == "" {
+		database = user
+	}
+	if !matchesAny(t.AllowedUsers, user) {
+		return fmt.Errorf("user %q is not allowed on target %q", user, t.Name)
+	}
+	if !matchesAny(t.AllowedDatabases, database) {
+		return fmt.Errorf("database %q is not allowed on target %q", database, t.Name)
+	}
+	return nil
+}
+
+// IsClientAllowed returns an error if none of the names from the client's
+// certificate are allowed on this target
+func (t *Target) IsClientAllowed(names []string) error {
+	if len(t.AllowedClients) == 0 {
+		return nil
+	}
+	for _, name := range names {
+		if matchesAny(t.AllowedClients, name) {
+			return nil
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("target %q requires a client certificate", t.Name)
+	}
+	return fmt.Errorf("client %q is not allowed on target %q", names[0], t.Name)
+}
+
+// IsClientBoundToUser returns an error unless one of the names from the
+// client's certificate is bound to the database user in ClientUsers
+func (t *Target) IsClientBoundToUser(names []string, user string) error {
+	for _, binding := range t.ClientUsers {
+		if len(binding.Users) == 0 || !matchesAny(binding.Users, user) {
+			continue
+		}
+		for _, name := range names {
+			if ok, err := path.Match(binding.Client, name); err == nil && ok {
+				return nil
+			}
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("target %q requires a client certificate", t.Name)
+	}
+	return fmt.Errorf("client %q is not bound to user %q on target %q", names[0], user, t.Name)
+}
+
+// ParseCIDRs parses the target's allowed and denied CIDRs, returning an error
+// if any are invalid. Called once when the target is loaded or discovered,
+// before IsAddrAllowed.
+func (t *Target) ParseCIDRs() error {
+	t.addrACL = CIDRACL{Allowed: t.AllowedCIDRs, Denied: t.DeniedCIDRs}
+	if err := t.addrACL.Parse(); err != nil {
+		return fmt.Errorf("invalid CIDRs on target %q: %w", t.Name, err)
+	}
+	return nil
+}
+
+// IsAddrAllowed returns an error if the client address isn't allowed on this
+// target. Every address is denied if the target's CIDRs weren't parsed.
+func (t *Target) IsAddrAllowed(addr net.Addr) error {
+	acl := t.addrACL
+	if !acl.parsed {
+		acl = CIDRACL{Allowed: t.AllowedCIDRs, Denied: t.DeniedCIDRs}
+	}
+	if err := acl.IsAllowed(addr); err != nil {
+		return fmt.Errorf("%w on target %q", err, t.Name)
+	}
+	return nil
+}
+
+// SessionRoute is which of a target's instances a session should be sent to
+type SessionRoute int
+
+const (
+	// RouteWriter sends the session to the target's Host
+	RouteWriter SessionRoute = iota
+	// RouteReplica sends the session to one of the replicas
+	RouteReplica
+	// RoutePreferReplica sends the session to one of the replicas, or to the
+	// writer if none of them are reachable
+	RoutePreferReplica
+)
+
+// SessionRoute returns where a session for user should go, from the
+// target_session_attrs the client asked for (as in libpq), or from
+// ReadOnlyUsers if it didn't ask
+func (t *Target) SessionRoute(user, sessionAttrs string) (SessionRoute, error) {
+	route := RouteWriter
+	switch sessionAttrs {
+	case "", "any":
+		if len(t.ReadOnlyUsers) > 0 && matchesAny(t.ReadOnlyUsers, user) {
+			route = RoutePreferReplica
+		}
+	case "read-write", "primary":
+		return RouteWriter, nil
+	case "read-only", "standby":
+		if len(t.Replicas) == 0 {
+			return RouteWriter, fmt.Errorf("target %q has no replicas for target_session_attrs=%s", t.Name, sessionAttrs)
+		}
+		return RouteReplica, nil
+	case "prefer-standby":
+		route = RoutePreferReplica
+	default:
+		return RouteWriter, fmt.Errorf("invalid target_session_attrs %q", sessionAttrs)
+	}
+	if route == RoutePreferReplica && len(t.Replicas) == 0 {
+		return RouteWriter, nil
+	}
+	return route, nil
+}
+
+// HasTags returns true if the target has every one of the tags
+func (t *Target) HasTags(tags TagList) bool {
+	for _, tag := range tags {
+		value, ok := t.Tags[tag.Name]
+		if !ok || value != tag.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// TagWildcard stands in for the * wildcard in RDS tag values, which can't
+// contain a *
+const TagWildcard = "+"
+
+// ParseList splits a whitespace separated list, as used by list valued RDS
+// tags. Tag values can't contain commas, but they're accepted as separators
+// too.
+func ParseList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// ParsePatternList splits a list like ParseList, and turns each TagWildcard
+// into a * wildcard, as used by the RDS tags listing users, databases or
+// clients
+func ParsePatternList(value string) []string {
+	patterns := ParseList(value)
+	for idx, pattern := range patterns {
+		patterns[idx] = strings.ReplaceAll(pattern, TagWildcard, "*")
+	}
+	return patterns
+}
+
+// ParseClientUsers parses client=user pairs, separated and with wildcards
+// like ParsePatternList, as used by the client users RDS tag
+func ParseClientUsers(value string) ([]ClientUser, error) {
+	pairs := ParsePatternList(value)
+	bindings := make([]ClientUser, 0, len(pairs))
+	for _, pair := range pairs {
+		idx := strings.LastIndex(pair, "=")
+		if idx <= 0 || idx == len(pair)-1 {
+			return nil, fmt.Errorf("invalid client user %q, expected client=user", pair)
+		}
+		bindings = append(bindings, ClientUser{Client: pair[:idx], Users: []string{pair[idx+1:]}})
+	}
+	return bindings, nil
+}
+
+// matchesAny returns true if the value matches any of the glob patterns,
+// or if there are no patterns at all
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package config_test
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
 	. "github.com/mothership/rds-auth-proxy/pkg/config"
@@ -36,6 +38,39 @@ func TestTargetGetHost(t *testing.T) {
 	}
 }
 
+func TestTargetGetHosts(t *testing.T) {
+	cases := []struct {
+		Target   ProxyTarget
+		Expected []string
+	}{
+		// Case 0: single host
+		{
+			Target:   ProxyTarget{Host: "proxy:8000"},
+			Expected: []string{"proxy:8000"},
+		},
+		// Case 1: host list
+		{
+			Target:   ProxyTarget{Hosts: []string{"proxy-a:8000", "proxy-b:8000"}},
+			Expected: []string{"proxy-a:8000", "proxy-b:8000"},
+		},
+		// Case 2: port-forwards only have the local host
+		{
+			Target: ProxyTarget{
+				Hosts:       []string{"proxy-a:8000", "proxy-b:8000"},
+				PortForward: &PortForward{LocalPort: strPtr("8001")},
+			},
+			Expected: []string{"0.0.0.0:8001"},
+		},
+	}
+
+	for idx, test := range cases {
+		result := test.Target.GetHosts()
+		if fmt.Sprint(result) != fmt.Sprint(test.Expected) {
+			t.Errorf("[Case %d] Expected %+v, got %+v", idx, test.Expected, result)
+		}
+	}
+}
+
 func TestTargetIsPortForward(t *testing.T) {
 	cases := []struct {
 		Target   ProxyTarget
@@ -65,3 +100,405 @@ func TestTargetIsPortForward(t *testing.T) {
 		}
 	}
 }
+
+func TestTargetIsAllowed(t *testing.T) {
+	target := Target{
+		Name:             "orders",
+		AllowedUsers:     []string{"app_*", "readonly"},
+		AllowedDatabases: []string{"orders", "readonly"},
+	}
+	cases := []struct {
+		Target   Target
+		User     string
+		Database string
+		Error    error
+	}{
+		// Case 0: empty lists allow everything
+		{
+			Target:   Target{Name: "open"},
+			User:     "rds_superuser",
+			Database: "postgres",
+			Error:    nil,
+		},
+		// Case 1: exact user and database
+		{
+			Target:   target,
+			User:     "readonly",
+			Database: "orders",
+			Error:    nil,
+		},
+		// Case 2: wildcard user
+		{
+			Target:   target,
+			User:     "app_orders",
+			Database: "orders",
+			Error:    nil,
+		},
+		// Case 3: user not in list
+		{
+			Target:   target,
+			User:     "rds_superuser",
+			Database: "orders",
+			Error:    fmt.Errorf("user \"rds_superuser\" is not allowed on target \"orders\""),
+		},
+		// Case 4: database not in list
+		{
+			Target:   target,
+			User:     "app_orders",
+			Database: "postgres",
+			Error:    fmt.Errorf("database \"postgres\" is not allowed on target \"orders\""),
+		},
+		// Case 5: database defaults to the user name
+		{
+			Target:   target,
+			User:     "readonly",
+			Database: "",
+			Error:    nil,
+		},
+	}
+
+	for idx, test := range cases {
+		err := test.Target.IsAllowed(test.User, test.Database)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func TestTargetIsAddrAllowed(t *testing.T) {
+	target := Target{
+		Name:         "orders-prod",
+		AllowedCIDRs: []string{"10.8.0.0/16"},
+	}
+	// Denied until the CIDRs are parsed
+	expected := fmt.Errorf("client CIDRs weren't parsed")
+	if err := target.IsAddrAllowed(tcpAddr("10.8.1.20")); !errorContains(err, expected) {
+		t.Errorf("expected %+v, got %+v", expected, err)
+	}
+	if err := target.ParseCIDRs(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := target.IsAddrAllowed(tcpAddr("10.8.1.20")); err != nil {
+		t.Errorf("expected no error, got %+v", err)
+	}
+	expected = fmt.Errorf("client address 203.0.113.7 is not allowed on target \"orders-prod\"")
+	if err := target.IsAddrAllowed(tcpAddr("203.0.113.7")); !errorContains(err, expected) {
+		t.Errorf("expected %+v, got %+v", expected, err)
+	}
+}
+
+func TestTargetParseCIDRs(t *testing.T) {
+	cases := []struct {
+		Target Target
+		Error  error
+	}{
+		{Target: Target{Name: "a", AllowedCIDRs: []string{"10.8.0.0/16"}, DeniedCIDRs: []string{"10.8.99.1"}}},
+		{Target: Target{Name: "b"}},
+		{Target: Target{Name: "c", AllowedCIDRs: []string{"10.8.0.0/33"}}, Error: fmt.Errorf("invalid CIDRs on target \"c\": invalid CIDR")},
+		{Target: Target{Name: "d", DeniedCIDRs: []string{"vpn.internal"}}, Error: fmt.Errorf("invalid CIDRs on target \"d\": invalid IP")},
+	}
+	for idx, test := range cases {
+		err := test.Target.ParseCIDRs()
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func TestTargetSessionRoute(t *testing.T) {
+	target := Target{
+		Name:          "orders",
+		Replicas:      []string{"orders-replica-1:5432", "orders-replica-2:5432"},
+		ReadOnlyUsers: []string{"analytics_*"},
+	}
+	noReplicas := Target{
+		Name:          "billing",
+		ReadOnlyUsers: []string{"analytics_*"},
+	}
+	cases := []struct {
+		Target       Target
+		User         string
+		SessionAttrs string
+		Expected     SessionRoute
+		Error        error
+	}{
+		// Case 0: everything else goes to the writer
+		{Target: target, User: "app", Expected: RouteWriter},
+		// Case 1: read only users go to a replica
+		{Target: target, User: "analytics_bi", Expected: RoutePreferReplica},
+		// Case 2: unless they ask for the writer
+		{Target: target, User: "analytics_bi", SessionAttrs: "read-write", Expected: RouteWriter},
+		// Case 3: anyone can ask for a replica
+		{Target: target, User: "app", SessionAttrs: "read-only", Expected: RouteReplica},
+		{Target: target, User: "app", SessionAttrs: "standby", Expected: RouteReplica},
+		{Target: target, User: "app", SessionAttrs: "prefer-standby", Expected: RoutePreferReplica},
+		// Case 6: read only users stay on the writer without replicas
+		{Target: noReplicas, User: "analytics_bi", Expected: RouteWriter},
+		{Target: noReplicas, User: "app", SessionAttrs: "prefer-standby", Expected: RouteWriter},
+		// Case 8: asking for a replica that doesn't exist
+		{Target: noReplicas, User: "app", SessionAttrs: "standby", Error: fmt.Errorf("target \"billing\" has no replicas for target_session_attrs=standby")},
+		// Case 9: unknown value
+		{Target: target, User: "app", SessionAttrs: "secondary", Error: fmt.Errorf("invalid target_session_attrs \"secondary\"")},
+	}
+
+	for idx, test := range cases {
+		route, err := test.Target.SessionRoute(test.User, test.SessionAttrs)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if err == nil && route != test.Expected {
+			t.Errorf("[Case %d] expected route %d, got %d", idx, test.Expected, route)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Expected []string
+	}{
+		{Value: "", Expected: []string{}},
+		{Value: "a", Expected: []string{"a"}},
+		{Value: "a,b", Expected: []string{"a", "b"}},
+		{Value: "a b  c", Expected: []string{"a", "b", "c"}},
+		{Value: " a, b ,c ", Expected: []string{"a", "b", "c"}},
+	}
+
+	for idx, test := range cases {
+		result := ParseList(test.Value)
+		if len(result) != len(test.Expected) {
+			t.Fatalf("[Case %d] expected %+v, got %+v", idx, test.Expected, result)
+		}
+		for i := range result {
+			if result[i] != test.Expected[i] {
+				t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, result)
+			}
+		}
+	}
+}
+
+func TestParsePatternList(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Expected []string
+	}{
+		// Case 0: no wildcards
+		{Value: "app readonly", Expected: []string{"app", "readonly"}},
+		// Case 1: tag wildcards
+		{Value: "app_+ +@example.com", Expected: []string{"app_*", "*@example.com"}},
+		// Case 2: * still works outside of tags
+		{Value: "app_*", Expected: []string{"app_*"}},
+	}
+
+	for idx, test := range cases {
+		result := ParsePatternList(test.Value)
+		if !reflect.DeepEqual(result, test.Expected) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, result)
+		}
+	}
+}
+
+func TestTargetIsClientAllowed(t *testing.T) {
+	target := Target{
+		Name:           "orders",
+		AllowedClients: []string{"*@example.com", "ci-runner"},
+	}
+	cases := []struct {
+		Target Target
+		Names  []string
+		Error  error
+	}{
+		// Case 0: empty list allows all clients, even without a certificate
+		{
+			Target: Target{Name: "open"},
+			Names:  nil,
+			Error:  nil,
+		},
+		// Case 1: no client certificate
+		{
+			Target: target,
+			Names:  nil,
+			Error:  fmt.Errorf("target \"orders\" requires a client certificate"),
+		},
+		// Case 2: matching common name
+		{
+			Target: target,
+			Names:  []string{"ci-runner"},
+			Error:  nil,
+		},
+		// Case 3: matching SAN after a non-matching common name
+		{
+			Target: target,
+			Names:  []string{"Jane Doe", "jane@example.com"},
+			Error:  nil,
+		},
+		// Case 4: no matching names
+		{
+			Target: target,
+			Names:  []string{"Jane Doe", "jane@example.org"},
+			Error:  fmt.Errorf("client \"Jane Doe\" is not allowed on target \"orders\""),
+		},
+	}
+
+	for idx, test := range cases {
+		err := test.Target.IsClientAllowed(test.Names)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func TestTargetIsClientBoundToUser(t *testing.T) {
+	target := Target{
+		Name: "orders",
+		ClientUsers: []ClientUser{
+			{Client: "ci-runner", Users: []string{"app"}},
+			{Client: "*@example.com", Users: []string{"readonly", "report_*"}},
+		},
+	}
+	cases := []struct {
+		Target Target
+		Names  []string
+		User   string
+		Error  error
+	}{
+		// Case 0: no bindings, no tokens
+		{
+			Target: Target{Name: "open", AllowedClients: []string{"*"}},
+			Names:  []string{"ci-runner"},
+			User:   "app",
+			Error:  fmt.Errorf("client \"ci-runner\" is not bound to user \"app\" on target \"open\""),
+		},
+		// Case 1: bound common name
+		{Target: target, Names: []string{"ci-runner"}, User: "app"},
+		// Case 2: bound SAN, wildcard user
+		{Target: target, Names: []string{"Jane Doe", "jane@example.com"}, User: "report_daily"},
+		// Case 3: an allowed client asking for a user it isn't bound to
+		{
+			Target: target,
+			Names:  []string{"ci-runner"},
+			User:   "rds_superuser",
+			Error:  fmt.Errorf("client \"ci-runner\" is not bound to user \"rds_superuser\""),
+		},
+		// Case 4: no client certificate
+		{
+			Target: target,
+			User:   "app",
+			Error:  fmt.Errorf("target \"orders\" requires a client certificate"),
+		},
+	}
+
+	for idx, test := range cases {
+		err := test.Target.IsClientBoundToUser(test.Names, test.User)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func TestParseClientUsers(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Expected []ClientUser
+		Error    error
+	}{
+		// Case 0: several pairs
+		{
+			Value: "ci-runner=app *@example.com=readonly",
+			Expected: []ClientUser{
+				{Client: "ci-runner", Users: []string{"app"}},
+				{Client: "*@example.com", Users: []string{"readonly"}},
+			},
+		},
+		// Case 1: tag wildcards
+		{
+			Value:    "+@example.com=analytics_+",
+			Expected: []ClientUser{{Client: "*@example.com", Users: []string{"analytics_*"}}},
+		},
+		// Case 2: missing user
+		{Value: "ci-runner=", Error: fmt.Errorf("invalid client user \"ci-runner=\"")},
+		// Case 3: missing client
+		{Value: "app", Error: fmt.Errorf("invalid client user \"app\"")},
+	}
+
+	for idx, test := range cases {
+		bindings, err := ParseClientUsers(test.Value)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if test.Error == nil && !reflect.DeepEqual(bindings, test.Expected) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, bindings)
+		}
+	}
+}
+
+func TestTargetGetListenAddr(t *testing.T) {
+	cases := []struct {
+		Target   Target
+		Default  string
+		Expected string
+		Error    error
+	}{
+		{
+			Target:   Target{},
+			Default:  "0.0.0.0:8000",
+			Expected: "0.0.0.0:8000",
+		},
+		{
+			Target:   Target{LocalPort: strPtr("54000")},
+			Default:  "127.0.0.1:8000",
+			Expected: "127.0.0.1:54000",
+		},
+		{
+			Target:  Target{LocalPort: strPtr("54000")},
+			Default: "bah",
+			Error:   fmt.Errorf("missing port in address"),
+		},
+		{
+			Target:   Target{},
+			Default:  "unix:/tmp/rds/.s.PGSQL.5432",
+			Expected: "unix:/tmp/rds/.s.PGSQL.5432",
+		},
+		{
+			Target:   Target{LocalPort: strPtr("54000")},
+			Default:  "unix:/tmp/rds/.s.PGSQL.5432",
+			Expected: "unix:/tmp/rds/.s.PGSQL.54000",
+		},
+		{
+			Target:  Target{LocalPort: strPtr("54000")},
+			Default: "unix:/tmp/rds/proxy.sock",
+			Error:   fmt.Errorf("must be named .s.PGSQL.<port>"),
+		},
+	}
+
+	for idx, test := range cases {
+		result, err := test.Target.GetListenAddr(test.Default)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if result != test.Expected {
+			t.Errorf("[Case %d] expected %q, got %q", idx, test.Expected, result)
+		}
+	}
+}
+
+func TestTargetHasTags(t *testing.T) {
+	target := Target{Tags: map[string]string{"env": "prod", "team": "orders"}}
+	cases := []struct {
+		Tags     TagList
+		Expected bool
+	}{
+		{Tags: nil, Expected: true},
+		{Tags: TagList{{Name: "env", Value: "prod"}}, Expected: true},
+		{Tags: TagList{{Name: "env", Value: "prod"}, {Name: "team", Value: "orders"}}, Expected: true},
+		{Tags: TagList{{Name: "env", Value: "staging"}}, Expected: false},
+		{Tags: TagList{{Name: "env", Value: "prod"}, {Name: "owner", Value: "jane"}}, Expected: false},
+	}
+
+	for idx, test := range cases {
+		result := target.HasTags(test.Tags)
+		if result != test.Expected {
+			t.Errorf("[Case %d] Expected %t, got %t", idx, test.Expected, result)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package credentials
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CachingProvider wraps a Provider, reusing credentials for two thirds of
+// their TTL so they are never handed out right before they expire
+type CachingProvider struct {
+	provider  Provider
+	lock      sync.Mutex
+	creds     Credentials
+	expiresAt time.Time
+}
+
+var _ Provider = (*CachingProvider)(nil)
+
+// NewCachingProvider returns a CachingProvider for provider
+func NewCachingProvider(provider Provider) *CachingProvider {
+	return &CachingProvider{provider: provider}
+}
+
+// Credentials returns the cached credentials, or fetches new ones if they
+// are missing or stale
+func (c *CachingProvider) Credentials(ctx context.Context) (Credentials, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.creds.Password != "" && time.Now().Before(c.expiresAt) {
+		return c.creds, nil
+	}
+	creds, err := c.provider.Credentials(ctx)
+	if err != nil {
+		return creds, err
+	}
+	c.creds = creds
+	c.expiresAt = time.Now().Add(creds.TTL * 2 / 3)
+	return creds, nil
+}
@@ -0,0 +1,98 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/mothership/rds-auth-proxy/pkg/aws"
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials/local"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials/secretsmanager"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials/vault"
+	"github.com/mothership/rds-auth-proxy/pkg/file"
+)
+
+// FromConfig returns a caching credential Provider from a target's credential settings.
+func FromConfig(ctx context.Context, src *config.CredentialSource) (credentials.Provider, error) {
+	sources := 0
+	for _, set := range []bool{src.SecretsManager != nil, src.Vault != nil, src.File != nil, len(src.Exec) > 0} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("exactly one credential source must be set, found %d", sources)
+	}
+
+	var provider credentials.Provider
+	switch {
+	case src.SecretsManager != nil:
+		region := src.SecretsManager.Region
+		if parsed, err := arn.Parse(src.SecretsManager.SecretID); region == "" && err == nil {
+			region = parsed.Region
+		}
+		client, err := aws.NewSecretsManagerClient(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		provider = secretsmanager.NewProvider(client, src.SecretsManager.SecretID)
+	case src.Vault != nil:
+		address := src.Vault.Address
+		if address == "" {
+			address = os.Getenv("VAULT_ADDR")
+		}
+		if address == "" {
+			return nil, fmt.Errorf("vault address not set, and VAULT_ADDR is empty")
+		}
+		token, err := vaultToken(src.Vault.TokenPath)
+		if err != nil {
+			return nil, err
+		}
+		provider = vault.NewProvider(address, src.Vault.Path, token)
+	case src.File != nil:
+		provider = local.NewFileProvider(*src.File)
+	default:
+		provider = local.NewExecProvider(src.Exec)
+	}
+	return credentials.NewCachingProvider(provider), nil
+}
+
+// FromTargets returns a Provider for every target with credentials configured, keyed by target name.
+func FromTargets(ctx context.Context, targets map[string]*config.Target) (map[string]credentials.Provider, error) {
+	providers := make(map[string]credentials.Provider, len(targets))
+	for name, target := range targets {
+		if target.Credentials == nil {
+			continue
+		}
+		provider, err := FromConfig(ctx, target.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", name, err)
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+func vaultToken(tokenPath *string) (string, error) {
+	if tokenPath == nil {
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return "", fmt.Errorf("vault token_file not set, and VAULT_TOKEN is empty")
+		}
+		return token, nil
+	}
+	path, err := file.ExpandPath(*tokenPath)
+	if err != nil {
+		return "", err
+	}
+	token, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
@@ -0,0 +1,92 @@
+package credentials_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	. "github.com/mothership/rds-auth-proxy/pkg/credentials/factory"
+)
+
+func TestFromConfigValidation(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "")
+	cases := []struct {
+		Source config.CredentialSource
+		Error  error
+	}{
+		// Case 0: nothing set
+		{
+			Source: config.CredentialSource{},
+			Error:  fmt.Errorf("exactly one credential source must be set, found 0"),
+		},
+		// Case 1: too many set
+		{
+			Source: config.CredentialSource{
+				File: strPtr("/etc/rds-auth-proxy/password"),
+				Exec: []string{"echo", "hunter2"},
+			},
+			Error: fmt.Errorf("exactly one credential source must be set, found 2"),
+		},
+		// Case 2: file
+		{
+			Source: config.CredentialSource{File: strPtr("/etc/rds-auth-proxy/password")},
+			Error:  nil,
+		},
+		// Case 3: vault without an address
+		{
+			Source: config.CredentialSource{Vault: &config.VaultSource{Path: "database/creds/app"}},
+			Error:  fmt.Errorf("vault address not set"),
+		},
+	}
+
+	for idx, test := range cases {
+		_, err := FromConfig(context.Background(), &test.Source)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func TestFromTargets(t *testing.T) {
+	targets := map[string]*config.Target{
+		"iam": {Name: "iam"},
+		"static": {
+			Name:        "static",
+			Credentials: &config.CredentialSource{Exec: []string{"echo", "hunter2"}},
+		},
+	}
+	providers, err := FromTargets(context.Background(), targets)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(providers) != 1 {
+		t.Fatalf("expected 1 provider, got %d", len(providers))
+	}
+	creds, err := providers["static"].Credentials(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if creds.Password != "hunter2" {
+		t.Errorf("expected password from command, got %q", creds.Password)
+	}
+}
+
+// errorContains checks if the error message in out contains the text in
+// want.
+//
+// This is safe when out is nil. Use an empty string for want if you want to
+// test that err is nil.
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
+
+func strPtr(val string) *string {
+	return &val
+}
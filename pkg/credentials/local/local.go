@@ -0,0 +1,64 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+	"github.com/mothership/rds-auth-proxy/pkg/file"
+)
+
+// FileProvider reads credentials from a local file
+type FileProvider struct {
+	path string
+}
+
+var _ credentials.Provider = (*FileProvider)(nil)
+
+// NewFileProvider returns a provider that reads credentials from path. The file
+// can hold the password, or a JSON object with a username and password.
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+// Credentials reads the file, it is re-read on every call so edits are
+// picked up without a restart
+func (f *FileProvider) Credentials(ctx context.Context) (credentials.Credentials, error) {
+	path, err := file.ExpandPath(f.path)
+	if err != nil {
+		return credentials.Credentials{}, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return credentials.Credentials{}, err
+	}
+	return credentials.Parse(data)
+}
+
+// ExecProvider runs a command and reads credentials from its output
+type ExecProvider struct {
+	command []string
+}
+
+var _ credentials.Provider = (*ExecProvider)(nil)
+
+// NewExecProvider returns a provider that runs command, the first element
+// being the program. Output is parsed the same way as a FileProvider's file.
+func NewExecProvider(command []string) *ExecProvider {
+	return &ExecProvider{command: command}
+}
+
+// Credentials runs the command
+func (e *ExecProvider) Credentials(ctx context.Context) (credentials.Credentials, error) {
+	if len(e.command) == 0 {
+		return credentials.Credentials{}, fmt.Errorf("no credential command set")
+	}
+	//nolint:gosec // The command comes from the operator's config file
+	output, err := exec.CommandContext(ctx, e.command[0], e.command[1:]...).Output()
+	if err != nil {
+		return credentials.Credentials{}, fmt.Errorf("credential command %q failed: %w", e.command[0], err)
+	}
+	return credentials.Parse(output)
+}
@@ -0,0 +1,72 @@
+package local_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+	. "github.com/mothership/rds-auth-proxy/pkg/credentials/local"
+)
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte(`{"username": "app", "password": "hunter2"}`), 0600); err != nil {
+		t.Fatalf("failed to write password file: %s", err)
+	}
+
+	creds, err := NewFileProvider(passwordFile).Credentials(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := credentials.Credentials{Username: "app", Password: "hunter2"}
+	if creds != expected {
+		t.Errorf("expected %+v, got %+v", expected, creds)
+	}
+
+	if _, err := NewFileProvider(filepath.Join(dir, "missing")).Credentials(context.Background()); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestExecProvider(t *testing.T) {
+	cases := []struct {
+		Command  []string
+		Expected credentials.Credentials
+		Error    bool
+	}{
+		// Case 0: password on stdout
+		{
+			Command:  []string{"echo", "hunter2"},
+			Expected: credentials.Credentials{Password: "hunter2"},
+		},
+		// Case 1: command fails
+		{
+			Command: []string{"false"},
+			Error:   true,
+		},
+		// Case 2: no command
+		{
+			Command: nil,
+			Error:   true,
+		},
+	}
+
+	for idx, test := range cases {
+		creds, err := NewExecProvider(test.Command).Credentials(context.Background())
+		if test.Error != (err != nil) {
+			t.Fatalf("[Case %d] expected error: %t, got %+v", idx, test.Error, err)
+		}
+		if creds != test.Expected {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, creds)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrNoPassword is returned when a credential source didn't contain a password
+var ErrNoPassword = errors.New("no password found in credentials")
+
+// Credentials are the username and password used to log in to a target
+type Credentials struct {
+	// Username overrides the user the client connected with, if set
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// TTL is how long the credentials may be reused, zero disables caching
+	TTL time.Duration `json:"-"`
+}
+
+// Provider looks up the credentials for a target
+type Provider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// Parse reads credentials from either a JSON object with "username" and
+// "password" keys (the format RDS uses for Secrets Manager secrets), or
+// treats the whole value as the password.
+func Parse(data []byte) (Credentials, error) {
+	var creds Credentials
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		if err := json.Unmarshal([]byte(trimmed), &creds); err != nil {
+			return creds, err
+		}
+	} else {
+		creds.Password = trimmed
+	}
+	if creds.Password == "" {
+		return creds, ErrNoPassword
+	}
+	return creds, nil
+}
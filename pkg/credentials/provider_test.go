@@ -0,0 +1,122 @@
+package credentials_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/credentials"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		Data     string
+		Expected Credentials
+		Error    error
+	}{
+		// Case 0: plain password
+		{
+			Data:     "hunter2\n",
+			Expected: Credentials{Password: "hunter2"},
+		},
+		// Case 1: JSON with a username
+		{
+			Data:     `{"username": "app", "password": "hunter2", "engine": "postgres"}`,
+			Expected: Credentials{Username: "app", Password: "hunter2"},
+		},
+		// Case 2: empty file
+		{
+			Data:  "  \n",
+			Error: ErrNoPassword,
+		},
+		// Case 3: JSON without a password
+		{
+			Data:  `{"username": "app"}`,
+			Error: ErrNoPassword,
+		},
+		// Case 4: broken JSON
+		{
+			Data:  `{"username": `,
+			Error: fmt.Errorf("unexpected end of JSON input"),
+		},
+	}
+
+	for idx, test := range cases {
+		creds, err := Parse([]byte(test.Data))
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if err == nil && creds != test.Expected {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, creds)
+		}
+	}
+}
+
+func TestCachingProvider(t *testing.T) {
+	cases := []struct {
+		TTL           time.Duration
+		ExpectedCalls int
+	}{
+		// Case 0: no TTL, never cached
+		{TTL: 0, ExpectedCalls: 3},
+		// Case 1: long TTL, fetched once
+		{TTL: time.Hour, ExpectedCalls: 1},
+	}
+
+	for idx, test := range cases {
+		mock := &mockProvider{Creds: Credentials{Password: "hunter2", TTL: test.TTL}}
+		provider := NewCachingProvider(mock)
+		for i := 0; i < 3; i++ {
+			creds, err := provider.Credentials(context.Background())
+			if err != nil {
+				t.Fatalf("[Case %d] unexpected error: %s", idx, err)
+			}
+			if creds.Password != "hunter2" {
+				t.Errorf("[Case %d] expected password to be passed through, got %q", idx, creds.Password)
+			}
+		}
+		if mock.Calls != test.ExpectedCalls {
+			t.Errorf("[Case %d] expected %d calls, got %d", idx, test.ExpectedCalls, mock.Calls)
+		}
+	}
+}
+
+func TestCachingProviderDoesNotCacheErrors(t *testing.T) {
+	mock := &mockProvider{Error: fmt.Errorf("vault sealed")}
+	provider := NewCachingProvider(mock)
+	for i := 0; i < 2; i++ {
+		if _, err := provider.Credentials(context.Background()); err == nil {
+			t.Fatalf("expected an error")
+		}
+	}
+	if mock.Calls != 2 {
+		t.Errorf("expected 2 calls, got %d", mock.Calls)
+	}
+}
+
+type mockProvider struct {
+	Calls int
+	Creds Credentials
+	Error error
+}
+
+func (m *mockProvider) Credentials(ctx context.Context) (Credentials, error) {
+	m.Calls++
+	return m.Creds, m.Error
+}
+
+// errorContains checks if the error message in out contains the text in
+// want.
+//
+// This is safe when out is nil. Use an empty string for want if you want to
+// test that err is nil.
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
@@ -0,0 +1,53 @@
+package secretsmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+)
+
+// DefaultTTL is how long a secret is reused before it's fetched again, so
+// rotated secrets are picked up
+const DefaultTTL = 5 * time.Minute
+
+// GetSecretValueAPI is the part of the Secrets Manager client we use,
+// allows us to mock this for testing
+type GetSecretValueAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// Provider reads credentials from an AWS Secrets Manager secret
+type Provider struct {
+	client   GetSecretValueAPI
+	secretID string
+}
+
+var _ credentials.Provider = (*Provider)(nil)
+
+// NewProvider returns a Provider for the secret name or ARN
+func NewProvider(client GetSecretValueAPI, secretID string) *Provider {
+	return &Provider{client: client, secretID: secretID}
+}
+
+// Credentials fetches the current version of the secret. The secret can
+// hold the password, or a JSON object with a username and password.
+func (p *Provider) Credentials(ctx context.Context) (credentials.Credentials, error) {
+	out, err := p.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: &p.secretID,
+	})
+	if err != nil {
+		return credentials.Credentials{}, err
+	}
+	if out.SecretString == nil {
+		return credentials.Credentials{}, fmt.Errorf("secret %q has no string value", p.secretID)
+	}
+	creds, err := credentials.Parse([]byte(*out.SecretString))
+	if err != nil {
+		return creds, err
+	}
+	creds.TTL = DefaultTTL
+	return creds, nil
+}
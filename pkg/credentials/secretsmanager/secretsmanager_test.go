@@ -0,0 +1,61 @@
+package secretsmanager_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	sm "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+	. "github.com/mothership/rds-auth-proxy/pkg/credentials/secretsmanager"
+)
+
+func TestSecretsManagerProvider(t *testing.T) {
+	client := &mockSecretsManager{Secrets: map[string]string{
+		"rds-json":  `{"username": "app", "password": "hunter2", "engine": "postgres"}`,
+		"plaintext": "hunter2",
+	}}
+
+	cases := []struct {
+		SecretID string
+		Expected credentials.Credentials
+		Error    bool
+	}{
+		{
+			SecretID: "rds-json",
+			Expected: credentials.Credentials{Username: "app", Password: "hunter2", TTL: DefaultTTL},
+		},
+		{
+			SecretID: "plaintext",
+			Expected: credentials.Credentials{Password: "hunter2", TTL: DefaultTTL},
+		},
+		{
+			SecretID: "missing",
+			Error:    true,
+		},
+	}
+
+	for idx, test := range cases {
+		creds, err := NewProvider(client, test.SecretID).Credentials(context.Background())
+		if test.Error != (err != nil) {
+			t.Fatalf("[Case %d] expected error: %t, got %+v", idx, test.Error, err)
+		}
+		if creds != test.Expected {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, creds)
+		}
+	}
+}
+
+type mockSecretsManager struct {
+	Secrets map[string]string
+}
+
+var _ GetSecretValueAPI = (*mockSecretsManager)(nil)
+
+func (m *mockSecretsManager) GetSecretValue(ctx context.Context, params *sm.GetSecretValueInput, optFns ...func(*sm.Options)) (*sm.GetSecretValueOutput, error) {
+	secret, ok := m.Secrets[*params.SecretId]
+	if !ok {
+		return nil, fmt.Errorf("ResourceNotFoundException: secret %q not found", *params.SecretId)
+	}
+	return &sm.GetSecretValueOutput{SecretString: &secret}, nil
+}
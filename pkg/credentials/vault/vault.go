@@ -0,0 +1,75 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+)
+
+// Provider reads dynamic database credentials from HashiCorp Vault
+type Provider struct {
+	address string
+	path    string
+	token   string
+	client  *http.Client
+}
+
+var _ credentials.Provider = (*Provider)(nil)
+
+// secretResponse is the subset of Vault's secret response we use
+type secretResponse struct {
+	LeaseDuration int `json:"lease_duration"`
+	Data          struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// NewProvider returns a Provider reading path (ex: database/creds/readonly)
+// from the Vault server at address
+func NewProvider(address, path, token string) *Provider {
+	return &Provider{
+		address: strings.TrimSuffix(address, "/"),
+		path:    strings.Trim(path, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Credentials requests a new set of credentials from Vault. Both the
+// username and password are returned, and are valid for the lease duration.
+func (p *Provider) Credentials(ctx context.Context) (credentials.Credentials, error) {
+	var creds credentials.Credentials
+	url := fmt.Sprintf("%s/v1/%s", p.address, p.path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return creds, err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return creds, err
+	}
+	defer resp.Body.Close()
+
+	var secret secretResponse
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return creds, fmt.Errorf("failed to decode vault response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return creds, fmt.Errorf("vault returned status %d: %s", resp.StatusCode, strings.Join(secret.Errors, ", "))
+	}
+	if secret.Data.Password == "" {
+		return creds, credentials.ErrNoPassword
+	}
+	creds.Username = secret.Data.Username
+	creds.Password = secret.Data.Password
+	creds.TTL = time.Duration(secret.LeaseDuration) * time.Second
+	return creds, nil
+}
@@ -0,0 +1,95 @@
+package vault_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/credentials"
+	. "github.com/mothership/rds-auth-proxy/pkg/credentials/vault"
+)
+
+func TestVaultProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/database/creds/readonly":
+			fmt.Fprint(w, `{"lease_id": "database/creds/readonly/abc", "lease_duration": 3600, "data": {"username": "v-token-readonly-abc", "password": "hunter2"}}`)
+		case "/v1/database/creds/empty":
+			fmt.Fprint(w, `{"lease_duration": 3600, "data": {}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": []}`)
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		Path     string
+		Token    string
+		Expected credentials.Credentials
+		Error    error
+	}{
+		// Case 0: dynamic credentials
+		{
+			Path:  "database/creds/readonly",
+			Token: "s.token",
+			Expected: credentials.Credentials{
+				Username: "v-token-readonly-abc",
+				Password: "hunter2",
+				TTL:      time.Hour,
+			},
+		},
+		// Case 1: bad token
+		{
+			Path:  "database/creds/readonly",
+			Token: "s.wrong",
+			Error: fmt.Errorf("vault returned status 403: permission denied"),
+		},
+		// Case 2: missing path
+		{
+			Path:  "database/creds/missing",
+			Token: "s.token",
+			Error: fmt.Errorf("vault returned status 404"),
+		},
+		// Case 3: no password in the secret
+		{
+			Path:  "/database/creds/empty/",
+			Token: "s.token",
+			Error: credentials.ErrNoPassword,
+		},
+	}
+
+	for idx, test := range cases {
+		provider := NewProvider(server.URL+"/", test.Path, test.Token)
+		creds, err := provider.Credentials(context.Background())
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if creds != test.Expected {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, creds)
+		}
+	}
+}
+
+// errorContains checks if the error message in out contains the text in
+// want.
+//
+// This is safe when out is nil. Use an empty string for want if you want to
+// test that err is nil.
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
@@ -0,0 +1,218 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"github.com/mothership/rds-auth-proxy/pkg/netutil"
+	"go.uber.org/zap"
+)
+
+// Commands understood by the daemon
+const (
+	CommandUp     = "up"
+	CommandDown   = "down"
+	CommandStatus = "status"
+)
+
+// requestTimeout bounds how long a control connection can stay open
+const requestTimeout = 30 * time.Second
+
+// Request is sent to the daemon over the control socket, one per connection
+type Request struct {
+	Command    string `json:"command"`
+	Target     string `json:"target,omitempty"`
+	ListenAddr string `json:"listen_addr,omitempty"`
+}
+
+// Tunnel is an open tunnel, as reported by the daemon
+type Tunnel struct {
+	Target     string    `json:"target"`
+	ListenAddr string    `json:"listen_addr"`
+	Started    time.Time `json:"started"`
+}
+
+// Response is the daemon's reply to a request
+type Response struct {
+	Error   string   `json:"error,omitempty"`
+	Tunnels []Tunnel `json:"tunnels"`
+}
+
+// Opener opens a tunnel to the target, and returns the address it listens on.
+// An empty listenAddr lets the opener pick. The tunnel is closed when ctx is canceled.
+type Opener func(ctx context.Context, target, listenAddr string) (string, error)
+
+type openTunnel struct {
+	Tunnel
+	cancel context.CancelFunc
+}
+
+// Server opens and closes tunnels on request
+type Server struct {
+	opener  Opener
+	lock    sync.Mutex
+	tunnels map[string]*openTunnel
+}
+
+// NewServer returns a server opening tunnels with opener
+func NewServer(opener Opener) *Server {
+	return &Server{
+		opener:  opener,
+		tunnels: map[string]*openTunnel{},
+	}
+}
+
+// Listen listens on a unix socket at path, only reachable by the current user.
+// A socket left behind by a daemon that's no longer running is replaced.
+func Listen(path string) (net.Listener, error) {
+	listener, err := netutil.ListenUnix(path)
+	if errors.Is(err, netutil.ErrSocketInUse) {
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	return listener, err
+}
+
+// Serve handles requests until ctx is canceled, then closes every tunnel
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	defer s.closeAll()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	var req Request
+	var res Response
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		res.Error = fmt.Sprintf("bad request: %s", err)
+	} else if err := s.Do(ctx, req); err != nil {
+		res.Error = err.Error()
+	}
+	res.Tunnels = s.Tunnels()
+	if err := json.NewEncoder(conn).Encode(res); err != nil {
+		log.Warn("failed to reply on control socket", zap.Error(err))
+	}
+}
+
+// Do runs a request
+func (s *Server) Do(ctx context.Context, req Request) error {
+	switch req.Command {
+	case CommandUp:
+		return s.up(ctx, req.Target, req.ListenAddr)
+	case CommandDown:
+		return s.down(req.Target)
+	case CommandStatus:
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", req.Command)
+	}
+}
+
+func (s *Server) up(ctx context.Context, target, listenAddr string) error {
+	if target == "" {
+		return fmt.Errorf("no target given")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.tunnels[target]; ok {
+		return nil
+	}
+
+	tunnelCtx, cancel := context.WithCancel(ctx)
+	addr, err := s.opener(tunnelCtx, target, listenAddr)
+	if err != nil {
+		cancel()
+		return err
+	}
+	log.Info("tunnel up", zap.String("target", target), zap.String("listen_addr", addr))
+	s.tunnels[target] = &openTunnel{
+		Tunnel: Tunnel{Target: target, ListenAddr: addr, Started: time.Now()},
+		cancel: cancel,
+	}
+	return nil
+}
+
+// down closes the tunnel to target, or every tunnel if target is empty
+func (s *Server) down(target string) error {
+	if target == "" {
+		s.closeAll()
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.tunnels[target]
+	if !ok {
+		return fmt.Errorf("no tunnel open to %q", target)
+	}
+	t.cancel()
+	delete(s.tunnels, target)
+	log.Info("tunnel down", zap.String("target", target))
+	return nil
+}
+
+func (s *Server) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, t := range s.tunnels {
+		t.cancel()
+		delete(s.tunnels, name)
+		log.Info("tunnel down", zap.String("target", name))
+	}
+}
+
+// Tunnels returns the open tunnels, sorted by target
+func (s *Server) Tunnels() []Tunnel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tunnels := make([]Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t.Tunnel)
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Target < tunnels[j].Target })
+	return tunnels
+}
+
+// Send sends a request to the daemon listening on path, and returns its
+// response. Errors reported by the daemon are returned as errors.
+func Send(path string, req Request) (Response, error) {
+	var res Response
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return res, fmt.Errorf("failed to reach the daemon, is `rds-auth-proxy daemon` running? %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return res, err
+	}
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return res, err
+	}
+	if res.Error != "" {
+		return res, fmt.Errorf("%s", res.Error)
+	}
+	return res, nil
+}
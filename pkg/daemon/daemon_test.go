@@ -0,0 +1,265 @@
+package daemon_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pgproto3 "github.com/jackc/pgproto3/v2"
+	. "github.com/mothership/rds-auth-proxy/pkg/daemon"
+	"github.com/mothership/rds-auth-proxy/pkg/pg"
+	"github.com/mothership/rds-auth-proxy/pkg/proxy"
+)
+
+// fakeOpen opens a pretend tunnel, defaulting to the postgres port
+func fakeOpen(ctx context.Context, target, listenAddr string) (string, error) {
+	if target == "missing" {
+		return "", fmt.Errorf("target %q: target not found", target)
+	}
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:5432"
+	}
+	return listenAddr, nil
+}
+
+func TestServer(t *testing.T) {
+	cases := []struct {
+		Requests        []Request
+		ExpectedError   error
+		ExpectedTunnels []string
+	}{
+		// Case 0: nothing open
+		{
+			Requests:        []Request{{Command: CommandStatus}},
+			ExpectedTunnels: []string{},
+		},
+		// Case 1: open two tunnels
+		{
+			Requests: []Request{
+				{Command: CommandUp, Target: "b"},
+				{Command: CommandUp, Target: "a", ListenAddr: "127.0.0.1:8001"},
+			},
+			ExpectedTunnels: []string{"a=127.0.0.1:8001", "b=127.0.0.1:5432"},
+		},
+		// Case 2: up twice is a no-op
+		{
+			Requests: []Request{
+				{Command: CommandUp, Target: "a"},
+				{Command: CommandUp, Target: "a", ListenAddr: "127.0.0.1:8001"},
+			},
+			ExpectedTunnels: []string{"a=127.0.0.1:5432"},
+		},
+		// Case 3: close one tunnel
+		{
+			Requests: []Request{
+				{Command: CommandUp, Target: "a"},
+				{Command: CommandUp, Target: "b", ListenAddr: "127.0.0.1:8001"},
+				{Command: CommandDown, Target: "a"},
+			},
+			ExpectedTunnels: []string{"b=127.0.0.1:8001"},
+		},
+		// Case 4: close every tunnel
+		{
+			Requests: []Request{
+				{Command: CommandUp, Target: "a"},
+				{Command: CommandUp, Target: "b", ListenAddr: "127.0.0.1:8001"},
+				{Command: CommandDown},
+			},
+			ExpectedTunnels: []string{},
+		},
+		// Case 5: unknown target
+		{
+			Requests:        []Request{{Command: CommandUp, Target: "missing"}},
+			ExpectedError:   fmt.Errorf("target \"missing\": target not found"),
+			ExpectedTunnels: []string{},
+		},
+		// Case 6: closing a tunnel that isn't open
+		{
+			Requests:        []Request{{Command: CommandDown, Target: "a"}},
+			ExpectedError:   fmt.Errorf("no tunnel open to \"a\""),
+			ExpectedTunnels: []string{},
+		},
+		// Case 7: unknown command
+		{
+			Requests:        []Request{{Command: "restart"}},
+			ExpectedError:   fmt.Errorf("unknown command \"restart\""),
+			ExpectedTunnels: []string{},
+		},
+	}
+
+	for idx, test := range cases {
+		dir, err := ioutil.TempDir("", "daemon")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "control.sock")
+
+		listener, err := Listen(path)
+		if err != nil {
+			t.Fatalf("[Case %d]: unexpected error listening: %+v", idx, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("[Case %d]: expected socket to be owner only, got %+v %+v", idx, info, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- NewServer(fakeOpen).Serve(ctx, listener)
+		}()
+
+		var res Response
+		for _, req := range test.Requests {
+			res, err = Send(path, req)
+		}
+		if !errorContains(err, test.ExpectedError) {
+			t.Errorf("[Case %d]: expected error %+v, got %+v", idx, test.ExpectedError, err)
+		}
+		tunnels := make([]string, 0, len(res.Tunnels))
+		for _, tunnel := range res.Tunnels {
+			tunnels = append(tunnels, tunnel.Target+"="+tunnel.ListenAddr)
+		}
+		if !reflect.DeepEqual(tunnels, test.ExpectedTunnels) {
+			t.Errorf("[Case %d]: expected tunnels %+v, got %+v", idx, test.ExpectedTunnels, tunnels)
+		}
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("[Case %d]: unexpected error from Serve: %+v", idx, err)
+		}
+	}
+}
+
+// proxyOpen opens a tunnel with a real client proxy, like the daemon does
+func proxyOpen(ctx context.Context, target, listenAddr string) (string, error) {
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:0"
+	}
+	manager, err := proxy.NewManager(proxy.WithListenAddress(listenAddr), proxy.WithMode(proxy.ClientSide))
+	if err != nil {
+		return "", err
+	}
+	addr, err := manager.Listen()
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		_ = manager.Start(ctx)
+	}()
+	return addr.String(), nil
+}
+
+func TestServerProxyTunnels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = NewServer(proxyOpen).Serve(ctx, listener)
+	}()
+
+	if _, err := Send(path, Request{Command: CommandUp, Target: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Send(path, Request{Command: CommandUp, Target: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tunnels) != 2 {
+		t.Fatalf("expected 2 tunnels, got %+v", res.Tunnels)
+	}
+
+	// Connect to both tunnels at once, each proxy answers an SSL request
+	var wg sync.WaitGroup
+	for idx := 0; idx < 5; idx++ {
+		for _, tunnel := range res.Tunnels {
+			wg.Add(1)
+			go func(tunnel Tunnel) {
+				defer wg.Done()
+				if err := requestSSL(tunnel.ListenAddr); err != nil {
+					t.Errorf("[%s] %+v", tunnel.Target, err)
+				}
+			}(tunnel)
+		}
+	}
+	wg.Wait()
+}
+
+// requestSSL sends an SSL request to a proxy without SSL, and expects it
+// to be refused
+func requestSSL(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := conn.Write((&pgproto3.SSLRequest{}).Encode(nil)); err != nil {
+		return err
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != pg.SSLNotAllowed {
+		return fmt.Errorf("expected SSL to be refused, got %q", reply[0])
+	}
+	return nil
+}
+
+func TestListenRefusesRunningDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if _, err := Listen(path); !errorContains(err, fmt.Errorf("a daemon is already listening")) {
+		t.Errorf("expected error for a running daemon, got %+v", err)
+	}
+}
+
+func TestSendWithoutDaemon(t *testing.T) {
+	_, err := Send(filepath.Join(os.TempDir(), "no-such-daemon.sock"), Request{Command: CommandStatus})
+	if !errorContains(err, fmt.Errorf("failed to reach the daemon")) {
+		t.Errorf("expected error reaching the daemon, got %+v", err)
+	}
+}
+
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
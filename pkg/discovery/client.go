@@ -13,3 +13,15 @@ type Client interface {
 	GetTargets() []config.Target
 	Refresh(ctx context.Context) error
 }
+
+// Exclusion is a database the discovery client found, but won't connect to
+type Exclusion struct {
+	Target config.Target
+	Reason string
+}
+
+// ExclusionReporter is implemented by discovery clients that can explain
+// which databases they excluded, and why
+type ExclusionReporter interface {
+	GetExclusions() []Exclusion
+}
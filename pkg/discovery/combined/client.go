@@ -12,6 +12,7 @@ type CombinedDiscoveryClient struct {
 }
 
 var _ discovery.Client = (*CombinedDiscoveryClient)(nil)
+var _ discovery.ExclusionReporter = (*CombinedDiscoveryClient)(nil)
 
 func NewCombinedDiscoveryClient(clients []discovery.Client) *CombinedDiscoveryClient {
 	return &CombinedDiscoveryClient{
@@ -45,6 +46,17 @@ func (c *CombinedDiscoveryClient) GetTargets() []config.Target {
 	return targetList
 }
 
+// GetExclusions returns the exclusions from every client that reports them
+func (c *CombinedDiscoveryClient) GetExclusions() []discovery.Exclusion {
+	exclusions := make([]discovery.Exclusion, 0)
+	for _, client := range c.clients {
+		if reporter, ok := client.(discovery.ExclusionReporter); ok {
+			exclusions = append(exclusions, reporter.GetExclusions()...)
+		}
+	}
+	return exclusions
+}
+
 func (c *CombinedDiscoveryClient) Refresh(ctx context.Context) error {
 	for _, client := range c.clients {
 		if err := client.Refresh(ctx); err != nil {
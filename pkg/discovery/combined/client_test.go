@@ -1,6 +1,7 @@
 package combined_test
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/mothership/rds-auth-proxy/pkg/config"
@@ -62,7 +63,7 @@ func TestCombinedDiscoveryClientHostLookupSuccess(t *testing.T) {
 		if err != nil {
 			t.Fatalf("[Case %d] unexpected error: %s", idx, err)
 		}
-		if test.Expected != target {
+		if !reflect.DeepEqual(test.Expected, target) {
 			t.Errorf("[Case %d] expected %+v. Got %+v.", idx, test.Expected, target)
 		}
 	}
@@ -93,7 +94,7 @@ func TestCombinedDiscoveryClientNameLookupSuccess(t *testing.T) {
 		if err != nil {
 			t.Fatalf("[Case %d] unexpected error: %s", idx, err)
 		}
-		if test.Expected != target {
+		if !reflect.DeepEqual(test.Expected, target) {
 			t.Errorf("[Case %d] expected %+v. Got %+v.", idx, test.Expected, target)
 		}
 	}
@@ -141,7 +142,7 @@ func TestCombinedDiscoveryClientGetTargets(t *testing.T) {
 		if err != nil {
 			t.Fatalf("unexpected error %+v", err)
 		}
-		if found != target {
+		if !reflect.DeepEqual(found, target) {
 			t.Fatalf("found wrong target: %+v, expected %+v", found, target)
 		}
 	}
@@ -3,9 +3,11 @@ package rds
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
 	"sync"
 
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
 	"github.com/mothership/rds-auth-proxy/pkg/aws"
 	"github.com/mothership/rds-auth-proxy/pkg/config"
 	"github.com/mothership/rds-auth-proxy/pkg/discovery"
@@ -15,8 +17,16 @@ import (
 )
 
 const (
-	defaultDatabaseTag = "rds-auth-proxy:db-name"
-	localPortTag       = "rds-auth-proxy:local-port"
+	defaultDatabaseTag  = "rds-auth-proxy:db-name"
+	localPortTag        = "rds-auth-proxy:local-port"
+	allowedUsersTag     = "rds-auth-proxy:allowed-users"
+	allowedDatabasesTag = "rds-auth-proxy:allowed-databases"
+	allowedClientsTag   = "rds-auth-proxy:allowed-clients"
+	clientUsersTag      = "rds-auth-proxy:client-users"
+	readOnlyUsersTag    = "rds-auth-proxy:read-only-users"
+	allowedCIDRsTag     = "rds-auth-proxy:allowed-cidrs"
+	deniedCIDRsTag      = "rds-auth-proxy:denied-cidrs"
+	statusAvailable     = "available"
 )
 
 type RdsDiscoveryClient struct {
@@ -24,9 +34,11 @@ type RdsDiscoveryClient struct {
 	config     *config.ConfigFile
 	client     aws.RDSClient
 	rdsTargets map[string]config.Target
+	exclusions []discovery.Exclusion
 }
 
 var _ discovery.Client = (*RdsDiscoveryClient)(nil)
+var _ discovery.ExclusionReporter = (*RdsDiscoveryClient)(nil)
 
 func NewRdsDiscoveryClient(client aws.RDSClient, cfg *config.ConfigFile) *RdsDiscoveryClient {
 	return &RdsDiscoveryClient{
@@ -34,6 +46,7 @@ func NewRdsDiscoveryClient(client aws.RDSClient, cfg *config.ConfigFile) *RdsDis
 		config:     cfg,
 		client:     client,
 		rdsTargets: map[string]config.Target{},
+		exclusions: []discovery.Exclusion{},
 	}
 }
 
@@ -68,64 +81,192 @@ func (r *RdsDiscoveryClient) GetTargets() []config.Target {
 	return targetList
 }
 
+// GetExclusions returns the instances skipped during the last refresh, and why
+func (r *RdsDiscoveryClient) GetExclusions() []discovery.Exclusion {
+	r.targetLock.RLock()
+	defer r.targetLock.RUnlock()
+	exclusions := make([]discovery.Exclusion, len(r.exclusions))
+	copy(exclusions, r.exclusions)
+	return exclusions
+}
+
 // RefreshRDSTargets searches AWS for allowed dbs updates the target list
 func (r *RdsDiscoveryClient) Refresh(ctx context.Context) (err error) {
 	// XXX: Must consume ALL of these, else I think we leak the channel
 	resChan := r.client.GetPostgresInstances(ctx)
 	rdsTargets := map[string]config.Target{}
+	exclusions := []discovery.Exclusion{}
+	instances := []types.DBInstance{}
 	for result := range resChan {
 		if result.Error != nil {
 			err = result.Error
 			continue
 		}
 		d := result.Instance
+		target := config.Target{
+			Name:            *d.DBInstanceIdentifier,
+			DefaultDatabase: d.DBName,
+			SSL: config.SSL{
+				Mode:                  pg.SSLVerifyFull,
+				ClientCertificatePath: r.config.Proxy.SSL.ClientCertificatePath,
+				ClientPrivateKeyPath:  r.config.Proxy.SSL.ClientPrivateKeyPath,
+				RootCertificatePaths:  rdsRootCertificates(r.config.Proxy),
+			},
+			Tags:  make(map[string]string, len(d.TagList)),
+			IsRDS: true,
+		}
+		for _, tag := range d.TagList {
+			target.Tags[*tag.Key] = *tag.Value
+			if *tag.Key == defaultDatabaseTag {
+				target.DefaultDatabase = tag.Value
+			} else if *tag.Key == localPortTag {
+				target.LocalPort = tag.Value
+			} else if *tag.Key == allowedUsersTag {
+				target.AllowedUsers = config.ParsePatternList(*tag.Value)
+			} else if *tag.Key == allowedDatabasesTag {
+				target.AllowedDatabases = config.ParsePatternList(*tag.Value)
+			} else if *tag.Key == allowedClientsTag {
+				target.AllowedClients = config.ParsePatternList(*tag.Value)
+			} else if *tag.Key == clientUsersTag {
+				bindings, tagErr := config.ParseClientUsers(*tag.Value)
+				if tagErr != nil {
+					// Without the bindings, clients are asked for a password
+					log.Warn("ignoring invalid client users tag", zap.String("name", *d.DBInstanceIdentifier), zap.Error(tagErr))
+					continue
+				}
+				target.ClientUsers = bindings
+			} else if *tag.Key == readOnlyUsersTag {
+				target.ReadOnlyUsers = config.ParsePatternList(*tag.Value)
+			} else if *tag.Key == allowedCIDRsTag {
+				target.AllowedCIDRs = config.ParseList(*tag.Value)
+			} else if *tag.Key == deniedCIDRsTag {
+				target.DeniedCIDRs = config.ParseList(*tag.Value)
+			}
+		}
+
 		if d.Endpoint == nil {
 			log.Warn("db instance missing endpoint, skipping", zap.String("name", *d.DBInstanceIdentifier))
+			exclusions = append(exclusions, discovery.Exclusion{Target: target, Reason: "missing endpoint"})
 			continue
 		}
+		target.Host = fmt.Sprintf("%+v:%+v", *d.Endpoint.Address, strconv.FormatInt(int64(d.Endpoint.Port), 10))
 
 		if tmpErr := r.config.Proxy.ACL.IsAllowed(d.TagList); tmpErr != nil {
 			log.Debug("db instance not allowed by acl", zap.String("name", *d.DBInstanceIdentifier))
+			exclusions = append(exclusions, discovery.Exclusion{Target: target, Reason: tmpErr.Error()})
+			continue
+		}
+
+		// Skipped rather than ignoring the tag, which would let every client in
+		if tmpErr := target.ParseCIDRs(); tmpErr != nil {
+			log.Warn("db instance has invalid CIDR tags, skipping", zap.String("name", *d.DBInstanceIdentifier), zap.Error(tmpErr))
+			exclusions = append(exclusions, discovery.Exclusion{Target: target, Reason: tmpErr.Error()})
 			continue
 		}
 
 		region, regionErr := r.client.RegionForInstance(d)
 		if regionErr != nil {
 			log.Error("failed to detect db region, skipping", zap.Error(regionErr), zap.String("name", *d.DBInstanceIdentifier))
+			exclusions = append(exclusions, discovery.Exclusion{Target: target, Reason: "failed to detect region"})
 			continue
 		}
+		target.Region = region
 
 		if !d.IAMDatabaseAuthenticationEnabled {
 			log.Warn("db instance does not have IAM auth enabled, skipping", zap.String("name", *d.DBInstanceIdentifier))
+			exclusions = append(exclusions, discovery.Exclusion{Target: target, Reason: "IAM auth not enabled"})
 			continue
 		}
 
-		target := config.Target{
-			Name:            *d.DBInstanceIdentifier,
-			Host:            fmt.Sprintf("%+v:%+v", *d.Endpoint.Address, strconv.FormatInt(int64(d.Endpoint.Port), 10)),
-			DefaultDatabase: d.DBName,
-			SSL: config.SSL{
-				Mode:                  pg.SSLVerifyFull,
-				ClientCertificatePath: r.config.Proxy.SSL.ClientCertificatePath,
-				ClientPrivateKeyPath:  r.config.Proxy.SSL.ClientPrivateKeyPath,
-			},
-			Region: region,
-			IsRDS:  true,
-		}
-		for _, tag := range d.TagList {
-			if *tag.Key == defaultDatabaseTag {
-				target.DefaultDatabase = tag.Value
-			} else if *tag.Key == localPortTag {
-				target.LocalPort = tag.Value
-			}
-		}
 		rdsTargets[target.Host] = target
+		instances = append(instances, d)
 	}
 
 	if err == nil {
+		r.linkReplicas(ctx, rdsTargets, instances)
 		r.targetLock.Lock()
 		defer r.targetLock.Unlock()
 		r.rdsTargets = rdsTargets
+		r.exclusions = exclusions
 	}
 	return err
 }
+
+// linkReplicas fills in each writer's replicas, from RDS read replicas and
+// Aurora cluster readers. Only available replicas that are targets themselves
+// are used.
+func (r *RdsDiscoveryClient) linkReplicas(ctx context.Context, rdsTargets map[string]config.Target, instances []types.DBInstance) {
+	hosts := make(map[string]string, len(instances))
+	replicas := map[string][]string{}
+	hasClusters := false
+	for _, d := range instances {
+		hosts[*d.DBInstanceIdentifier] = fmt.Sprintf("%s:%d", *d.Endpoint.Address, d.Endpoint.Port)
+		if d.DBClusterIdentifier != nil {
+			hasClusters = true
+		}
+		if d.ReadReplicaSourceDBInstanceIdentifier != nil && isAvailable(d) {
+			source := *d.ReadReplicaSourceDBInstanceIdentifier
+			replicas[source] = append(replicas[source], *d.DBInstanceIdentifier)
+		}
+	}
+
+	if hasClusters {
+		clusters, err := r.client.GetPostgresClusters(ctx)
+		if err != nil {
+			// Not fatal, the cluster instances still work as targets on their own
+			log.Warn("failed to list aurora clusters, skipping their readers", zap.Error(err))
+		}
+		available := make(map[string]bool, len(instances))
+		for _, d := range instances {
+			available[*d.DBInstanceIdentifier] = isAvailable(d)
+		}
+		for _, cluster := range clusters {
+			writer := ""
+			readers := []string{}
+			for _, member := range cluster.DBClusterMembers {
+				if member.DBInstanceIdentifier == nil {
+					continue
+				}
+				if member.IsClusterWriter {
+					writer = *member.DBInstanceIdentifier
+				} else if available[*member.DBInstanceIdentifier] {
+					readers = append(readers, *member.DBInstanceIdentifier)
+				}
+			}
+			if writer != "" {
+				replicas[writer] = append(replicas[writer], readers...)
+			}
+		}
+	}
+
+	for writer, names := range replicas {
+		writerHost, ok := hosts[writer]
+		if !ok {
+			continue
+		}
+		target := rdsTargets[writerHost]
+		target.Replicas = nil
+		for _, name := range names {
+			if host, ok := hosts[name]; ok {
+				target.Replicas = append(target.Replicas, host)
+			}
+		}
+		sort.Strings(target.Replicas)
+		rdsTargets[writerHost] = target
+	}
+}
+
+// isAvailable returns true if the instance can take connections, instances
+// without a status are assumed to
+func isAvailable(d types.DBInstance) bool {
+	return d.DBInstanceStatus == nil || *d.DBInstanceStatus == statusAvailable
+}
+
+// rdsRootCertificates returns the CAs that sign RDS server certificates, the
+// bundle built into the proxy unless the config has a copy
+func rdsRootCertificates(proxy config.Proxy) []string {
+	if proxy.RDSCABundle != nil {
+		return []string{*proxy.RDSCABundle}
+	}
+	return []string{config.RootCertificateRDS}
+}
@@ -3,6 +3,8 @@ package rds_test
 import (
 	"context"
 	"fmt"
+	"net"
+	"reflect"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/service/rds/types"
@@ -256,8 +258,256 @@ func TestRdsDiscoveryClientGetTargets(t *testing.T) {
 	// TODO: sort and test that each instance was present, currently a low quality test
 }
 
+func TestRefreshParsesAllowListTags(t *testing.T) {
+	instances := []aws.DBInstanceResult{
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("db-1"),
+			Endpoint:             endpoint("db-1", 5000),
+			TagList:              rdsTags("rds-auth-proxy:allowed-users", "app_+ readonly"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("db-2"),
+			Endpoint:             endpoint("db-2", 5000),
+			TagList:              rdsTags("rds-auth-proxy:allowed-databases", "orders"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("db-3"),
+			Endpoint:             endpoint("db-3", 5000),
+			TagList:              rdsTags("rds-auth-proxy:allowed-cidrs", "10.8.0.0/16"),
+		}),
+	}
+
+	cases := []struct {
+		Name             string
+		AllowedUsers     []string
+		AllowedDatabases []string
+		DeniedAddr       net.Addr
+	}{
+		{
+			Name:         "db-1",
+			AllowedUsers: []string{"app_*", "readonly"},
+		},
+		{
+			Name:             "db-2",
+			AllowedDatabases: []string{"orders"},
+		},
+		// Case 2: CIDRs are parsed when the target is discovered
+		{
+			Name:       "db-3",
+			DeniedAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 50000},
+		},
+	}
+
+	config := configFromACL(nil, nil)
+	client := NewRdsDiscoveryClient(&mockRDSClient{Return: instances}, &config)
+	if err := client.Refresh(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %+v", err)
+	}
+	for idx, test := range cases {
+		target, err := client.LookupTargetByName(test.Name)
+		if err != nil {
+			t.Fatalf("[Case %d] got unexpected error: %s", idx, err)
+		}
+		if !reflect.DeepEqual(target.AllowedUsers, test.AllowedUsers) {
+			t.Errorf("[Case %d] expected users %+v. Got %+v.", idx, test.AllowedUsers, target.AllowedUsers)
+		}
+		if !reflect.DeepEqual(target.AllowedDatabases, test.AllowedDatabases) {
+			t.Errorf("[Case %d] expected databases %+v. Got %+v.", idx, test.AllowedDatabases, target.AllowedDatabases)
+		}
+		if test.DeniedAddr == nil {
+			continue
+		}
+		if err := target.IsAddrAllowed(&net.TCPAddr{IP: net.ParseIP("10.8.1.20"), Port: 50000}); err != nil {
+			t.Errorf("[Case %d] expected no error, got %+v", idx, err)
+		}
+		if err := target.IsAddrAllowed(test.DeniedAddr); err == nil {
+			t.Errorf("[Case %d] expected %s to be denied", idx, test.DeniedAddr)
+		}
+	}
+}
+
+func TestRefreshTrustsRDSCertificates(t *testing.T) {
+	instances := []aws.DBInstanceResult{
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("db-1"),
+			Endpoint:             endpoint("db-1", 5000),
+		}),
+	}
+
+	cases := []struct {
+		RDSCABundle *string
+		Expected    []string
+	}{
+		// Case 0: the bundle built into the proxy
+		{Expected: []string{config.RootCertificateRDS}},
+		// Case 1: a newer copy of the bundle
+		{RDSCABundle: strPtr("/etc/rds-auth-proxy/global-bundle.pem"), Expected: []string{"/etc/rds-auth-proxy/global-bundle.pem"}},
+	}
+
+	for idx, test := range cases {
+		config := configFromACL(nil, nil)
+		config.Proxy.RDSCABundle = test.RDSCABundle
+		client := NewRdsDiscoveryClient(&mockRDSClient{Return: instances}, &config)
+		if err := client.Refresh(context.Background()); err != nil {
+			t.Fatalf("[Case %d] expected no error, got: %+v", idx, err)
+		}
+		target, err := client.LookupTargetByName("db-1")
+		if err != nil {
+			t.Fatalf("[Case %d] got unexpected error: %s", idx, err)
+		}
+		if !reflect.DeepEqual(target.SSL.RootCertificates(), test.Expected) {
+			t.Errorf("[Case %d] expected root certificates %+v. Got %+v.", idx, test.Expected, target.SSL.RootCertificates())
+		}
+	}
+}
+
+func TestRefreshRecordsExclusions(t *testing.T) {
+	noIAM := types.DBInstance{
+		DBInstanceIdentifier: strPtr("db-3"),
+		Endpoint:             endpoint("db-3", 5000),
+		TagList:              rdsTags("enabled", "true"),
+	}
+	instances := []aws.DBInstanceResult{
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("db-1"),
+			Endpoint:             endpoint("db-1", 5000),
+			TagList:              rdsTags("enabled", "true"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("db-2"),
+			Endpoint:             endpoint("db-2", 5000),
+			TagList:              rdsTags("enabled", "false"),
+		}),
+		{Instance: noIAM},
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("db-4"),
+			TagList:              rdsTags("enabled", "true"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("db-5"),
+			Endpoint:             endpoint("db-5", 5000),
+			TagList:              append(rdsTags("enabled", "true"), rdsTags("rds-auth-proxy:allowed-cidrs", "10.8.0.0/33")...),
+		}),
+	}
+
+	config := configFromACL(tags("enabled", "true"), nil)
+	client := NewRdsDiscoveryClient(&mockRDSClient{Return: instances}, &config)
+	if err := client.Refresh(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %+v", err)
+	}
+
+	expected := map[string]string{
+		"db-2": "tag \"enabled\" has wrong value \"false\" (wanted: \"true\")",
+		"db-3": "IAM auth not enabled",
+		"db-4": "missing endpoint",
+		"db-5": "invalid CIDRs on target \"db-5\": invalid CIDR \"10.8.0.0/33\"",
+	}
+	exclusions := client.GetExclusions()
+	if len(exclusions) != len(expected) {
+		t.Fatalf("expected %d exclusions, got %+v", len(expected), exclusions)
+	}
+	for _, exclusion := range exclusions {
+		if exclusion.Reason != expected[exclusion.Target.Name] {
+			t.Errorf("expected %q to be excluded with %q, got %q", exclusion.Target.Name, expected[exclusion.Target.Name], exclusion.Reason)
+		}
+	}
+	if len(client.GetTargets()) != 1 {
+		t.Errorf("expected exclusions not to be in the target list")
+	}
+}
+
+func TestRefreshLinksReplicas(t *testing.T) {
+	instances := []aws.DBInstanceResult{
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("orders"),
+			Endpoint:             endpoint("orders", 5432),
+			TagList:              rdsTags("rds-auth-proxy:read-only-users", "analytics_+"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier:                  strPtr("orders-replica-1"),
+			Endpoint:                              endpoint("orders-replica-1", 5432),
+			ReadReplicaSourceDBInstanceIdentifier: strPtr("orders"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier:                  strPtr("orders-replica-2"),
+			Endpoint:                              endpoint("orders-replica-2", 5432),
+			ReadReplicaSourceDBInstanceIdentifier: strPtr("orders"),
+			DBInstanceStatus:                      strPtr("rebooting"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("billing-1"),
+			Endpoint:             endpoint("billing-1", 5432),
+			DBClusterIdentifier:  strPtr("billing"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("billing-2"),
+			Endpoint:             endpoint("billing-2", 5432),
+			DBClusterIdentifier:  strPtr("billing"),
+		}),
+		instance(types.DBInstance{
+			DBInstanceIdentifier: strPtr("billing-3"),
+			Endpoint:             endpoint("billing-3", 5432),
+			DBClusterIdentifier:  strPtr("billing"),
+		}),
+	}
+	clusters := []types.DBCluster{
+		{
+			DBClusterIdentifier: strPtr("billing"),
+			DBClusterMembers: []types.DBClusterMember{
+				{DBInstanceIdentifier: strPtr("billing-1")},
+				{DBInstanceIdentifier: strPtr("billing-2"), IsClusterWriter: true},
+				{DBInstanceIdentifier: strPtr("billing-3")},
+			},
+		},
+	}
+
+	cases := []struct {
+		Name          string
+		Replicas      []string
+		ReadOnlyUsers []string
+	}{
+		// Case 0: RDS read replicas, skipping the one that isn't available
+		{
+			Name:          "orders",
+			Replicas:      []string{"orders-replica-1:5432"},
+			ReadOnlyUsers: []string{"analytics_*"},
+		},
+		// Case 1: replicas don't have replicas of their own
+		{
+			Name: "orders-replica-1",
+		},
+		// Case 2: Aurora readers
+		{
+			Name:     "billing-2",
+			Replicas: []string{"billing-1:5432", "billing-3:5432"},
+		},
+		{
+			Name: "billing-1",
+		},
+	}
+
+	config := configFromACL(nil, nil)
+	client := NewRdsDiscoveryClient(&mockRDSClient{Return: instances, Clusters: clusters}, &config)
+	if err := client.Refresh(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %+v", err)
+	}
+	for idx, test := range cases {
+		target, err := client.LookupTargetByName(test.Name)
+		if err != nil {
+			t.Fatalf("[Case %d] got unexpected error: %s", idx, err)
+		}
+		if !reflect.DeepEqual(target.Replicas, test.Replicas) {
+			t.Errorf("[Case %d] expected replicas %+v. Got %+v.", idx, test.Replicas, target.Replicas)
+		}
+		if !reflect.DeepEqual(target.ReadOnlyUsers, test.ReadOnlyUsers) {
+			t.Errorf("[Case %d] expected read only users %+v. Got %+v.", idx, test.ReadOnlyUsers, target.ReadOnlyUsers)
+		}
+	}
+}
+
 type mockRDSClient struct {
-	Return []aws.DBInstanceResult
+	Return   []aws.DBInstanceResult
+	Clusters []types.DBCluster
 }
 
 var _ aws.RDSClient = (*mockRDSClient)(nil)
@@ -276,6 +526,10 @@ func (m *mockRDSClient) GetPostgresInstances(ctx context.Context) <-chan aws.DBI
 	return retChan
 }
 
+func (m *mockRDSClient) GetPostgresClusters(ctx context.Context) ([]types.DBCluster, error) {
+	return m.Clusters, nil
+}
+
 func (m *mockRDSClient) NewAuthToken(ctx context.Context, host, region, user string) (string, error) {
 	return "", nil
 }
@@ -23,6 +23,14 @@ func (s *StaticDiscoveryClient) LookupTargetByHost(host string) (config.Target,
 	if target, ok := s.targets[host]; ok {
 		return target, nil
 	}
+	// Replicas are reached with their writer's settings
+	for _, target := range s.targets {
+		for _, replica := range target.Replicas {
+			if replica == host {
+				return target, nil
+			}
+		}
+	}
 	return config.Target{}, discovery.ErrTargetNotFound
 }
 
@@ -1,6 +1,7 @@
 package static_test
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/mothership/rds-auth-proxy/pkg/config"
@@ -38,8 +39,11 @@ func TestStaticDiscoveryClientHostLookupFailures(t *testing.T) {
 }
 
 func TestStaticDiscoveryClientHostLookupSuccess(t *testing.T) {
+	withReplica := makeTarget("orders", "orders.com:5432")
+	withReplica.Replicas = []string{"orders-replica.com:5432"}
 	staticTargets := map[string]config.Target{
-		"test.com:5432": makeTarget("test", "test.com:5432"),
+		"test.com:5432":   makeTarget("test", "test.com:5432"),
+		"orders.com:5432": withReplica,
 	}
 	cases := []struct {
 		Targets  map[string]config.Target
@@ -51,6 +55,12 @@ func TestStaticDiscoveryClientHostLookupSuccess(t *testing.T) {
 			Host:     "test.com:5432",
 			Expected: staticTargets["test.com:5432"],
 		},
+		// Replicas resolve to their writer
+		{
+			Targets:  staticTargets,
+			Host:     "orders-replica.com:5432",
+			Expected: withReplica,
+		},
 	}
 	for idx, test := range cases {
 		client := NewStaticDiscoveryClient(test.Targets)
@@ -58,7 +68,7 @@ func TestStaticDiscoveryClientHostLookupSuccess(t *testing.T) {
 		if err != nil {
 			t.Fatalf("[Case %d] unexpected error: %s", idx, err)
 		}
-		if test.Expected != target {
+		if !reflect.DeepEqual(test.Expected, target) {
 			t.Errorf("[Case %d] expected %+v. Got %+v.", idx, test.Expected, target)
 		}
 	}
@@ -85,7 +95,7 @@ func TestStaticDiscoveryClientNameLookupSuccess(t *testing.T) {
 		if err != nil {
 			t.Fatalf("[Case %d] unexpected error: %s", idx, err)
 		}
-		if test.Expected != target {
+		if !reflect.DeepEqual(test.Expected, target) {
 			t.Errorf("[Case %d] expected %+v. Got %+v.", idx, test.Expected, target)
 		}
 	}
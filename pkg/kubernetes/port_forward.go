@@ -3,13 +3,18 @@ package kubernetes
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"time"
 
 	"github.com/mothership/rds-auth-proxy/pkg/file"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	restclient "k8s.io/client-go/rest"
@@ -32,60 +37,227 @@ type PortForwardCommand struct {
 	ReadyChannel  chan struct{}
 }
 
+// PortForwardOptions picks the pod to forward to. Set one of Deployment,
+// Selector, Service or Pod.
 type PortForwardOptions struct {
-	Namespace  string
+	Namespace string
+	// Deployment selects pods labeled app.kubernetes.io/name=<deployment>
 	Deployment string
-	Ports      []string
-	Context    string
+	// Selector is a label selector for the pods
+	Selector string
+	// Service forwards to one of the pods behind the service's endpoints
+	Service string
+	// Pod forwards to a single pod
+	Pod     string
+	Ports   []string
+	Context string
 }
 
-func loadConfig(path, context string) (*restclient.Config, error) {
+// loadConfig loads the kubeconfig, and returns it with the name of the context in use
+func loadConfig(path, context string) (*restclient.Config, string, error) {
 	loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: path}
 	overrides := &clientcmd.ConfigOverrides{}
 	if context != "" {
 		overrides.CurrentContext = context
 	}
-	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	if context == "" {
+		if raw, err := clientConfig.RawConfig(); err == nil {
+			context = raw.CurrentContext
+		}
+	}
+	return config, context, nil
 }
 
-func BuildPortForwardCommand(ctx context.Context, kubeConfigPath string, opts PortForwardOptions) (*PortForwardCommand, error) {
-	cmd := &PortForwardCommand{
-		Namespace:    opts.Namespace,
-		Ports:        opts.Ports,
-		Address:      []string{"localhost"},
-		Out:          new(bytes.Buffer),
-		ErrOut:       new(bytes.Buffer),
-		StopChannel:  make(chan struct{}, 1),
-		ReadyChannel: make(chan struct{}),
-	}
+// loadClient loads the kubeconfig at kubeConfigPath, and returns a client for
+// it, along with the name of the context in use
+func loadClient(kubeConfigPath, context string) (*restclient.Config, *kubernetes.Clientset, string, error) {
 	path, err := file.ExpandPath(kubeConfigPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, "", err
 	}
-	config, err := loadConfig(path, opts.Context)
+	config, context, err := loadConfig(path, context)
 	if err != nil {
-		return nil, err
+		return nil, nil, "", err
 	}
-	cmd.Config = config
-	// create the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, err
+		return nil, nil, "", err
 	}
+	return config, clientset, context, nil
+}
+
+// SelectPod returns a random ready pod matching opts
+func SelectPod(ctx context.Context, client corev1client.CoreV1Interface, opts PortForwardOptions) (string, error) {
+	set := 0
+	for _, opt := range []string{opts.Deployment, opts.Selector, opts.Service, opts.Pod} {
+		if opt != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return "", fmt.Errorf("port-forward needs exactly one of a deployment, selector, service or pod")
+	}
+
+	var candidates []string
+	var source string
+	switch {
+	case opts.Pod != "":
+		source = fmt.Sprintf("pod %q", opts.Pod)
+		pod, err := client.Pods(opts.Namespace).Get(ctx, opts.Pod, v1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		if isPodReady(pod) {
+			candidates = append(candidates, pod.Name)
+		}
+	case opts.Service != "":
+		source = fmt.Sprintf("service %q", opts.Service)
+		endpoints, err := client.Endpoints(opts.Namespace).Get(ctx, opts.Service, v1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		// Only ready pods are listed in Addresses, the rest are in NotReadyAddresses
+		for _, subset := range endpoints.Subsets {
+			for _, address := range subset.Addresses {
+				if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+					candidates = append(candidates, address.TargetRef.Name)
+				}
+			}
+		}
+	default:
+		selector := opts.Selector
+		if selector == "" {
+			selector = fmt.Sprintf("app.kubernetes.io/name=%s", opts.Deployment)
+		}
+		source = fmt.Sprintf("selector %q", selector)
+		pods, err := client.Pods(opts.Namespace).List(ctx, v1.ListOptions{
+			LabelSelector: selector,
+			FieldSelector: "status.phase=Running",
+		})
+		if err != nil {
+			return "", err
+		}
+		for idx := range pods.Items {
+			if isPodReady(&pods.Items[idx]) {
+				candidates = append(candidates, pods.Items[idx].Name)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no ready pods found for %s in namespace %q (context %q)", source, opts.Namespace, opts.Context)
+	}
+	rand.Seed(time.Now().Unix())
+	return candidates[rand.Intn(len(candidates))], nil
+}
 
-	cmd.Client = clientset.CoreV1().RESTClient()
-	cmd.PodClient = clientset.CoreV1()
-	pods, err := cmd.PodClient.Pods(opts.Namespace).List(ctx, v1.ListOptions{
-		LabelSelector: fmt.Sprintf("app.kubernetes.io/name=%s", opts.Deployment),
-		FieldSelector: "status.phase=Running",
-		Limit:         3,
-	})
+// isPodReady is true for running pods passing their readiness checks, that
+// aren't shutting down
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// ErrPodGone is wrapped by WatchPod's error when the pod is gone
+var ErrPodGone = errors.New("pod is gone")
+
+// WatchPod blocks until the pod is deleted, starts shutting down, or stops
+// being ready. The error wraps ErrPodGone then, otherwise the watch failed or
+// ctx was canceled.
+func WatchPod(ctx context.Context, client corev1client.PodsGetter, namespace, name string) error {
+	for {
+		// Checked before each watch, since the pod may have changed between
+		// watches, and the API server closes them every few minutes
+		pod, err := client.Pods(namespace).Get(ctx, name, v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("pod %q was deleted: %w", name, ErrPodGone)
+		}
+		if err != nil {
+			return err
+		}
+		if !isPodReady(pod) {
+			return fmt.Errorf("pod %q isn't ready: %w", name, ErrPodGone)
+		}
+
+		watcher, err := client.Pods(namespace).Watch(ctx, v1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+			ResourceVersion: pod.ResourceVersion,
+		})
+		if err != nil {
+			return err
+		}
+		err = waitPodGone(ctx, watcher, name)
+		watcher.Stop()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// waitPodGone returns an error wrapping ErrPodGone once the watched pod is
+// gone, ctx's error once it's canceled, or nil when the watch closes
+func waitPodGone(ctx context.Context, watcher watch.Interface, name string) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil
+			}
+			pod, ok := event.Object.(*corev1.Pod)
+			if !ok || pod.Name != name {
+				continue
+			}
+			switch {
+			case event.Type == watch.Deleted:
+				return fmt.Errorf("pod %q was deleted: %w", name, ErrPodGone)
+			case !isPodReady(pod):
+				return fmt.Errorf("pod %q isn't ready: %w", name, ErrPodGone)
+			}
+		}
+	}
+}
+
+func BuildPortForwardCommand(ctx context.Context, kubeConfigPath string, opts PortForwardOptions) (*PortForwardCommand, error) {
+	config, clientset, kubeContext, err := loadClient(kubeConfigPath, opts.Context)
 	if err != nil {
 		return nil, err
 	}
+	opts.Context = kubeContext
+	return buildPortForwardCommand(ctx, config, clientset, opts)
+}
 
-	rand.Seed(time.Now().Unix())
-	cmd.PodName = pods.Items[rand.Intn(len(pods.Items))].Name
+func buildPortForwardCommand(ctx context.Context, config *restclient.Config, clientset *kubernetes.Clientset, opts PortForwardOptions) (*PortForwardCommand, error) {
+	cmd := &PortForwardCommand{
+		Namespace:    opts.Namespace,
+		Ports:        opts.Ports,
+		Address:      []string{"localhost"},
+		Out:          new(bytes.Buffer),
+		ErrOut:       new(bytes.Buffer),
+		StopChannel:  make(chan struct{}, 1),
+		ReadyChannel: make(chan struct{}),
+		Config:       config,
+		Client:       clientset.CoreV1().RESTClient(),
+		PodClient:    clientset.CoreV1(),
+	}
+	podName, err := SelectPod(ctx, clientset.CoreV1(), opts)
+	if err != nil {
+		return nil, err
+	}
+	cmd.PodName = podName
 	return cmd, nil
 }
 
@@ -0,0 +1,210 @@
+package kubernetes_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/kubernetes"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testPod(name string, labels map[string]string, phase corev1.PodPhase, ready bool, deleting bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "proxy", Labels: labels},
+		Status: corev1.PodStatus{
+			Phase:      phase,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+	if deleting {
+		now := v1.Now()
+		pod.DeletionTimestamp = &now
+	}
+	return pod
+}
+
+func testEndpoints(name string, ready []string, notReady []string) *corev1.Endpoints {
+	subset := corev1.EndpointSubset{}
+	for _, pod := range ready {
+		subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{IP: "10.0.0.1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: pod}})
+	}
+	for _, pod := range notReady {
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses, corev1.EndpointAddress{IP: "10.0.0.2", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: pod}})
+	}
+	return &corev1.Endpoints{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "proxy"},
+		Subsets:    []corev1.EndpointSubset{subset},
+	}
+}
+
+func TestSelectPod(t *testing.T) {
+	appLabels := map[string]string{"app.kubernetes.io/name": "rds-auth-proxy"}
+	customLabels := map[string]string{"app": "proxy", "tier": "db"}
+	objects := []runtime.Object{
+		testPod("ready", appLabels, corev1.PodRunning, true, false),
+		testPod("not-ready", appLabels, corev1.PodRunning, false, false),
+		testPod("terminating", appLabels, corev1.PodRunning, true, true),
+		testPod("pending", customLabels, corev1.PodPending, false, false),
+		testPod("custom-ready", customLabels, corev1.PodRunning, true, false),
+		testEndpoints("proxy-svc", []string{"svc-ready"}, []string{"svc-not-ready"}),
+		testEndpoints("empty-svc", nil, []string{"svc-not-ready"}),
+	}
+
+	cases := []struct {
+		Options  PortForwardOptions
+		Expected string
+		Error    error
+	}{
+		// Case 0: deployment picks only ready pods
+		{
+			Options:  PortForwardOptions{Namespace: "proxy", Deployment: "rds-auth-proxy"},
+			Expected: "ready",
+		},
+		// Case 1: label selector
+		{
+			Options:  PortForwardOptions{Namespace: "proxy", Selector: "app=proxy,tier=db"},
+			Expected: "custom-ready",
+		},
+		// Case 2: service endpoints
+		{
+			Options:  PortForwardOptions{Namespace: "proxy", Service: "proxy-svc"},
+			Expected: "svc-ready",
+		},
+		// Case 3: single pod
+		{
+			Options:  PortForwardOptions{Namespace: "proxy", Pod: "ready"},
+			Expected: "ready",
+		},
+		// Case 4: single pod that isn't ready
+		{
+			Options: PortForwardOptions{Namespace: "proxy", Pod: "not-ready", Context: "prod"},
+			Error:   fmt.Errorf("no ready pods found for pod \"not-ready\" in namespace \"proxy\" (context \"prod\")"),
+		},
+		// Case 5: service without ready endpoints
+		{
+			Options: PortForwardOptions{Namespace: "proxy", Service: "empty-svc", Context: "prod"},
+			Error:   fmt.Errorf("no ready pods found for service \"empty-svc\" in namespace \"proxy\" (context \"prod\")"),
+		},
+		// Case 6: nothing matches
+		{
+			Options: PortForwardOptions{Namespace: "other", Deployment: "rds-auth-proxy", Context: "prod"},
+			Error:   fmt.Errorf("no ready pods found for selector \"app.kubernetes.io/name=rds-auth-proxy\" in namespace \"other\" (context \"prod\")"),
+		},
+		// Case 7: more than one way to pick a pod
+		{
+			Options: PortForwardOptions{Namespace: "proxy", Deployment: "rds-auth-proxy", Service: "proxy-svc"},
+			Error:   fmt.Errorf("exactly one of a deployment, selector, service or pod"),
+		},
+		// Case 8: no way to pick a pod
+		{
+			Options: PortForwardOptions{Namespace: "proxy"},
+			Error:   fmt.Errorf("exactly one of a deployment, selector, service or pod"),
+		},
+	}
+
+	client := fake.NewSimpleClientset(objects...)
+	for idx, test := range cases {
+		pod, err := SelectPod(context.Background(), client.CoreV1(), test.Options)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if pod != test.Expected {
+			t.Errorf("[Case %d] expected pod %q, got %q", idx, test.Expected, pod)
+		}
+	}
+}
+
+func TestWatchPod(t *testing.T) {
+	cases := []struct {
+		Pod *corev1.Pod
+		// Change is applied to the pod once it's watched
+		Change func(client *fake.Clientset) error
+		Gone   bool
+		Error  error
+	}{
+		// Case 0: pod doesn't exist
+		{
+			Gone:  true,
+			Error: fmt.Errorf("pod \"ready\" was deleted"),
+		},
+		// Case 1: pod isn't ready
+		{
+			Pod:   testPod("ready", nil, corev1.PodRunning, false, false),
+			Gone:  true,
+			Error: fmt.Errorf("pod \"ready\" isn't ready"),
+		},
+		// Case 2: pod is deleted
+		{
+			Pod: testPod("ready", nil, corev1.PodRunning, true, false),
+			Change: func(client *fake.Clientset) error {
+				return client.CoreV1().Pods("proxy").Delete(context.Background(), "ready", v1.DeleteOptions{})
+			},
+			Gone:  true,
+			Error: fmt.Errorf("pod \"ready\" was deleted"),
+		},
+		// Case 3: pod starts shutting down
+		{
+			Pod: testPod("ready", nil, corev1.PodRunning, true, false),
+			Change: func(client *fake.Clientset) error {
+				_, err := client.CoreV1().Pods("proxy").Update(context.Background(), testPod("ready", nil, corev1.PodRunning, true, true), v1.UpdateOptions{})
+				return err
+			},
+			Gone:  true,
+			Error: fmt.Errorf("pod \"ready\" isn't ready"),
+		},
+		// Case 4: other pods changing are ignored, until the watch is canceled
+		{
+			Pod: testPod("ready", nil, corev1.PodRunning, true, false),
+			Change: func(client *fake.Clientset) error {
+				_, err := client.CoreV1().Pods("proxy").Create(context.Background(), testPod("other", nil, corev1.PodRunning, false, false), v1.CreateOptions{})
+				return err
+			},
+			Error: context.DeadlineExceeded,
+		},
+	}
+
+	for idx, test := range cases {
+		var objects []runtime.Object
+		if test.Pod != nil {
+			objects = append(objects, test.Pod)
+		}
+		client := fake.NewSimpleClientset(objects...)
+		// Signal once the watch is set up, so changes aren't missed
+		watching := make(chan struct{}, 1)
+		client.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+			watcher, err := client.Tracker().Watch(action.GetResource(), action.GetNamespace())
+			watching <- struct{}{}
+			return true, watcher, err
+		})
+		if test.Change != nil {
+			go func() {
+				<-watching
+				if err := test.Change(client); err != nil {
+					t.Errorf("[Case %d] %+v", idx, err)
+				}
+			}()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		err := WatchPod(ctx, client.CoreV1(), "proxy", "ready")
+		cancel()
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if errors.Is(err, ErrPodGone) != test.Gone {
+			t.Errorf("[Case %d] expected pod gone to be %v, got %+v", idx, test.Gone, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMinBackoff is the wait before the first reconnect attempt
+	DefaultMinBackoff = 500 * time.Millisecond
+	// DefaultMaxBackoff caps the wait between reconnect attempts
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// OpenFunc opens a port-forward for ports, calls ready with the local ports
+// once it's listening, and blocks until the port-forward drops
+type OpenFunc func(ctx context.Context, ports []string, ready func(localPorts []uint16)) error
+
+// Supervisor keeps a port-forward open. When it drops, or its pod goes away
+// (ex: the pod restarted during a deploy), it picks another pod and
+// reconnects on the same local ports, backing off between attempts.
+type Supervisor struct {
+	Ports      []string
+	Open       OpenFunc
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	done       chan struct{}
+}
+
+// NewSupervisor returns a supervisor forwarding to a ready pod picked by opts
+func NewSupervisor(kubeConfigPath string, opts PortForwardOptions) (*Supervisor, error) {
+	config, clientset, kubeContext, err := loadClient(kubeConfigPath, opts.Context)
+	if err != nil {
+		return nil, err
+	}
+	opts.Context = kubeContext
+	open := func(ctx context.Context, ports []string, ready func([]uint16)) error {
+		// Stops this attempt's port-forward once it returns
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		attemptOpts := opts
+		attemptOpts.Ports = ports
+		cmd, err := buildPortForwardCommand(ctx, config, clientset, attemptOpts)
+		if err != nil {
+			return err
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- ForwardPort(ctx, cmd)
+		}()
+		select {
+		case <-cmd.ReadyChannel:
+		case err := <-done:
+			return err
+		}
+
+		forwarded, err := cmd.PortForwarder.GetPorts()
+		if err != nil {
+			return err
+		}
+		localPorts := make([]uint16, 0, len(forwarded))
+		for _, port := range forwarded {
+			localPorts = append(localPorts, port.Local)
+		}
+		log.Debug("k8s port-forward connected", zap.String("pod", cmd.PodName), zap.String("namespace", cmd.Namespace))
+		ready(localPorts)
+
+		// client-go doesn't notice the pod going away until the next
+		// connection fails, so watch it, and drop the port-forward then
+		watched := make(chan error, 1)
+		go func() {
+			watched <- WatchPod(ctx, clientset.CoreV1(), cmd.Namespace, cmd.PodName)
+		}()
+		for {
+			select {
+			case err := <-done:
+				// client-go returns nil when it loses the pod, the supervisor
+				// reconnects either way
+				return err
+			case err := <-watched:
+				if !errors.Is(err, ErrPodGone) {
+					if ctx.Err() == nil {
+						log.Debug("can't watch the k8s pod, reconnecting only once the port-forward drops", zap.String("pod", cmd.PodName), zap.Error(err))
+					}
+					watched = nil
+					continue
+				}
+				// Wait for the listeners to close, so the reconnect can reuse
+				// the local ports
+				cancel()
+				<-done
+				return err
+			}
+		}
+	}
+	return &Supervisor{
+		Ports:      opts.Ports,
+		Open:       open,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}, nil
+}
+
+// Start opens the port-forward, and returns the local ports once it's ready.
+// It's kept open in the background until ctx is canceled.
+func (s *Supervisor) Start(ctx context.Context) ([]uint16, error) {
+	localPorts, done, err := s.open(ctx, s.Ports)
+	if err != nil {
+		return nil, err
+	}
+	s.done = make(chan struct{})
+	go s.supervise(ctx, pinLocalPorts(s.Ports, localPorts), done)
+	return localPorts, nil
+}
+
+// Done is closed once the port-forward has closed after ctx was canceled
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// supervise waits for the port-forward to drop, and reopens it on ports
+func (s *Supervisor) supervise(ctx context.Context, ports []string, done <-chan error) {
+	defer close(s.done)
+	for {
+		err := <-done
+		if ctx.Err() != nil {
+			log.Info("k8s port-forward closed", zap.Strings("ports", ports))
+			return
+		}
+		log.Warn("k8s port-forward dropped, reconnecting", zap.Error(err), zap.Strings("ports", ports))
+
+		backoff := s.MinBackoff
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			_, done, err = s.open(ctx, ports)
+			if err == nil {
+				log.Info("k8s port-forward reconnected", zap.Strings("ports", ports))
+				break
+			}
+			backoff *= 2
+			if backoff > s.MaxBackoff {
+				backoff = s.MaxBackoff
+			}
+			log.Warn("k8s port-forward reconnect failed", zap.Error(err), zap.Duration("retry_in", backoff))
+		}
+	}
+}
+
+// open opens a port-forward, and waits until it's ready or fails. The returned
+// channel gets the result once the port-forward drops.
+func (s *Supervisor) open(ctx context.Context, ports []string) ([]uint16, <-chan error, error) {
+	ready := make(chan []uint16, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Open(ctx, ports, func(localPorts []uint16) {
+			ready <- localPorts
+		})
+	}()
+	select {
+	case localPorts := <-ready:
+		return localPorts, done, nil
+	case err := <-done:
+		if err == nil {
+			err = fmt.Errorf("k8s port-forward closed before it was ready")
+		}
+		return nil, nil, err
+	}
+}
+
+// pinLocalPorts replaces the local side of each port spec ("local:remote", or
+// "port") with the local port actually in use, so reconnects reuse it
+func pinLocalPorts(ports []string, localPorts []uint16) []string {
+	pinned := make([]string, len(ports))
+	for idx, port := range ports {
+		if idx >= len(localPorts) {
+			pinned[idx] = port
+			continue
+		}
+		remote := port[strings.LastIndex(port, ":")+1:]
+		pinned[idx] = fmt.Sprintf("%d:%s", localPorts[idx], remote)
+	}
+	return pinned
+}
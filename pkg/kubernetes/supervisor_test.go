@@ -0,0 +1,131 @@
+package kubernetes_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/kubernetes"
+)
+
+// fakeForward is a scripted port-forward, each attempt either fails to
+// connect, or connects and drops when told to
+type fakeForward struct {
+	lock     sync.Mutex
+	attempts [][]string
+	fail     map[int]bool
+	drop     chan struct{}
+	ready    chan struct{}
+}
+
+func (f *fakeForward) Open(ctx context.Context, ports []string, ready func([]uint16)) error {
+	f.lock.Lock()
+	attempt := len(f.attempts)
+	f.attempts = append(f.attempts, ports)
+	f.lock.Unlock()
+
+	if f.fail[attempt] {
+		return fmt.Errorf("no running pods")
+	}
+	ready([]uint16{54321})
+	f.ready <- struct{}{}
+	select {
+	case <-ctx.Done():
+	case <-f.drop:
+	}
+	return nil
+}
+
+func (f *fakeForward) Attempts() [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.attempts
+}
+
+func TestSupervisorReconnects(t *testing.T) {
+	forward := &fakeForward{
+		fail:  map[int]bool{1: true, 2: true},
+		drop:  make(chan struct{}),
+		ready: make(chan struct{}, 1),
+	}
+	supervisor := &Supervisor{
+		Ports:      []string{"0:8000"},
+		Open:       forward.Open,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	localPorts, err := supervisor.Start(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(localPorts, []uint16{54321}) {
+		t.Errorf("expected local port 54321, got %+v", localPorts)
+	}
+	<-forward.ready
+
+	// Drop the forward, two attempts fail, then the third reconnects
+	forward.drop <- struct{}{}
+	select {
+	case <-forward.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("port-forward wasn't reopened")
+	}
+
+	expected := [][]string{{"0:8000"}, {"54321:8000"}, {"54321:8000"}, {"54321:8000"}}
+	if attempts := forward.Attempts(); !reflect.DeepEqual(attempts, expected) {
+		t.Errorf("expected attempts %+v, got %+v", expected, attempts)
+	}
+
+	cancel()
+	select {
+	case <-supervisor.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor didn't stop")
+	}
+}
+
+func TestSupervisorStartError(t *testing.T) {
+	cases := []struct {
+		Open  OpenFunc
+		Error error
+	}{
+		// Case 0: fails to connect
+		{
+			Open: func(ctx context.Context, ports []string, ready func([]uint16)) error {
+				return fmt.Errorf("no running pods")
+			},
+			Error: fmt.Errorf("no running pods"),
+		},
+		// Case 1: closes before it's ready
+		{
+			Open: func(ctx context.Context, ports []string, ready func([]uint16)) error {
+				return nil
+			},
+			Error: fmt.Errorf("closed before it was ready"),
+		},
+	}
+
+	for idx, test := range cases {
+		supervisor := &Supervisor{Ports: []string{"0:8000"}, Open: test.Open}
+		_, err := supervisor.Start(context.Background())
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // NewLogger returns a configured Zap Logger
@@ -27,6 +28,16 @@ func NewLogger() *zap.Logger {
 	return logger
 }
 
+// EnvLevel returns the level set by LOG_LEVEL, or defaultLevel if it
+// isn't set
+func EnvLevel(defaultLevel zapcore.Level) zap.AtomicLevel {
+	level := os.Getenv("LOG_LEVEL")
+	if level == "" {
+		return zap.NewAtomicLevelAt(defaultLevel)
+	}
+	return unmarshalLevel(level)
+}
+
 func unmarshalLevel(l string) zap.AtomicLevel {
 	switch l {
 	case "warn":
@@ -0,0 +1,61 @@
+package netutil_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/netutil"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	cases := []struct {
+		CIDRs    []string
+		Expected []string
+		Error    error
+	}{
+		{CIDRs: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}, Expected: []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32"}},
+		{CIDRs: []string{"10.0.0.0/33"}, Error: fmt.Errorf("invalid CIDR \"10.0.0.0/33\"")},
+		{CIDRs: []string{"lb.internal"}, Error: fmt.Errorf("invalid IP \"lb.internal\"")},
+	}
+	for idx, test := range cases {
+		nets, err := ParseCIDRs(test.CIDRs)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		for i, ipNet := range nets {
+			if ipNet.String() != test.Expected[i] {
+				t.Errorf("[Case %d] expected %s, got %s", idx, test.Expected[i], ipNet)
+			}
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	nets, _ := ParseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	cases := []struct {
+		Addr     net.Addr
+		Expected bool
+	}{
+		{Addr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5432}, Expected: true},
+		{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5432}, Expected: true},
+		{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5432}, Expected: false},
+		// Case 3: only TCP addresses can match
+		{Addr: &net.UnixAddr{Name: "/tmp/.s.PGSQL.5432", Net: "unix"}, Expected: false},
+	}
+	for idx, test := range cases {
+		if out := Contains(nets, test.Addr); out != test.Expected {
+			t.Errorf("[Case %d] expected %v, got %v", idx, test.Expected, out)
+		}
+	}
+}
+
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
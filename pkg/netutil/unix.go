@@ -0,0 +1,80 @@
+package netutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// ErrSocketInUse is returned when another process is listening on the socket
+var ErrSocketInUse = fmt.Errorf("another process is listening on the socket")
+
+// unixListener is a socket that was moved to path after it was created, so
+// path is its address, and is removed on close
+type unixListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close removes the socket before closing it, like net.UnixListener, so it's
+// gone by the time Accept returns
+func (l *unixListener) Close() error {
+	removeErr := os.Remove(l.addr.Name)
+	if err := l.UnixListener.Close(); err != nil {
+		return err
+	}
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	return nil
+}
+
+// ListenUnix listens on a unix socket at path, only reachable by the current
+// user. The socket is created in a new directory only the current user can
+// enter, made owner only, then moved to path, so other users can't connect
+// to it in between. That doesn't depend on the umask, which is shared by
+// the whole process. A socket left behind by an earlier run is replaced.
+func ListenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %s", ErrSocketInUse, path)
+		}
+	}
+
+	// Next to path, so the rename doesn't cross filesystems
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	tmpPath := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed from path on close instead
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
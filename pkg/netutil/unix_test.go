@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package netutil_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/netutil"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	listener, err := ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listener.Addr().String() != path {
+		t.Errorf("expected address %s, got %s", path, listener.Addr())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected socket to be owner only, got %s", info.Mode().Perm())
+	}
+	// Only the socket is left next to it
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the socket in %s, got %d entries", dir, len(entries))
+	}
+
+	if _, err := ListenUnix(path); !errors.Is(err, ErrSocketInUse) {
+		t.Errorf("expected %+v, got %+v", ErrSocketInUse, err)
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Errorf("unexpected error closing: %+v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be removed on close, got %+v", err)
+	}
+}
+
+func TestListenUnixKeepsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(path, []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Errorf("isn't a socket")
+	if _, err := ListenUnix(path); !errorContains(err, want) {
+		t.Errorf("expected %+v, got %+v", want, err)
+	}
+	if contents, _ := ioutil.ReadFile(path); string(contents) != "keep me" {
+		t.Errorf("expected the file to be left alone, got %q", contents)
+	}
+}
@@ -2,6 +2,9 @@ package pg
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -14,6 +17,12 @@ const GSSENCecNotAllowed byte = 'N'
 const SSLNotAllowed byte = 'N'
 const SSLAllowed byte = 'S'
 
+// passwordTimeout is how long we wait on a client to answer a password request
+const passwordTimeout = 30 * time.Second
+
+// ErrSSLRequired is returned when asking for a password over a connection without SSL
+var ErrSSLRequired = errors.New("SSL is required to send a password to the proxy")
+
 // Backend acts as the postgres front-end client (ex: psql)
 type Backend interface {
 	io.Closer
@@ -97,10 +106,41 @@ func (b *PostgresBackend) Close() error {
 	return b.connection.Close()
 }
 
+// RequestPassword asks the client for its password in cleartext, so it can
+// be passed along upstream. Refuses to ask unless the connection uses SSL.
+func (b *PostgresBackend) RequestPassword() (string, error) {
+	if _, ok := b.connection.(*tls.Conn); !ok {
+		return "", ErrSSLRequired
+	}
+	if err := b.Send(&pgproto3.AuthenticationCleartextPassword{}); err != nil {
+		return "", err
+	}
+	_ = b.connection.SetReadDeadline(time.Now().Add(passwordTimeout))
+	msg, err := b.backend.Receive()
+	if err != nil {
+		return "", err
+	}
+	password, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return "", fmt.Errorf("expected a password message, got %T", msg)
+	}
+	return password.Password, nil
+}
+
+// PeerCertificates returns the verified client certificate chain, if the
+// connection was upgraded to SSL and the client presented a certificate.
+func (b *PostgresBackend) PeerCertificates() []*x509.Certificate {
+	conn, ok := b.connection.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return conn.ConnectionState().PeerCertificates
+}
+
 // SetupConnection sets up an inbound connection and extracts the login information
 // This will always return the existing connection, unless it had to upgrade to an SSL
-// connection.
-func (b *PostgresBackend) SetupConnection(cert *tls.Certificate) (map[string]string, error) {
+// connection. If tlsConfig is nil, SSL requests are refused.
+func (b *PostgresBackend) SetupConnection(tlsConfig *tls.Config) (map[string]string, error) {
 	for {
 		message, err := b.backend.ReceiveStartupMessage()
 		if err != nil {
@@ -110,7 +150,7 @@ func (b *PostgresBackend) SetupConnection(cert *tls.Certificate) (map[string]str
 		case *pgproto3.StartupMessage:
 			return msg.Parameters, nil
 		case *pgproto3.SSLRequest:
-			if cert == nil {
+			if tlsConfig == nil {
 				err = b.SendRaw([]byte{SSLNotAllowed})
 				if err != nil {
 					return nil, err
@@ -121,7 +161,7 @@ func (b *PostgresBackend) SetupConnection(cert *tls.Certificate) (map[string]str
 			if err != nil {
 				return nil, err
 			}
-			b.connection = UpgradeServer(b.connection, cert)
+			b.connection = UpgradeServer(b.connection, tlsConfig)
 			b.backend = pgproto3.NewBackend(pgproto3.NewChunkReader(b.connection), b.connection)
 			continue
 		case *pgproto3.GSSEncRequest:
@@ -0,0 +1,62 @@
+package pg_test
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	pgproto3 "github.com/jackc/pgproto3/v2"
+	"github.com/mothership/rds-auth-proxy/pkg/cert"
+	. "github.com/mothership/rds-auth-proxy/pkg/pg"
+)
+
+func TestRequestPasswordRequiresSSL(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	backend, _ := NewBackend(server)
+	defer backend.Close()
+
+	if _, err := backend.RequestPassword(); err != ErrSSLRequired {
+		t.Errorf("expected %+v, got %+v", ErrSSLRequired, err)
+	}
+}
+
+func TestRequestPassword(t *testing.T) {
+	certBytes, keyBytes, err := cert.GenerateSelfSignedCert("localhost", false)
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %s", err)
+	}
+	serverCert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+
+	server, client := net.Pipe()
+	// Close the pipes directly, closing the TLS connections waits on a
+	// close_notify nobody is reading
+	defer server.Close()
+	defer client.Close()
+	tlsServer := UpgradeServer(server, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	//nolint:gosec // Test certificate
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+
+	go func() {
+		frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(tlsClient), tlsClient)
+		msg, err := frontend.Receive()
+		if err != nil {
+			return
+		}
+		if _, ok := msg.(*pgproto3.AuthenticationCleartextPassword); ok {
+			_ = frontend.Send(&pgproto3.PasswordMessage{Password: "hunter2"})
+		}
+	}()
+
+	backend, _ := NewBackend(tlsServer)
+	password, err := backend.RequestPassword()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if password != "hunter2" {
+		t.Errorf("expected password %q, got %q", "hunter2", password)
+	}
+}
@@ -34,10 +34,46 @@ type AuthFailedError struct {
 	ErrMsg *pgproto3.ErrorResponse
 }
 
+// NewAuthFailedError returns an AuthFailedError with a FATAL
+// invalid_authorization_specification response for the client
+func NewAuthFailedError(err error) *AuthFailedError {
+	return &AuthFailedError{
+		ErrMsg: &pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "28000",
+			Message:  err.Error(),
+		},
+	}
+}
+
 func (a *AuthFailedError) Error() string {
 	return "auth failed"
 }
 
+// CodeConnectFailed is the sqlclient_unable_to_establish_sqlconnection
+// SQLSTATE, sent when the proxy couldn't reach the upstream server
+const CodeConnectFailed = "08001"
+
+type ConnectFailedError struct {
+	ErrMsg *pgproto3.ErrorResponse
+}
+
+// NewConnectFailedError returns a ConnectFailedError with a FATAL
+// sqlclient_unable_to_establish_sqlconnection response for the client
+func NewConnectFailedError(err error) *ConnectFailedError {
+	return &ConnectFailedError{
+		ErrMsg: &pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     CodeConnectFailed,
+			Message:  err.Error(),
+		},
+	}
+}
+
+func (c *ConnectFailedError) Error() string {
+	return c.ErrMsg.Message
+}
+
 // PostgresFrontend implements a postgres frontend client
 type PostgresFrontend struct {
 	frontend    *pgproto3.Frontend
@@ -0,0 +1,67 @@
+package pg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// pinPrefix is the hash algorithm prefix on a public key pin
+const pinPrefix = "sha256/"
+
+// ErrPinMismatch is returned when the server's certificate doesn't match
+// any of the pinned public keys
+var ErrPinMismatch = errors.New("server certificate doesn't match any pinned public key")
+
+// ParsePublicKeyPins parses pins of the form sha256/<base64 SHA-256 hash of
+// the certificate's DER-encoded SubjectPublicKeyInfo>
+func ParsePublicKeyPins(pins []string) ([][]byte, error) {
+	hashes := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		if !strings.HasPrefix(pin, pinPrefix) {
+			return nil, fmt.Errorf("invalid public key pin %q, expected sha256/<base64 hash>", pin)
+		}
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid public key pin %q, expected sha256/<base64 hash>", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// PublicKeyPin returns the pin for a certificate's public key
+func PublicKeyPin(certificate *x509.Certificate) string {
+	hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// checkPins requires the server's certificate to match one of the pins. Only
+// the leaf is checked unless the chain was verified, otherwise a server could
+// send a real CA's certificate along with its own.
+func checkPins(pins [][]byte, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return ErrPinMismatch
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	candidates := []*x509.Certificate{leaf}
+	for _, chain := range verifiedChains {
+		candidates = append(candidates, chain...)
+	}
+	for _, certificate := range candidates {
+		hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w, got %s", ErrPinMismatch, PublicKeyPin(leaf))
+}
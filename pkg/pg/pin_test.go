@@ -0,0 +1,113 @@
+package pg_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mothership/rds-auth-proxy/pkg/cert"
+	. "github.com/mothership/rds-auth-proxy/pkg/pg"
+)
+
+func TestParsePublicKeyPins(t *testing.T) {
+	cases := []struct {
+		Pins  []string
+		Error error
+	}{
+		// Case 0: valid pin
+		{Pins: []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}},
+		// Case 1: missing algorithm
+		{
+			Pins:  []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+			Error: fmt.Errorf("invalid public key pin"),
+		},
+		// Case 2: not a SHA-256 hash
+		{
+			Pins:  []string{"sha256/aGVsbG8="},
+			Error: fmt.Errorf("invalid public key pin"),
+		},
+		// Case 3: not base64
+		{
+			Pins:  []string{"sha256/not base64!"},
+			Error: fmt.Errorf("invalid public key pin"),
+		},
+	}
+
+	for idx, test := range cases {
+		_, err := ParsePublicKeyPins(test.Pins)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func newKeyPair(t *testing.T) tls.Certificate {
+	certBytes, keyBytes, err := cert.GenerateSelfSignedCert("localhost", false)
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %s", err)
+	}
+	keyPair, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+	return keyPair
+}
+
+func TestUpgradeClientPins(t *testing.T) {
+	serverCert := newKeyPair(t)
+	clientCert := newKeyPair(t)
+	leaf, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	serverPin := PublicKeyPin(leaf)
+	otherPin := "sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	cases := []struct {
+		Mode  SSLMode
+		Pins  []string
+		Error error
+	}{
+		// Case 0: require, matching pin
+		{Mode: SSLRequired, Pins: []string{serverPin}},
+		// Case 1: require, any pin can match
+		{Mode: SSLRequired, Pins: []string{otherPin, serverPin}},
+		// Case 2: require, impersonated server
+		{Mode: SSLRequired, Pins: []string{otherPin}, Error: ErrPinMismatch},
+		// Case 3: verify-ca checks pins after the chain
+		{Mode: SSLVerifyCA, Pins: []string{otherPin}, Error: ErrPinMismatch},
+		// Case 4: no pins
+		{Mode: SSLRequired},
+	}
+
+	for idx, test := range cases {
+		pins, err := ParsePublicKeyPins(test.Pins)
+		if err != nil {
+			t.Fatalf("[Case %d] %+v", idx, err)
+		}
+
+		server, client := net.Pipe()
+		go func() {
+			tlsServer := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+			_ = tlsServer.Handshake()
+		}()
+
+		_, err = UpgradeClient("localhost:5432", client, SSLConfig{
+			Mode:              test.Mode,
+			ClientCertificate: &clientCert,
+			RootCertificates:  []*x509.Certificate{leaf},
+			PinnedPublicKeys:  pins,
+		})
+		if test.Error == nil && err != nil {
+			t.Errorf("[Case %d] expected no error, got %+v", idx, err)
+		} else if test.Error != nil && !errors.Is(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if err != nil && test.Error != nil && !strings.Contains(err.Error(), serverPin) {
+			t.Errorf("[Case %d] expected the error to include the server's pin, got %+v", idx, err)
+		}
+		server.Close()
+		client.Close()
+	}
+}
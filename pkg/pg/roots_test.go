@@ -0,0 +1,87 @@
+package pg_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/mothership/rds-auth-proxy/pkg/cert"
+	. "github.com/mothership/rds-auth-proxy/pkg/pg"
+)
+
+// systemCA signs certificates in the system trust store, as far as these
+// tests are concerned. It's set with SSL_CERT_FILE before anything loads the
+// system pool, which only linux reads.
+var systemCA *cert.CA
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "pg-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	caPEM, keyPEM, err := cert.GenerateCA(cert.Options{CommonName: "System CA"})
+	if err == nil {
+		systemCA, err = cert.LoadCA(caPEM, keyPEM)
+	}
+	if err == nil {
+		path := filepath.Join(dir, "system-ca.pem")
+		if err = ioutil.WriteFile(path, caPEM, 0600); err == nil {
+			err = os.Setenv("SSL_CERT_FILE", path)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestUpgradeClientRoots(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SSL_CERT_FILE only replaces the system trust store on linux")
+	}
+	certPEM, keyPEM, err := systemCA.Issue(cert.Options{Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert := newKeyPair(t)
+	otherRoot, _ := x509.ParseCertificate(otherCert.Certificate[0])
+	server := fakeServer{SSL: true, HBA: "host"}
+
+	cases := []struct {
+		Mode        SSLMode
+		Roots       []*x509.Certificate
+		SystemRoots bool
+		Expected    string
+	}{
+		// Case 0: the system's CAs are trusted without any roots
+		{Mode: SSLVerifyCA, Expected: outcomeSSL},
+		{Mode: SSLVerifyFull, Expected: outcomeSSL},
+		// Case 2: only the configured roots are trusted, like sslrootcert
+		{Mode: SSLVerifyCA, Roots: []*x509.Certificate{otherRoot}, Expected: outcomeError},
+		{Mode: SSLVerifyFull, Roots: []*x509.Certificate{otherRoot}, Expected: outcomeError},
+		// Case 4: require checks the chain when it has roots
+		{Mode: SSLRequired, Roots: []*x509.Certificate{otherRoot}, Expected: outcomeError},
+		// Case 5: the system's CAs along with the roots
+		{Mode: SSLVerifyCA, Roots: []*x509.Certificate{otherRoot}, SystemRoots: true, Expected: outcomeSSL},
+	}
+
+	for idx, test := range cases {
+		outcome := connect(t, server, serverCert, SSLConfig{Mode: test.Mode, RootCertificates: test.Roots, SystemRoots: test.SystemRoots})
+		if outcome != test.Expected {
+			t.Errorf("[Case %d] sslmode=%s: expected %s, got %s", idx, test.Mode, test.Expected, outcome)
+		}
+	}
+}
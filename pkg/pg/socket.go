@@ -0,0 +1,34 @@
+package pg
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// UnixSocketPrefix marks a listen address as a unix socket, ex: unix:/tmp/.s.PGSQL.5432
+const UnixSocketPrefix = "unix:"
+
+// socketFilePrefix is how libpq names unix sockets, followed by the port
+const socketFilePrefix = ".s.PGSQL."
+
+// SocketPath returns the path of the socket for port in dir, named the
+// way libpq expects so psql can connect with -h dir -p port
+func SocketPath(dir, port string) string {
+	return filepath.Join(dir, socketFilePrefix+port)
+}
+
+// SplitSocketPath returns the directory and port libpq uses to find the
+// socket at socketPath
+func SplitSocketPath(socketPath string) (dir string, port string, err error) {
+	dir, name := filepath.Split(socketPath)
+	if !strings.HasPrefix(name, socketFilePrefix) {
+		return "", "", fmt.Errorf("unix socket %q must be named %s<port> for psql to find it", socketPath, socketFilePrefix)
+	}
+	port = strings.TrimPrefix(name, socketFilePrefix)
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("unix socket %q must be named %s<port> for psql to find it", socketPath, socketFilePrefix)
+	}
+	return filepath.Clean(dir), port, nil
+}
@@ -0,0 +1,42 @@
+package pg_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/pg"
+)
+
+func TestSplitSocketPath(t *testing.T) {
+	cases := []struct {
+		Path         string
+		ExpectedDir  string
+		ExpectedPort string
+		Error        error
+	}{
+		{Path: "/tmp/.s.PGSQL.5432", ExpectedDir: "/tmp", ExpectedPort: "5432"},
+		{Path: SocketPath("/run/user/1000/rds", "8000"), ExpectedDir: "/run/user/1000/rds", ExpectedPort: "8000"},
+		{Path: "/tmp/proxy.sock", Error: fmt.Errorf("must be named .s.PGSQL.<port>")},
+		{Path: "/tmp/.s.PGSQL.abc", Error: fmt.Errorf("must be named .s.PGSQL.<port>")},
+	}
+
+	for idx, test := range cases {
+		dir, port, err := SplitSocketPath(test.Path)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if dir != test.ExpectedDir || port != test.ExpectedPort {
+			t.Errorf("[Case %d] expected %q %q, got %q %q", idx, test.ExpectedDir, test.ExpectedPort, dir, port)
+		}
+	}
+}
+
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
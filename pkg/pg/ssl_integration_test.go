@@ -0,0 +1,172 @@
+//go:build integration
+// +build integration
+
+package pg_test
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	pgproto3 "github.com/jackc/pgproto3/v2"
+	. "github.com/mothership/rds-auth-proxy/pkg/pg"
+)
+
+// The users from build/integration/init.sql, each only allowed one kind of
+// connection by build/integration/pg_hba.conf
+const (
+	userAnySSL    = "any_ssl"
+	userSSLOnly   = "ssl_only"
+	userNoSSLOnly = "nossl_only"
+)
+
+// postgresAddr returns PGHOST with the port from portEnv, or skips the test
+// if either isn't set
+func postgresAddr(t *testing.T, portEnv string) string {
+	host, port := os.Getenv("PGHOST"), os.Getenv(portEnv)
+	if host == "" || port == "" {
+		t.Skipf("PGHOST and %s are not set, see make integration-test", portEnv)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// connectPostgres logs in to a real server, and returns how it went, and the
+// server's major version if it got that far
+func connectPostgres(t *testing.T, addr string, user string, ssl SSLConfig) (string, int) {
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+	startup := pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": user, "database": "postgres"},
+	}
+	conn, err := ConnectAndStartup(dial, addr, ssl, startup.Encode(nil))
+	if err != nil {
+		return outcomeError, 0
+	}
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	version := 0
+	for ready := false; !ready; {
+		msg, err := frontend.Receive()
+		if err != nil {
+			return outcomeError, 0
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return outcomeRejected, 0
+		case *pgproto3.AuthenticationOk:
+		case *pgproto3.ParameterStatus:
+			if msg.Name == "server_version" {
+				version, _ = strconv.Atoi(strings.SplitN(msg.Value, ".", 2)[0])
+			}
+		case *pgproto3.ReadyForQuery:
+			ready = true
+		case *pgproto3.BackendKeyData:
+		default:
+			t.Fatalf("unexpected %T, the test users need trust auth", msg)
+		}
+	}
+
+	// Ask the server, rather than trusting the client's view
+	if err := frontend.Send(&pgproto3.Query{String: "SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()"}); err != nil {
+		t.Fatal(err)
+	}
+	secure := false
+	for done := false; !done; {
+		msg, err := frontend.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			secure = string(msg.Values[0]) == "t"
+		case *pgproto3.ErrorResponse:
+			t.Fatalf("query failed: %s", msg.Message)
+		case *pgproto3.ReadyForQuery:
+			done = true
+		}
+	}
+	_ = frontend.Send(&pgproto3.Terminate{})
+	if secure {
+		return outcomeSSL, version
+	}
+	return outcomePlain, version
+}
+
+// TestConnectAndStartupPostgres is TestConnectAndStartup against real
+// servers, with ssl=on at PGPORT, and ssl=off at PGPORT_SSL_OFF
+func TestConnectAndStartupPostgres(t *testing.T) {
+	cases := []struct {
+		Mode     SSLMode
+		User     string
+		SSLOff   bool
+		Expected string
+	}{
+		// Case 0-4: disable never asks for SSL
+		{Mode: SSLDisabled, User: userAnySSL, Expected: outcomePlain},
+		{Mode: SSLDisabled, User: userSSLOnly, Expected: outcomeRejected},
+		{Mode: SSLDisabled, User: userNoSSLOnly, Expected: outcomePlain},
+		{Mode: SSLDisabled, User: userAnySSL, SSLOff: true, Expected: outcomePlain},
+		{Mode: SSLDisabled, User: userSSLOnly, SSLOff: true, Expected: outcomeRejected},
+		// Case 5-9: allow falls back to SSL when the server rejects the connection
+		{Mode: SSLAllow, User: userAnySSL, Expected: outcomePlain},
+		{Mode: SSLAllow, User: userSSLOnly, Expected: outcomeSSL},
+		{Mode: SSLAllow, User: userNoSSLOnly, Expected: outcomePlain},
+		{Mode: SSLAllow, User: userAnySSL, SSLOff: true, Expected: outcomePlain},
+		{Mode: SSLAllow, User: userSSLOnly, SSLOff: true, Expected: outcomeError},
+		// Case 10-14: prefer falls back without SSL when the server rejects the connection
+		{Mode: SSLPrefer, User: userAnySSL, Expected: outcomeSSL},
+		{Mode: SSLPrefer, User: userSSLOnly, Expected: outcomeSSL},
+		{Mode: SSLPrefer, User: userNoSSLOnly, Expected: outcomePlain},
+		{Mode: SSLPrefer, User: userAnySSL, SSLOff: true, Expected: outcomePlain},
+		{Mode: SSLPrefer, User: userSSLOnly, SSLOff: true, Expected: outcomeRejected},
+		// Case 15-19: require never falls back
+		{Mode: SSLRequired, User: userAnySSL, Expected: outcomeSSL},
+		{Mode: SSLRequired, User: userSSLOnly, Expected: outcomeSSL},
+		{Mode: SSLRequired, User: userNoSSLOnly, Expected: outcomeRejected},
+		{Mode: SSLRequired, User: userAnySSL, SSLOff: true, Expected: outcomeError},
+		{Mode: SSLRequired, User: userSSLOnly, SSLOff: true, Expected: outcomeError},
+	}
+
+	addr := postgresAddr(t, "PGPORT")
+	sslOffAddr := ""
+	if port := os.Getenv("PGPORT_SSL_OFF"); port != "" {
+		sslOffAddr = net.JoinHostPort(os.Getenv("PGHOST"), port)
+	}
+	for idx, test := range cases {
+		addr := addr
+		if test.SSLOff {
+			if sslOffAddr == "" {
+				t.Logf("[Case %d] skipped, PGPORT_SSL_OFF is not set", idx)
+				continue
+			}
+			addr = sslOffAddr
+		}
+		outcome, _ := connectPostgres(t, addr, test.User, SSLConfig{Mode: test.Mode})
+		if outcome != test.Expected {
+			t.Errorf("[Case %d] sslmode=%s user=%s on %s: expected %s, got %s", idx, test.Mode, test.User, addr, test.Expected, outcome)
+		}
+	}
+}
+
+// TestDirectSSLPostgres checks sslnegotiation=direct, which needs Postgres 17
+func TestDirectSSLPostgres(t *testing.T) {
+	addr := postgresAddr(t, "PGPORT")
+	outcome, version := connectPostgres(t, addr, userAnySSL, SSLConfig{Mode: SSLRequired})
+	if outcome != outcomeSSL {
+		t.Fatalf("expected %s, got %s", outcomeSSL, outcome)
+	}
+
+	expected := outcomeSSL
+	if version < 17 {
+		expected = outcomeError
+	}
+	outcome, _ = connectPostgres(t, addr, userAnySSL, SSLConfig{Mode: SSLRequired, Negotiation: SSLNegotiationDirect})
+	if outcome != expected {
+		t.Errorf("Postgres %d with direct negotiation: expected %s, got %s", version, expected, outcome)
+	}
+}
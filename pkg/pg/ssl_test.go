@@ -0,0 +1,289 @@
+package pg_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	pgproto3 "github.com/jackc/pgproto3/v2"
+	. "github.com/mothership/rds-auth-proxy/pkg/pg"
+)
+
+// fakeServer acts like a postgres server, enough to test SSL negotiation
+type fakeServer struct {
+	// SSL is ssl=on in postgresql.conf
+	SSL bool
+	// Direct accepts direct SSL connections, like Postgres 17
+	Direct bool
+	// HBA is the pg_hba.conf connection type, host, hostssl or hostnossl
+	HBA string
+}
+
+// peekedConn reads from a buffer that has already been peeked into
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// serve accepts connections until the listener is closed, and sends
+// whether each accepted startup message came over SSL
+func (f fakeServer) serve(t *testing.T, listener net.Listener, certificate tls.Certificate, accepted chan<- bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: []string{"postgresql"}}
+			reader := bufio.NewReader(conn)
+			first, err := reader.Peek(1)
+			if err != nil {
+				return
+			}
+			var client net.Conn = &peekedConn{Conn: conn, reader: reader}
+			secure := false
+			// A TLS handshake record instead of a length
+			if first[0] == 0x16 {
+				if !f.Direct {
+					return
+				}
+				client, secure = tls.Server(client, tlsConfig), true
+			}
+
+			for {
+				backend := pgproto3.NewBackend(pgproto3.NewChunkReader(client), client)
+				msg, err := backend.ReceiveStartupMessage()
+				if err != nil {
+					return
+				}
+				if _, ok := msg.(*pgproto3.SSLRequest); ok {
+					if !f.SSL {
+						_, _ = client.Write([]byte{'N'})
+						continue
+					}
+					_, _ = client.Write([]byte{'S'})
+					client, secure = tls.Server(client, tlsConfig), true
+					continue
+				}
+				if (f.HBA == "hostssl" && !secure) || (f.HBA == "hostnossl" && secure) {
+					_ = backend.Send(&pgproto3.ErrorResponse{
+						Severity: "FATAL",
+						Code:     "28000",
+						Message:  fmt.Sprintf("no pg_hba.conf entry for host \"127.0.0.1\", SSL %v", secure),
+					})
+					return
+				}
+				accepted <- secure
+				_ = backend.Send(&pgproto3.AuthenticationOk{})
+				return
+			}
+		}()
+	}
+}
+
+const (
+	outcomeSSL      = "ssl"
+	outcomePlain    = "plain"
+	outcomeRejected = "rejected"
+	outcomeError    = "error"
+)
+
+// connect runs a startup against the fake server, and returns how it went
+func connect(t *testing.T, server fakeServer, certificate tls.Certificate, ssl SSLConfig) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan bool, 1)
+	go server.serve(t, listener, certificate, accepted)
+
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	}
+	startup := pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	}
+	conn, err := ConnectAndStartup(dial, listener.Addr().String(), ssl, startup.Encode(nil))
+	if err != nil {
+		return outcomeError
+	}
+	defer conn.Close()
+
+	msg, err := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn).Receive()
+	if err != nil {
+		return outcomeError
+	}
+	if _, ok := msg.(*pgproto3.ErrorResponse); ok {
+		return outcomeRejected
+	}
+	if <-accepted {
+		return outcomeSSL
+	}
+	return outcomePlain
+}
+
+func TestConnectAndStartup(t *testing.T) {
+	sslOn := fakeServer{SSL: true, HBA: "host"}
+	sslOnly := fakeServer{SSL: true, HBA: "hostssl"}
+	plainOnly := fakeServer{SSL: true, HBA: "hostnossl"}
+	sslOff := fakeServer{SSL: false, HBA: "host"}
+	sslOffSSLOnly := fakeServer{SSL: false, HBA: "hostssl"}
+	direct := fakeServer{SSL: true, Direct: true, HBA: "host"}
+	serverCert := newKeyPair(t)
+	otherCert := newKeyPair(t)
+	serverRoot, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	otherRoot, _ := x509.ParseCertificate(otherCert.Certificate[0])
+
+	cases := []struct {
+		Mode        SSLMode
+		Negotiation SSLNegotiation
+		Roots       []*x509.Certificate
+		Server      fakeServer
+		Expected    string
+	}{
+		// Case 0-4: disable never asks for SSL
+		{Mode: SSLDisabled, Server: sslOn, Expected: outcomePlain},
+		{Mode: SSLDisabled, Server: sslOnly, Expected: outcomeRejected},
+		{Mode: SSLDisabled, Server: plainOnly, Expected: outcomePlain},
+		{Mode: SSLDisabled, Server: sslOff, Expected: outcomePlain},
+		{Mode: SSLDisabled, Server: sslOffSSLOnly, Expected: outcomeRejected},
+		// Case 5-9: allow falls back to SSL when the server rejects the connection
+		{Mode: SSLAllow, Server: sslOn, Expected: outcomePlain},
+		{Mode: SSLAllow, Server: sslOnly, Expected: outcomeSSL},
+		{Mode: SSLAllow, Server: plainOnly, Expected: outcomePlain},
+		{Mode: SSLAllow, Server: sslOff, Expected: outcomePlain},
+		{Mode: SSLAllow, Server: sslOffSSLOnly, Expected: outcomeError},
+		// Case 10-14: prefer falls back without SSL when the server rejects the connection
+		{Mode: SSLPrefer, Server: sslOn, Expected: outcomeSSL},
+		{Mode: SSLPrefer, Server: sslOnly, Expected: outcomeSSL},
+		{Mode: SSLPrefer, Server: plainOnly, Expected: outcomePlain},
+		{Mode: SSLPrefer, Server: sslOff, Expected: outcomePlain},
+		{Mode: SSLPrefer, Server: sslOffSSLOnly, Expected: outcomeRejected},
+		// Case 15-19: require never falls back
+		{Mode: SSLRequired, Server: sslOn, Expected: outcomeSSL},
+		{Mode: SSLRequired, Server: sslOnly, Expected: outcomeSSL},
+		{Mode: SSLRequired, Server: plainOnly, Expected: outcomeRejected},
+		{Mode: SSLRequired, Server: sslOff, Expected: outcomeError},
+		{Mode: SSLRequired, Server: sslOffSSLOnly, Expected: outcomeError},
+		// Case 20-21: direct SSL needs a server that supports it
+		{Mode: SSLRequired, Negotiation: SSLNegotiationDirect, Server: direct, Expected: outcomeSSL},
+		{Mode: SSLRequired, Negotiation: SSLNegotiationDirect, Server: sslOn, Expected: outcomeError},
+		// Case 22: verify-ca doesn't trust a self-signed certificate
+		{Mode: SSLVerifyCA, Server: sslOn, Expected: outcomeError},
+		// Case 23: verify-ca trusts any of the root certificates
+		{Mode: SSLVerifyCA, Roots: []*x509.Certificate{otherRoot, serverRoot}, Server: sslOn, Expected: outcomeSSL},
+		// Case 24: verify-ca with only other root certificates
+		{Mode: SSLVerifyCA, Roots: []*x509.Certificate{otherRoot}, Server: sslOn, Expected: outcomeError},
+	}
+
+	for idx, test := range cases {
+		outcome := connect(t, test.Server, serverCert, SSLConfig{Mode: test.Mode, Negotiation: test.Negotiation, RootCertificates: test.Roots})
+		if outcome != test.Expected {
+			t.Errorf("[Case %d] sslmode=%s with %+v: expected %s, got %s", idx, test.Mode, test.Server, test.Expected, outcome)
+		}
+	}
+}
+
+func TestUpgradeClientALPN(t *testing.T) {
+	serverCert := newKeyPair(t)
+	cases := []struct {
+		Negotiation SSLNegotiation
+		Expected    []string
+	}{
+		// Case 0: no ALPN after an SSLRequest, like libpq
+		{Negotiation: SSLNegotiationPostgres, Expected: nil},
+		// Case 1: direct SSL asks for postgresql
+		{Negotiation: SSLNegotiationDirect, Expected: []string{"postgresql"}},
+	}
+
+	for idx, test := range cases {
+		client, server := net.Pipe()
+		offered := make(chan []string, 1)
+		go func() {
+			defer server.Close()
+			tlsServer := tls.Server(server, &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				NextProtos:   []string{"postgresql"},
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					offered <- hello.SupportedProtos
+					return nil, nil
+				},
+			})
+			_ = tlsServer.Handshake()
+		}()
+		conn, err := UpgradeClient("localhost:5432", client, SSLConfig{Mode: SSLRequired, Negotiation: test.Negotiation})
+		if err != nil {
+			t.Fatalf("[Case %d] unexpected error %+v", idx, err)
+		}
+		conn.Close()
+		if protos := <-offered; !reflect.DeepEqual(protos, test.Expected) {
+			t.Errorf("[Case %d] expected ALPN %v, got %v", idx, test.Expected, protos)
+		}
+	}
+}
+
+func TestParseSSLMode(t *testing.T) {
+	cases := []struct {
+		Mode     string
+		Expected SSLMode
+		Error    error
+	}{
+		{Mode: "verify-full", Expected: SSLVerifyFull},
+		{Mode: "prefer", Expected: SSLPrefer},
+		// Earlier spelling of prefer
+		{Mode: "preferred", Expected: SSLPrefer},
+		{Mode: "required", Error: fmt.Errorf("invalid sslmode \"required\"")},
+	}
+	for idx, test := range cases {
+		mode, err := ParseSSLMode(test.Mode)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if mode != test.Expected {
+			t.Errorf("[Case %d] expected %q, got %q", idx, test.Expected, mode)
+		}
+	}
+}
+
+func TestAwaitStartupRejected(t *testing.T) {
+	cases := []struct {
+		Reply    pgproto3.BackendMessage
+		Expected string
+	}{
+		// Case 0: the reply is left for the caller to read
+		{Reply: &pgproto3.AuthenticationOk{}},
+		// Case 1: the server's error is kept, with its code
+		{Reply: &pgproto3.ErrorResponse{Severity: "FATAL", Code: CodeConnectFailed, Message: "connection refused"}, Expected: CodeConnectFailed},
+	}
+	for idx, test := range cases {
+		client, server := net.Pipe()
+		go func() {
+			_ = pgproto3.NewBackend(pgproto3.NewChunkReader(server), server).Send(test.Reply)
+		}()
+		conn, err := AwaitStartup(client)
+		if test.Expected == "" {
+			if err != nil {
+				t.Fatalf("[Case %d] unexpected error %+v", idx, err)
+			}
+			msg, err := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn).Receive()
+			if _, ok := msg.(*pgproto3.AuthenticationOk); !ok || err != nil {
+				t.Errorf("[Case %d] expected AuthenticationOk, got %T %+v", idx, msg, err)
+			}
+		} else if rejected, ok := err.(*RejectedError); !ok || rejected.ErrMsg.Code != test.Expected {
+			t.Errorf("[Case %d] expected a rejection with code %s, got %+v", idx, test.Expected, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,180 @@
+package pgservice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Section is a named service, and its connection parameters
+type Section struct {
+	Name   string
+	Params map[string]string
+}
+
+// section is a service as read from disk, keeping its raw lines so
+// comments and formatting survive a merge
+type section struct {
+	name  string
+	lines []string
+}
+
+// File is a pg_service.conf file
+type File struct {
+	// preamble holds the lines before the first section
+	preamble []string
+	sections []*section
+}
+
+// Parse reads a pg_service.conf file
+func Parse(r io.Reader) (*File, error) {
+	f := &File{}
+	var current *section
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			if !strings.HasSuffix(trimmed, "]") {
+				return nil, fmt.Errorf("bad section header %q", trimmed)
+			}
+			current = &section{name: strings.TrimSpace(trimmed[1 : len(trimmed)-1])}
+			f.sections = append(f.sections, current)
+			continue
+		}
+		if current == nil {
+			f.preamble = append(f.preamble, line)
+		} else {
+			current.lines = append(current.lines, line)
+		}
+	}
+	return f, scanner.Err()
+}
+
+// Set adds the section, or merges its parameters into an existing section
+// with the same name. Other parameters in that section, and other sections,
+// are left alone.
+func (f *File) Set(s Section) {
+	keys := make([]string, 0, len(s.Params))
+	for key := range s.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, existing := range f.sections {
+		if existing.name == s.Name {
+			existing.merge(s.Params, keys)
+			return
+		}
+	}
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%s", key, s.Params[key]))
+	}
+	// Keep a blank line between the new section and whatever came before it
+	if last := f.lastLines(); len(last) > 0 && strings.TrimSpace(last[len(last)-1]) != "" {
+		f.appendLine("")
+	}
+	f.sections = append(f.sections, &section{name: s.Name, lines: lines})
+}
+
+// merge replaces the lines setting any of params in place, and adds the
+// ones that aren't set yet after the section's last parameter. keys are the
+// params' keys, in the order to add them.
+func (s *section) merge(params map[string]string, keys []string) {
+	trailing := trailingBlankLines(s.lines)
+	body := s.lines[:len(s.lines)-len(trailing)]
+
+	merged := make([]string, 0, len(s.lines)+len(keys))
+	set := map[string]bool{}
+	for _, line := range body {
+		key, ok := paramKey(line)
+		if _, managed := params[key]; !ok || !managed {
+			merged = append(merged, line)
+			continue
+		}
+		// Drop repeats, the first one wins
+		if !set[key] {
+			merged = append(merged, fmt.Sprintf("%s=%s", key, params[key]))
+			set[key] = true
+		}
+	}
+	for _, key := range keys {
+		if !set[key] {
+			merged = append(merged, fmt.Sprintf("%s=%s", key, params[key]))
+		}
+	}
+	s.lines = append(merged, trailing...)
+}
+
+// paramKey returns the key a "key=value" line sets
+func paramKey(line string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return "", false
+	}
+	idx := strings.Index(trimmed, "=")
+	if idx < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(trimmed[:idx]), true
+}
+
+// WriteTo writes the file out
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	write := func(line string) error {
+		n, err := io.WriteString(w, line+"\n")
+		total += int64(n)
+		return err
+	}
+	for _, line := range f.preamble {
+		if err := write(line); err != nil {
+			return total, err
+		}
+	}
+	for _, s := range f.sections {
+		if err := write(fmt.Sprintf("[%s]", s.name)); err != nil {
+			return total, err
+		}
+		for _, line := range s.lines {
+			if err := write(line); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (f *File) lastLines() []string {
+	if len(f.sections) == 0 {
+		return f.preamble
+	}
+	return f.sections[len(f.sections)-1].lines
+}
+
+func (f *File) appendLine(line string) {
+	if len(f.sections) == 0 {
+		f.preamble = append(f.preamble, line)
+		return
+	}
+	last := f.sections[len(f.sections)-1]
+	last.lines = append(last.lines, line)
+}
+
+// trailingBlankLines returns the blank lines (and comments) at the end of a
+// section, which usually belong to the next one
+func trailingBlankLines(lines []string) []string {
+	idx := len(lines)
+	for idx > 0 {
+		trimmed := strings.TrimSpace(lines[idx-1])
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		idx--
+	}
+	return lines[idx:]
+}
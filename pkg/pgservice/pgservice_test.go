@@ -0,0 +1,77 @@
+package pgservice_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/pgservice"
+)
+
+func TestSet(t *testing.T) {
+	cases := []struct {
+		Existing string
+		Sections []Section
+		Expected string
+	}{
+		// Case 0: empty file
+		{
+			Existing: "",
+			Sections: []Section{{Name: "orders-prod", Params: map[string]string{"host": "127.0.0.1", "port": "8001"}}},
+			Expected: "[orders-prod]\nhost=127.0.0.1\nport=8001\n",
+		},
+		// Case 1: unrelated sections and comments are kept
+		{
+			Existing: "# my services\n[local]\nhost=localhost # dev box\ndbname=app\n",
+			Sections: []Section{{Name: "orders-prod", Params: map[string]string{"host": "127.0.0.1", "port": "8001"}}},
+			Expected: "# my services\n[local]\nhost=localhost # dev box\ndbname=app\n\n[orders-prod]\nhost=127.0.0.1\nport=8001\n",
+		},
+		// Case 2: existing section is updated in place
+		{
+			Existing: "[orders-prod]\nhost=old\nport=1\n\n# dev\n[local]\nhost=localhost\n",
+			Sections: []Section{{Name: "orders-prod", Params: map[string]string{"host": "127.0.0.1", "port": "8001", "dbname": "orders"}}},
+			Expected: "[orders-prod]\nhost=127.0.0.1\nport=8001\ndbname=orders\n\n# dev\n[local]\nhost=localhost\n",
+		},
+		// Case 3: keys added by hand are kept, and missing managed keys are
+		// added after the last one
+		{
+			Existing: "[orders-prod]\n# read-only\nhost=old\napplication_name=psql\nhost=older\n\n[local]\nhost=localhost\n",
+			Sections: []Section{{Name: "orders-prod", Params: map[string]string{"host": "127.0.0.1", "port": "8001"}}},
+			Expected: "[orders-prod]\n# read-only\nhost=127.0.0.1\napplication_name=psql\nport=8001\n\n[local]\nhost=localhost\n",
+		},
+		// Case 4: several sections
+		{
+			Existing: "[local]\nhost=localhost\n",
+			Sections: []Section{
+				{Name: "a", Params: map[string]string{"port": "1"}},
+				{Name: "b", Params: map[string]string{"port": "2"}},
+			},
+			Expected: "[local]\nhost=localhost\n\n[a]\nport=1\n\n[b]\nport=2\n",
+		},
+	}
+
+	for idx, test := range cases {
+		f, err := Parse(strings.NewReader(test.Existing))
+		if err != nil {
+			t.Errorf("[Case %d]: unexpected error: %+v", idx, err)
+			continue
+		}
+		for _, s := range test.Sections {
+			f.Set(s)
+		}
+		var out bytes.Buffer
+		if _, err := f.WriteTo(&out); err != nil {
+			t.Errorf("[Case %d]: unexpected error: %+v", idx, err)
+		}
+		if out.String() != test.Expected {
+			t.Errorf("[Case %d]: expected %q, got %q", idx, test.Expected, out.String())
+		}
+	}
+}
+
+func TestParseBadHeader(t *testing.T) {
+	_, err := Parse(strings.NewReader("[orders-prod\nhost=x\n"))
+	if err == nil || !strings.Contains(err.Error(), "bad section header") {
+		t.Errorf("expected bad section header error, got %+v", err)
+	}
+}
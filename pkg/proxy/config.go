@@ -2,27 +2,61 @@ package proxy
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"net"
+	"strings"
 
 	pgproto3 "github.com/jackc/pgproto3/v2"
 	"github.com/mothership/rds-auth-proxy/pkg/cert"
+	"github.com/mothership/rds-auth-proxy/pkg/netutil"
 	"github.com/mothership/rds-auth-proxy/pkg/pg"
+	"github.com/mothership/rds-auth-proxy/pkg/proxyproto"
 )
 
 // Credentials represents connection details to an upstream database or proxy
 type Credentials struct {
-	Host     string
+	Host string
+	// Optional hosts to pick from instead of Host, tried in order until one
+	// accepts the connection
+	HostPool HostPool
 	Database string
 	Username string
 	Password string
 	// Misc connection parameters to be passed along
 	Options map[string]string
 	// SSL Settings for the outbound connection
-	SSLMode           pg.SSLMode
-	ClientCertificate *tls.Certificate
-	RootCertificate   *x509.Certificate
+	SSL pg.SSLConfig
+	// Address of the connecting client, from the PROXY protocol header when
+	// the connection came through a trusted load balancer
+	ClientAddr net.Addr
+	// Optional PROXY protocol header version to send to the upstream
+	SendProxyHeader proxyproto.Version
+	// Verified identity of the connecting client, only set when the
+	// client presented a certificate signed by one of the ClientCAs
+	ClientIdentity *ClientIdentity
+	// Optional, called when the upstream couldn't be reached, to point the
+	// credentials at another host (ex: the next replica, with an IAM token
+	// signed for it). Returns false when there's nothing left to try.
+	Retry func(err error) bool
+	// passwordPrompt asks the connecting client for its password
+	passwordPrompt func() (string, error)
+}
+
+// PromptPassword asks the connecting client for its password. Only
+// available on connections using SSL.
+func (c *Credentials) PromptPassword() (string, error) {
+	if c.passwordPrompt == nil {
+		return "", fmt.Errorf("password prompt not available on this connection")
+	}
+	return c.passwordPrompt()
+}
+
+// HostPool is a set of interchangeable upstream hosts
+type HostPool interface {
+	// Hosts returns the hosts in the order they should be tried
+	Hosts() []string
+	// Report records the result of connecting to a host
+	Report(host string, err error)
 }
 
 // CredentialInterceptor provides a way to update credentials being forwarded
@@ -41,12 +75,17 @@ const (
 
 // Config contains the various options for setting up the proxy
 type Config struct {
-	ServerCertificate        *tls.Certificate
-	DefaultClientCertificate *tls.Certificate
-	ListenAddress            *net.TCPAddr
-	CredentialInterceptor    CredentialInterceptor
-	QueryInterceptor         QueryInterceptor
-	Mode                     Mode
+	// Certificates loaded from disk are swapped out when the files change
+	ServerCertificate        *cert.KeyPair
+	DefaultClientCertificate *cert.KeyPair
+	// ClientCAs, if set, requires clients to present a certificate signed by one of these CAs
+	ClientCAs     *cert.Bundle
+	ListenAddress net.Addr
+	// TrustedProxies, if set, must send a PROXY protocol header with the real client address
+	TrustedProxies        []*net.IPNet
+	CredentialInterceptor CredentialInterceptor
+	QueryInterceptor      QueryInterceptor
+	Mode                  Mode
 }
 
 // QueryInterceptor provides a way to define custom behavior for handling messages
@@ -69,9 +108,19 @@ func WithMode(mode Mode) Option {
 	}
 }
 
-// WithListenAddress sets the IP/port that the proxy will accept connections on
+// WithListenAddress sets the IP/port that the proxy will accept connections on,
+// or a unix socket path prefixed with "unix:"
 func WithListenAddress(addr string) Option {
 	return func(c *Config) error {
+		if strings.HasPrefix(addr, pg.UnixSocketPrefix) {
+			socketPath := strings.TrimPrefix(addr, pg.UnixSocketPrefix)
+			if _, _, err := pg.SplitSocketPath(socketPath); err != nil {
+				return err
+			}
+			c.ListenAddress = &net.UnixAddr{Name: socketPath, Net: "unix"}
+			return nil
+		}
+
 		listenAddr, err := net.ResolveTCPAddr("tcp", addr)
 		if err != nil {
 			return err
@@ -82,6 +131,15 @@ func WithListenAddress(addr string) Option {
 	}
 }
 
+// WithProxyProtocol reads the PROXY protocol header from connections from
+// the trusted CIDRs, such as a load balancer's subnet
+func WithProxyProtocol(trustedCIDRs []string) Option {
+	return func(c *Config) (err error) {
+		c.TrustedProxies, err = netutil.ParseCIDRs(trustedCIDRs)
+		return err
+	}
+}
+
 // WithCredentialInterceptor sets the credential retrieval strategy
 func WithCredentialInterceptor(credFactory CredentialInterceptor) Option {
 	return func(c *Config) error {
@@ -99,12 +157,8 @@ func WithServerCertificate(certPath, keyPath string) Option {
 		if keyPath == "" {
 			return fmt.Errorf("private key path not set")
 		}
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-		if err != nil {
-			return err
-		}
-		c.ServerCertificate = &cert
-		return nil
+		c.ServerCertificate, err = cert.DefaultStore.KeyPair(certPath, keyPath)
+		return err
 	}
 }
 
@@ -115,15 +169,27 @@ func WithGeneratedServerCertificate() Option {
 		if err != nil {
 			return err
 		}
-		cert, err := tls.X509KeyPair(certBytes, keyBytes)
+		certificate, err := tls.X509KeyPair(certBytes, keyBytes)
 		if err != nil {
 			return err
 		}
-		c.ServerCertificate = &cert
+		c.ServerCertificate = cert.NewKeyPair(certificate)
 		return nil
 	}
 }
 
+// WithClientCAs requires connecting clients to present a certificate signed by
+// one of the CAs in the pem-encoded bundle
+func WithClientCAs(bundlePath string) Option {
+	return func(c *Config) (err error) {
+		if bundlePath == "" {
+			return fmt.Errorf("client CA bundle path not set")
+		}
+		c.ClientCAs, err = cert.DefaultStore.Bundle(bundlePath)
+		return err
+	}
+}
+
 // WithClientCertificate sets up the default client certificates
 func WithClientCertificate(certPath, keyPath string) Option {
 	return func(c *Config) (err error) {
@@ -133,12 +199,8 @@ func WithClientCertificate(certPath, keyPath string) Option {
 		if keyPath == "" {
 			return fmt.Errorf("client private key path not set")
 		}
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-		if err != nil {
-			return err
-		}
-		c.DefaultClientCertificate = &cert
-		return nil
+		c.DefaultClientCertificate, err = cert.DefaultStore.KeyPair(certPath, keyPath)
+		return err
 	}
 }
 
@@ -149,11 +211,11 @@ func WithGeneratedClientCertificate() Option {
 		if err != nil {
 			return err
 		}
-		cert, err := tls.X509KeyPair(certBytes, keyBytes)
+		certificate, err := tls.X509KeyPair(certBytes, keyBytes)
 		if err != nil {
 			return err
 		}
-		c.DefaultClientCertificate = &cert
+		c.DefaultClientCertificate = cert.NewKeyPair(certificate)
 		return nil
 	}
 }
@@ -166,6 +228,22 @@ func WithQueryInterceptor(interceptor QueryInterceptor) Option {
 	}
 }
 
+// serverTLSConfig returns the TLS config for inbound connections, or nil if
+// SSL is not enabled on the proxy
+func (c *Config) serverTLSConfig() *tls.Config {
+	if c.ServerCertificate == nil {
+		return nil
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: c.ServerCertificate.GetCertificate,
+	}
+	if c.ClientCAs != nil {
+		tlsConfig.ClientCAs = c.ClientCAs.Pool()
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig
+}
+
 // MergeOptions is a helper to merge an option list
 func MergeOptions(lists ...[]Option) []Option {
 	opts := []Option{}
@@ -20,6 +20,16 @@ func TestConfigOptionErrors(t *testing.T) {
 			Option: WithListenAddress("0.0.0.0:8000"),
 			Error:  nil,
 		},
+		// PROXY protocol from a load balancer subnet
+		{
+			Option: WithProxyProtocol([]string{"10.0.0.0/16", "192.0.2.1"}),
+			Error:  nil,
+		},
+		// PROXY protocol with a hostname
+		{
+			Option: WithProxyProtocol([]string{"lb.internal"}),
+			Error:  fmt.Errorf("invalid IP \"lb.internal\""),
+		},
 		// Missing port
 		{
 			Option: WithListenAddress("bah"),
@@ -39,6 +49,16 @@ func TestConfigOptionErrors(t *testing.T) {
 			//      for now, just assert that we got an error :/
 			Error: fmt.Errorf(""),
 		},
+		// Unix socket
+		{
+			Option: WithListenAddress("unix:/tmp/.s.PGSQL.5432"),
+			Error:  nil,
+		},
+		// Unix socket psql can't find
+		{
+			Option: WithListenAddress("unix:/tmp/proxy.sock"),
+			Error:  fmt.Errorf("must be named .s.PGSQL.<port>"),
+		},
 		// valid credential getter
 		{
 			Option: WithCredentialInterceptor(func(creds *Credentials) error {
@@ -56,6 +76,16 @@ func TestConfigOptionErrors(t *testing.T) {
 			Option: WithMode(Mode(10)),
 			Error:  fmt.Errorf("invalid mode"),
 		},
+		// missing client CA path
+		{
+			Option: WithClientCAs(""),
+			Error:  fmt.Errorf("client CA bundle path not set"),
+		},
+		// client CA bundle doesn't exist
+		{
+			Option: WithClientCAs("/does/not/exist.pem"),
+			Error:  fmt.Errorf("no such file or directory"),
+		},
 	}
 
 	for idx, test := range cases {
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"crypto/x509"
+)
+
+// ClientIdentity is the identity of a client, taken from the certificate
+// it presented to the proxy
+type ClientIdentity struct {
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+}
+
+// NewClientIdentity extracts the subject and SANs from a verified client certificate
+func NewClientIdentity(cert *x509.Certificate) *ClientIdentity {
+	identity := &ClientIdentity{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		URIs:           make([]string, 0, len(cert.URIs)),
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+	return identity
+}
+
+// Names returns every name the client is known by, the common name first,
+// followed by DNS, email and URI SANs. Safe to call on a nil identity.
+func (i *ClientIdentity) Names() []string {
+	if i == nil {
+		return nil
+	}
+	names := make([]string, 0, 1+len(i.DNSNames)+len(i.EmailAddresses)+len(i.URIs))
+	if i.CommonName != "" {
+		names = append(names, i.CommonName)
+	}
+	names = append(names, i.DNSNames...)
+	names = append(names, i.EmailAddresses...)
+	names = append(names, i.URIs...)
+	return names
+}
@@ -0,0 +1,56 @@
+package proxy_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"reflect"
+	"testing"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/proxy"
+)
+
+func TestClientIdentityNames(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/ci")
+	cases := []struct {
+		Identity *ClientIdentity
+		Expected []string
+	}{
+		// Case 0: nil identity has no names
+		{
+			Identity: nil,
+			Expected: nil,
+		},
+		// Case 1: common name only
+		{
+			Identity: NewClientIdentity(&x509.Certificate{
+				Subject: pkix.Name{CommonName: "jane"},
+			}),
+			Expected: []string{"jane"},
+		},
+		// Case 2: common name first, then SANs
+		{
+			Identity: NewClientIdentity(&x509.Certificate{
+				Subject:        pkix.Name{CommonName: "jane"},
+				DNSNames:       []string{"laptop.example.com"},
+				EmailAddresses: []string{"jane@example.com"},
+				URIs:           []*url.URL{spiffe},
+			}),
+			Expected: []string{"jane", "laptop.example.com", "jane@example.com", "spiffe://example.com/ci"},
+		},
+		// Case 3: SANs without a common name
+		{
+			Identity: NewClientIdentity(&x509.Certificate{
+				EmailAddresses: []string{"jane@example.com"},
+			}),
+			Expected: []string{"jane@example.com"},
+		},
+	}
+
+	for idx, test := range cases {
+		names := test.Identity.Names()
+		if !reflect.DeepEqual(names, test.Expected) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, names)
+		}
+	}
+}
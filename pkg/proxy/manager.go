@@ -7,6 +7,8 @@ import (
 	"sync"
 
 	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"github.com/mothership/rds-auth-proxy/pkg/netutil"
+	"github.com/mothership/rds-auth-proxy/pkg/proxyproto"
 	"go.uber.org/zap"
 )
 
@@ -14,6 +16,9 @@ import (
 type errorWrapper struct {
 	ConnectionID uint64
 	Error        error
+	// Quiet connections closed before they started (ex: health checks), and
+	// only log at debug level
+	Quiet bool
 }
 
 // Manager watches a group of proxies
@@ -21,6 +26,7 @@ type Manager struct {
 	ActiveSessions sync.Map
 	errorCh        chan errorWrapper
 	cfg            *Config
+	listener       net.Listener
 }
 
 // NewManager returns an instance of Manager
@@ -40,24 +46,45 @@ func NewManager(opts ...Option) (*Manager, error) {
 	}, nil
 }
 
-// Start starts the proxy server
+// Listen binds the listen address and returns the address in use, which is
+// how to find the port when listening on port 0. Start calls this if it
+// hasn't been called already.
+func (m *Manager) Listen() (net.Addr, error) {
+	if m.listener != nil {
+		return m.listener.Addr(), nil
+	}
+	listener, err := listen(m.cfg.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.cfg.TrustedProxies) > 0 {
+		listener = proxyproto.NewListener(listener, m.cfg.TrustedProxies)
+	}
+	m.listener = listener
+	return listener.Addr(), nil
+}
+
+// Start starts the proxy server, and stops accepting connections once the
+// context is canceled
 func (m *Manager) Start(ctx context.Context) error {
 	go m.errorHandler(ctx)
-	listener, err := net.ListenTCP("tcp", m.cfg.ListenAddress)
-	if err != nil {
+	if _, err := m.Listen(); err != nil {
 		return err
 	}
+	go func() {
+		<-ctx.Done()
+		m.listener.Close()
+	}()
 
 	for {
-		conn, err := listener.AcceptTCP()
+		conn, err := m.listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			log.Error("error accepting connection from client", zap.Error(err))
 			continue
 		}
-		log.Info(
-			"accepted connection from client",
-			zap.String("client_address", conn.RemoteAddr().String()),
-		)
 		p := newProxy(conn, m.errorCh, m.cfg)
 		m.ActiveSessions.Store(p.ID, p)
 		//nolint:errcheck // Errors are handled in m.errorCh
@@ -65,6 +92,16 @@ func (m *Manager) Start(ctx context.Context) error {
 	}
 }
 
+// listen listens on a TCP address, or a unix socket only reachable by the
+// current user. A socket file left behind by an earlier run is replaced.
+func listen(addr net.Addr) (net.Listener, error) {
+	unixAddr, ok := addr.(*net.UnixAddr)
+	if !ok {
+		return net.Listen("tcp", addr.String())
+	}
+	return netutil.ListenUnix(unixAddr.Name)
+}
+
 func (m *Manager) errorHandler(ctx context.Context) {
 	log.Info("starting error handler")
 	defer log.Debug("shut down error handler")
@@ -79,11 +116,15 @@ func (m *Manager) errorHandler(ctx context.Context) {
 					zap.Error(err.Error),
 				)
 			}
+			logStop := log.Info
+			if err.Quiet {
+				logStop = log.Debug
+			}
 			if p, loaded := m.ActiveSessions.LoadAndDelete(err.ConnectionID); loaded {
 				proxy, _ := p.(*Proxy)
-				log.Info("stopping proxy", zap.Uint64("connectionID", err.ConnectionID))
+				logStop("stopping proxy", zap.Uint64("connectionID", err.ConnectionID))
 				proxy.Stop()
-				log.Info("proxy stopped", zap.Uint64("connectionID", err.ConnectionID))
+				logStop("proxy stopped", zap.Uint64("connectionID", err.ConnectionID))
 			}
 		}
 	}
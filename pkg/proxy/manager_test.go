@@ -0,0 +1,140 @@
+//go:build !windows
+// +build !windows
+
+package proxy_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/proxy"
+)
+
+func TestManagerListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, ".s.PGSQL.5432")
+
+	// A socket left behind by an earlier run is replaced
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	manager, err := NewManager(WithListenAddress("unix:" + socketPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := manager.Listen()
+	if err != nil {
+		t.Fatalf("unexpected error listening: %+v", err)
+	}
+	if addr.Network() != "unix" || addr.String() != socketPath {
+		t.Errorf("expected unix socket %s, got %s %s", socketPath, addr.Network(), addr)
+	}
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected socket to be owner only, got %s", info.Mode().Perm())
+	}
+
+	// A second proxy can't take over a socket in use
+	other, _ := NewManager(WithListenAddress("unix:" + socketPath))
+	if _, err := other.Listen(); err == nil {
+		t.Errorf("expected an error listening on a socket in use")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- manager.Start(ctx)
+	}()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error from Start: %+v", err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be removed on shutdown, got %+v", err)
+	}
+}
+
+func TestManagersConnectionIDs(t *testing.T) {
+	const perManager = 10
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	managers := make([]*Manager, 2)
+	addrs := make([]net.Addr, len(managers))
+	for idx := range managers {
+		manager, err := NewManager(WithListenAddress("127.0.0.1:0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[idx], err = manager.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		managers[idx] = manager
+		go func() {
+			_ = manager.Start(ctx)
+		}()
+	}
+
+	// Connect to both at once, the connections stay open waiting on a
+	// startup message
+	var lock sync.Mutex
+	var conns []net.Conn
+	var wg sync.WaitGroup
+	for idx := 0; idx < perManager; idx++ {
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func(addr net.Addr) {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", addr.String())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				lock.Lock()
+				conns = append(conns, conn)
+				lock.Unlock()
+			}(addr)
+		}
+	}
+	wg.Wait()
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	ids := map[interface{}]bool{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ids) < perManager*len(managers) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		ids = map[interface{}]bool{}
+		for _, manager := range managers {
+			manager.ActiveSessions.Range(func(id, _ interface{}) bool {
+				ids[id] = true
+				return true
+			})
+		}
+	}
+	if len(ids) != perManager*len(managers) {
+		t.Errorf("expected %d unique connection IDs, got %d", perManager*len(managers), len(ids))
+	}
+}
@@ -2,14 +2,17 @@ package proxy
 
 import (
 	"errors"
+	"io"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pgproto3 "github.com/jackc/pgproto3/v2"
 	"github.com/mothership/rds-auth-proxy/pkg/log"
 	"github.com/mothership/rds-auth-proxy/pkg/pg"
+	"github.com/mothership/rds-auth-proxy/pkg/proxyproto"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +22,7 @@ var connectionID = uint64(0)
 type Proxy struct {
 	ID           uint64
 	logger       *zap.Logger
+	clientConn   net.Conn
 	backend      *pg.PostgresBackend
 	frontend     *pg.PostgresFrontend
 	waiter       sync.WaitGroup
@@ -33,12 +37,14 @@ func newProxy(clientConn net.Conn, errChan chan errorWrapper, config *Config) *P
 	// XXX: can't error if no options are passed
 	backend, _ := pg.NewBackend(clientConn)
 	shutdownChan := make(chan bool, 1)
-	connectionID++
+	// Shared by every manager in the process, each accepting on its own
+	id := atomic.AddUint64(&connectionID, 1)
 	return &Proxy{
-		ID:           connectionID,
+		ID:           id,
 		shutdownChan: shutdownChan,
+		clientConn:   clientConn,
 		backend:      backend,
-		logger:       log.With(zap.Uint64("connectionID", connectionID)),
+		logger:       log.With(zap.Uint64("connectionID", id)),
 		errChan:      errChan,
 		waiter:       sync.WaitGroup{},
 		config:       config,
@@ -47,8 +53,14 @@ func newProxy(clientConn net.Conn, errChan chan errorWrapper, config *Config) *P
 
 func (p *Proxy) notifyError(err error) error {
 	msg := &pgproto3.ErrorResponse{Severity: "FATAL", Message: err.Error()}
-	if authErr, ok := err.(*pg.AuthFailedError); ok {
-		msg = authErr.ErrMsg
+	switch err := err.(type) {
+	case *pg.AuthFailedError:
+		msg = err.ErrMsg
+	case *pg.ConnectFailedError:
+		msg = err.ErrMsg
+	case *pg.RejectedError:
+		// Passed on as is, so the client sees why the server proxy refused
+		msg = err.ErrMsg
 	}
 	_ = p.backend.Send(msg)
 	p.errChan <- errorWrapper{ConnectionID: p.ID, Error: err}
@@ -68,22 +80,53 @@ func (p *Proxy) Stop() {
 // Start boots the proxy
 func (p *Proxy) Start() error {
 	defer p.backend.Close()
-	p.logger.Info("starting connection")
+	// With the PROXY protocol, this waits on the header, so it's read here
+	// rather than holding up the accept loop
+	clientAddr := p.clientConn.RemoteAddr()
 	// First, set up the connection with our client (ex: psql)
 	// and extract the connection parameters from the startup message
-	connectParams, err := p.backend.SetupConnection(p.config.ServerCertificate)
+	connectParams, err := p.backend.SetupConnection(p.config.serverTLSConfig())
+	if err == io.EOF {
+		// Closed before a startup message, like a client proxy's health
+		// check, which postgres doesn't log either
+		p.logger.Debug("client closed the connection before starting up", zap.String("client_address", clientAddr.String()))
+		p.errChan <- errorWrapper{ConnectionID: p.ID, Quiet: true}
+		return nil
+	}
 	if err != nil {
 		return p.notifyError(err)
 	}
+	p.logger.Info("accepted connection from client", zap.String("client_address", clientAddr.String()))
 	// Get credentials
 	creds := p.ParseCredentials(connectParams)
+	creds.passwordPrompt = p.backend.RequestPassword
+	creds.ClientAddr = clientAddr
+	if p.config.ClientCAs != nil {
+		// The TLS handshake verifies the chain, but a client that never
+		// asked for SSL won't have presented a certificate at all
+		peerCerts := p.backend.PeerCertificates()
+		if len(peerCerts) == 0 {
+			return p.notifyError(pg.NewAuthFailedError(errors.New("client certificate required")))
+		}
+		creds.ClientIdentity = NewClientIdentity(peerCerts[0])
+		p.logger.Info("verified client certificate", zap.Strings("client_identity", creds.ClientIdentity.Names()))
+	}
 	if err := p.config.CredentialInterceptor(&creds); err != nil {
 		return p.notifyError(err)
 	}
-	// Next, establish a connection with the upstream database
-	p.logger.Info("connecting to upstream postgres server", zap.String("postgres_server", creds.Host))
-	connection, err := pg.Connect(creds.Host, creds.SSLMode, creds.ClientCertificate, creds.RootCertificate)
+	p.logger.Debug("sending startup message",
+		zap.String("postgres_server", creds.Host),
+		zap.String("user", creds.Username),
+		zap.Any("options", creds.Options),
+	)
+
+	// Next, establish a connection with the upstream database, and send our own
+	// StartupMessage, passing thru any remaining connection parameters.
+	connection, err := p.connectSession(&creds)
 	if err != nil {
+		if _, ok := err.(*pg.RejectedError); !ok {
+			err = pg.NewConnectFailedError(err)
+		}
 		return p.notifyError(err)
 	}
 
@@ -94,22 +137,6 @@ func (p *Proxy) Start() error {
 
 	p.logger.Info("connected to upstream postgres server", zap.String("postgres_server", creds.Host))
 
-	p.logger.Debug("sending startup message",
-		zap.String("postgres_server", creds.Host),
-		zap.String("user", creds.Username),
-		zap.Any("options", creds.Options),
-	)
-
-	// If we're in client proxy mode, forward the password in the StartupMessage
-	if p.config.Mode == ClientSide && creds.Password != "" {
-		creds.Options["password"] = creds.Password
-	}
-	// Now send our own StartupMessage, and pass thru any remaining connection parameters.
-	startupMessage := createStartupMessage(creds.Username, creds.Database, creds.Options)
-	if err = frontend.SendRaw(startupMessage.Encode(nil)); err != nil {
-		return p.notifyError(err)
-	}
-
 	// Even if we're in server mode, don't bother intercepting the startup message response
 	// UNLESS we have the password/auth credentials to handle it. This lets the user use
 	// the proxy normally, for instance, if they are using it without IAM auth
@@ -140,6 +167,75 @@ func (p *Proxy) Start() error {
 	return nil
 }
 
+// connectSession sends the startup message upstream, calling creds.Retry to
+// move on to another host while the upstream can't be reached
+func (p *Proxy) connectSession(creds *Credentials) (net.Conn, error) {
+	for {
+		// If we're in client proxy mode, forward the password in the StartupMessage
+		if p.config.Mode == ClientSide && creds.Password != "" {
+			creds.Options["password"] = creds.Password
+		}
+		startupMessage := createStartupMessage(creds.Username, creds.Database, creds.Options)
+		connection, err := p.connectUpstream(creds, startupMessage.Encode(nil))
+		if creds.Retry == nil {
+			return connection, err
+		}
+		if err == nil && p.config.Mode == ClientSide {
+			// The server proxy only tells us it couldn't reach the host in
+			// its reply, after it's tried to connect and log in itself
+			connection, err = pg.AwaitStartupWithin(connection, 3*pg.ConnectTimeout)
+			if rejected, ok := err.(*pg.RejectedError); ok && rejected.ErrMsg.Code != pg.CodeConnectFailed {
+				return nil, err
+			}
+		}
+		if err == nil || !creds.Retry(err) {
+			return connection, err
+		}
+		p.logger.Warn("upstream host unavailable, retrying on another host", zap.Error(err))
+	}
+}
+
+// connectUpstream connects to the upstream host, or to the first host in the
+// pool that accepts the connection, updating creds.Host to the one used, and
+// sends the startup message
+func (p *Proxy) connectUpstream(creds *Credentials, startup []byte) (net.Conn, error) {
+	if creds.HostPool == nil {
+		p.logger.Info("connecting to upstream postgres server", zap.String("postgres_server", creds.Host))
+		return p.connectHost(creds.Host, creds, startup)
+	}
+
+	lastErr := errors.New("no upstream hosts available")
+	for _, host := range creds.HostPool.Hosts() {
+		p.logger.Info("connecting to upstream postgres server", zap.String("postgres_server", host))
+		connection, err := p.connectHost(host, creds, startup)
+		creds.HostPool.Report(host, err)
+		if err == nil {
+			creds.Host = host
+			return connection, nil
+		}
+		p.logger.Warn("failed to connect to upstream, trying the next host", zap.String("postgres_server", host), zap.Error(err))
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// connectHost connects to a single upstream host, sending a PROXY protocol
+// header first if the upstream is another proxy that wants one
+func (p *Proxy) connectHost(host string, creds *Credentials, startup []byte) (net.Conn, error) {
+	dial := func() (net.Conn, error) {
+		connection, err := net.DialTimeout("tcp", host, pg.ConnectTimeout)
+		if err != nil || creds.SendProxyHeader == "" {
+			return connection, err
+		}
+		if err := proxyproto.WriteHeader(connection, creds.SendProxyHeader, creds.ClientAddr, p.clientConn.LocalAddr()); err != nil {
+			connection.Close()
+			return nil, err
+		}
+		return connection, nil
+	}
+	return pg.ConnectAndStartup(dial, host, creds.SSL, startup)
+}
+
 func (p *Proxy) proxyToServer() {
 	idleTimeout := 5 * time.Minute
 	maxTimeouts := int64(int64(idleTimeout) / int64(p.backend.IdleTimeout))
@@ -263,12 +359,14 @@ func isRetryableError(err error) bool {
 func (p *Proxy) ParseCredentials(connectionParams map[string]string) Credentials {
 	extracted := []string{"host", "password", "user", "database"}
 	creds := Credentials{
-		Host:              connectionParams["host"],
-		Password:          connectionParams["password"],
-		Username:          connectionParams["user"],
-		Database:          connectionParams["database"],
-		SSLMode:           pg.SSLRequired,
-		ClientCertificate: p.config.DefaultClientCertificate,
+		Host:     connectionParams["host"],
+		Password: connectionParams["password"],
+		Username: connectionParams["user"],
+		Database: connectionParams["database"],
+		SSL:      pg.SSLConfig{Mode: pg.SSLRequired},
+	}
+	if p.config.DefaultClientCertificate != nil {
+		creds.SSL.ClientCertificate = p.config.DefaultClientCertificate.Certificate()
 	}
 	for _, key := range extracted {
 		delete(connectionParams, key)
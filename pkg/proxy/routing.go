@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"strings"
+)
+
+const (
+	// targetOption is the setting clients can pass with options=-c target=<name>
+	targetOption = "target"
+	// sessionAttrsOption picks a writer or replica, as target_session_attrs does in libpq
+	sessionAttrsOption = "target_session_attrs"
+	// targetSeparator splits <target>/<database> in the database name
+	targetSeparator = "/"
+	// userTargetSeparator splits <user>@<target> in the user name
+	userTargetSeparator = "@"
+)
+
+// ExtractTargetName finds and removes the target name a client asked for, from
+// a database named <target>/<database>, or a "-c target=<name>" in the options
+// parameter, in that order. Returns an empty string if no target was given.
+func ExtractTargetName(creds *Credentials) string {
+	if idx := strings.Index(creds.Database, targetSeparator); idx >= 0 {
+		target := creds.Database[:idx]
+		creds.Database = creds.Database[idx+len(targetSeparator):]
+		// Strip it from the options too, postgres rejects unknown settings
+		_, _ = extractOption(creds, targetOption)
+		return target
+	}
+	if target, ok := extractOption(creds, targetOption); ok {
+		return target
+	}
+	return ""
+}
+
+// ExtractDirectTargetName is ExtractTargetName, falling back to a user named
+// <user>@<target>. Only for direct clients of the server proxy, user names
+// with an @ in them (ex: jane@example.com) are left alone everywhere else.
+func ExtractDirectTargetName(creds *Credentials) string {
+	if target := ExtractTargetName(creds); target != "" {
+		return target
+	}
+	if idx := strings.LastIndex(creds.Username, userTargetSeparator); idx >= 0 {
+		target := creds.Username[idx+len(userTargetSeparator):]
+		// Postgres defaults the database to the user name, which would still
+		// have the target in it
+		if creds.Database == "" || creds.Database == creds.Username {
+			creds.Database = creds.Username[:idx]
+		}
+		creds.Username = creds.Username[:idx]
+		return target
+	}
+	return ""
+}
+
+// ExtractSessionAttrs finds and removes the target_session_attrs a client asked
+// for as "-c target_session_attrs=<attrs>" in the options parameter. libpq
+// handles a target_session_attrs connection parameter itself, and never sends
+// it. Returns an empty string if it wasn't set.
+func ExtractSessionAttrs(creds *Credentials) string {
+	attrs, _ := extractOption(creds, sessionAttrsOption)
+	return attrs
+}
+
+// extractOption removes "-c <name>=<value>" (or -c<name>=, --<name>=) from the
+// options parameter, returning the value and whether it was found
+func extractOption(creds *Credentials, name string) (string, bool) {
+	options, ok := creds.Options["options"]
+	if !ok {
+		return "", false
+	}
+	tokens := splitOptions(options)
+	remaining := make([]string, 0, len(tokens))
+	value, found := "", false
+	for i := 0; i < len(tokens); i++ {
+		setting := ""
+		switch {
+		case tokens[i] == "-c" && i+1 < len(tokens):
+			setting = tokens[i+1]
+			if !isSetting(setting, name) {
+				remaining = append(remaining, tokens[i], tokens[i+1])
+				i++
+				continue
+			}
+			i++
+		case strings.HasPrefix(tokens[i], "-c"):
+			setting = strings.TrimPrefix(tokens[i], "-c")
+		case strings.HasPrefix(tokens[i], "--"):
+			setting = strings.TrimPrefix(tokens[i], "--")
+		}
+		if !isSetting(setting, name) {
+			remaining = append(remaining, tokens[i])
+			continue
+		}
+		value = unescapeOption(strings.TrimPrefix(setting, name+"="))
+		found = true
+	}
+	if !found {
+		return "", false
+	}
+	if len(remaining) == 0 {
+		delete(creds.Options, "options")
+	} else {
+		creds.Options["options"] = strings.Join(remaining, " ")
+	}
+	return value, true
+}
+
+func isSetting(setting, name string) bool {
+	return strings.HasPrefix(setting, name+"=")
+}
+
+// splitOptions splits the options parameter on whitespace, keeping backslash
+// escaped whitespace as part of the token, the same way postgres does
+func splitOptions(options string) []string {
+	tokens := []string{}
+	var current strings.Builder
+	escaped := false
+	for _, r := range options {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			current.WriteRune(r)
+			escaped = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+func unescapeOption(value string) string {
+	var out strings.Builder
+	escaped := false
+	for _, r := range value {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		out.WriteRune(r)
+		escaped = false
+	}
+	return out.String()
+}
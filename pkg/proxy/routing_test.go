@@ -0,0 +1,254 @@
+package proxy_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/mothership/rds-auth-proxy/pkg/proxy"
+)
+
+func TestExtractTargetName(t *testing.T) {
+	cases := []struct {
+		Creds           Credentials
+		Direct          bool
+		ExpectedTarget  string
+		ExpectedUser    string
+		ExpectedDB      string
+		ExpectedOptions map[string]string
+	}{
+		// Case 0: no target
+		{
+			Creds:           Credentials{Database: "orders", Options: map[string]string{}},
+			ExpectedTarget:  "",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 1: target in the database name
+		{
+			Creds:           Credentials{Database: "orders-prod/orders", Options: map[string]string{}},
+			ExpectedTarget:  "orders-prod",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 2: target with an empty database
+		{
+			Creds:           Credentials{Database: "orders-prod/", Options: map[string]string{}},
+			ExpectedTarget:  "orders-prod",
+			ExpectedDB:      "",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 3: target in options
+		{
+			Creds:           Credentials{Database: "orders", Options: map[string]string{"options": "-c target=orders-prod"}},
+			ExpectedTarget:  "orders-prod",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 4: other options are kept
+		{
+			Creds: Credentials{Database: "orders", Options: map[string]string{
+				"options":          "-c statement_timeout=5s -ctarget=orders-prod --search_path=app",
+				"application_name": "psql",
+			}},
+			ExpectedTarget: "orders-prod",
+			ExpectedDB:     "orders",
+			ExpectedOptions: map[string]string{
+				"options":          "-c statement_timeout=5s --search_path=app",
+				"application_name": "psql",
+			},
+		},
+		// Case 5: long form, with an escaped space
+		{
+			Creds:           Credentials{Database: "orders", Options: map[string]string{"options": `--target=my\ db`}},
+			ExpectedTarget:  "my db",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 6: database wins, but the option is still stripped
+		{
+			Creds:           Credentials{Database: "a/orders", Options: map[string]string{"options": "-c target=b -c work_mem=64MB"}},
+			ExpectedTarget:  "a",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{"options": "-c work_mem=64MB"},
+		},
+		// Case 7: unrelated options only
+		{
+			Creds:           Credentials{Database: "orders", Options: map[string]string{"options": "-c work_mem=64MB"}},
+			ExpectedTarget:  "",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{"options": "-c work_mem=64MB"},
+		},
+		// Case 8: target in the user name
+		{
+			Creds:           Credentials{Username: "app@orders-prod", Database: "orders", Options: map[string]string{}},
+			Direct:          true,
+			ExpectedTarget:  "orders-prod",
+			ExpectedUser:    "app",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 9: target in the user name, database defaulted to the user name
+		{
+			Creds:           Credentials{Username: "jane@example.com@orders-prod", Database: "jane@example.com@orders-prod", Options: map[string]string{}},
+			Direct:          true,
+			ExpectedTarget:  "orders-prod",
+			ExpectedUser:    "jane@example.com",
+			ExpectedDB:      "jane@example.com",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 10: database wins over the user name
+		{
+			Creds:           Credentials{Username: "app@a", Database: "b/orders", Options: map[string]string{}},
+			Direct:          true,
+			ExpectedTarget:  "b",
+			ExpectedUser:    "app@a",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 11: the user name is left alone outside of direct mode
+		{
+			Creds:           Credentials{Username: "jane@example.com", Database: "jane@example.com", Options: map[string]string{}},
+			ExpectedTarget:  "",
+			ExpectedUser:    "jane@example.com",
+			ExpectedDB:      "jane@example.com",
+			ExpectedOptions: map[string]string{},
+		},
+		// Case 12: options win over the user name in direct mode
+		{
+			Creds:           Credentials{Username: "app@a", Database: "orders", Options: map[string]string{"options": "-c target=b"}},
+			Direct:          true,
+			ExpectedTarget:  "b",
+			ExpectedUser:    "app@a",
+			ExpectedDB:      "orders",
+			ExpectedOptions: map[string]string{},
+		},
+	}
+
+	for idx, test := range cases {
+		creds := test.Creds
+		extract := ExtractTargetName
+		if test.Direct {
+			extract = ExtractDirectTargetName
+		}
+		target := extract(&creds)
+		if target != test.ExpectedTarget {
+			t.Errorf("[Case %d] expected target %q, got %q", idx, test.ExpectedTarget, target)
+		}
+		if creds.Username != test.ExpectedUser {
+			t.Errorf("[Case %d] expected user %q, got %q", idx, test.ExpectedUser, creds.Username)
+		}
+		if creds.Database != test.ExpectedDB {
+			t.Errorf("[Case %d] expected database %q, got %q", idx, test.ExpectedDB, creds.Database)
+		}
+		if !reflect.DeepEqual(creds.Options, test.ExpectedOptions) {
+			t.Errorf("[Case %d] expected options %+v, got %+v", idx, test.ExpectedOptions, creds.Options)
+		}
+	}
+}
+
+func TestExtractSessionAttrs(t *testing.T) {
+	cases := []struct {
+		Options         map[string]string
+		Expected        string
+		ExpectedOptions map[string]string
+	}{
+		// Case 0: not set
+		{
+			Options:         map[string]string{"application_name": "psql"},
+			Expected:        "",
+			ExpectedOptions: map[string]string{"application_name": "psql"},
+		},
+		// Case 1: a startup parameter is left for the server, libpq never
+		// sends one
+		{
+			Options:         map[string]string{"target_session_attrs": "read-only"},
+			Expected:        "",
+			ExpectedOptions: map[string]string{"target_session_attrs": "read-only"},
+		},
+		// Case 2: in options, keeping the others
+		{
+			Options:         map[string]string{"options": "-c target_session_attrs=standby -c target=orders"},
+			Expected:        "standby",
+			ExpectedOptions: map[string]string{"options": "-c target=orders"},
+		},
+		// Case 3: --name=value form
+		{
+			Options:         map[string]string{"options": "--target_session_attrs=prefer-standby"},
+			Expected:        "prefer-standby",
+			ExpectedOptions: map[string]string{},
+		},
+	}
+
+	for idx, test := range cases {
+		creds := Credentials{Options: test.Options}
+		attrs := ExtractSessionAttrs(&creds)
+		if attrs != test.Expected {
+			t.Errorf("[Case %d] expected %q, got %q", idx, test.Expected, attrs)
+		}
+		if !reflect.DeepEqual(creds.Options, test.ExpectedOptions) {
+			t.Errorf("[Case %d] expected options %+v, got %+v", idx, test.ExpectedOptions, creds.Options)
+		}
+	}
+}
+
+func TestExtractSessionAttrsConnString(t *testing.T) {
+	cases := []struct {
+		ConnString string
+		Expected   string
+	}{
+		// Case 0: libpq handles target_session_attrs itself
+		{ConnString: "host=proxy dbname=orders target_session_attrs=read-only", Expected: ""},
+		// Case 1: quoted options
+		{ConnString: "host=proxy dbname=orders options='-c target_session_attrs=read-only'", Expected: "read-only"},
+		// Case 2: escaped space in options
+		{ConnString: `dbname=orders options=-c\ target_session_attrs=standby`, Expected: "standby"},
+	}
+
+	for idx, test := range cases {
+		creds := Credentials{Options: libpqStartupParams(test.ConnString)}
+		attrs := ExtractSessionAttrs(&creds)
+		if attrs != test.Expected {
+			t.Errorf("[Case %d] expected %q, got %q", idx, test.Expected, attrs)
+		}
+	}
+}
+
+// libpqStartupParams parses a libpq keyword=value connection string, and
+// returns the startup parameters libpq would send for it
+func libpqStartupParams(connString string) map[string]string {
+	sent := map[string]string{"user": "user", "dbname": "database", "options": "options", "application_name": "application_name"}
+	params := map[string]string{}
+	for len(connString) > 0 {
+		connString = strings.TrimLeft(connString, " ")
+		idx := strings.Index(connString, "=")
+		if idx < 0 {
+			break
+		}
+		key := strings.TrimSpace(connString[:idx])
+		connString = connString[idx+1:]
+
+		var value strings.Builder
+		quoted := strings.HasPrefix(connString, "'")
+		if quoted {
+			connString = connString[1:]
+		}
+		for len(connString) > 0 {
+			c := connString[0]
+			connString = connString[1:]
+			if c == '\\' && len(connString) > 0 {
+				value.WriteByte(connString[0])
+				connString = connString[1:]
+				continue
+			}
+			if (quoted && c == '\'') || (!quoted && c == ' ') {
+				break
+			}
+			value.WriteByte(c)
+		}
+		if param, ok := sent[key]; ok {
+			params[param] = value.String()
+		}
+	}
+	return params
+}
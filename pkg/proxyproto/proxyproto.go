@@ -0,0 +1,238 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/netutil"
+)
+
+// Version of the PROXY protocol header to send
+type Version string
+
+const (
+	// V1 is the human readable header
+	V1 Version = "v1"
+	// V2 is the binary header
+	V2 Version = "v2"
+)
+
+const (
+	// headerTimeout is how long a trusted source has to send its header
+	headerTimeout = 5 * time.Second
+	// v1MaxLength is the longest v1 header allowed, including the CRLF
+	v1MaxLength  = 107
+	v2HeaderSize = 16
+
+	v2CommandLocal  = 0x0
+	v2CommandProxy  = 0x1
+	v2FamilyInet    = 0x1
+	v2FamilyInet6   = 0x2
+	v2AddrSizeInet  = 12
+	v2AddrSizeInet6 = 36
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener reads the PROXY protocol header sent by trusted sources (ex: a
+// load balancer), so the connection's RemoteAddr is the real client. Headers
+// from any other source aren't parsed, and break the connection.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewListener wraps listener, expecting a PROXY protocol header on every
+// connection from the trusted networks
+func NewListener(listener net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{Listener: listener, trusted: trusted}
+}
+
+// Accept returns the next connection, the header is read on its first Read
+// or RemoteAddr so a slow client can't hold up the listener
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !netutil.Contains(l.trusted, conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReaderSize(conn, v1MaxLength)}, nil
+}
+
+// Conn is a connection that starts with a PROXY protocol header
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// Read reads from the connection, after the header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the address of
+// the connection if the header didn't have one
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		c.err = fmt.Errorf("failed to read PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), err)
+		return
+	}
+	switch first[0] {
+	case 'P':
+		c.remoteAddr, c.err = readV1(c.reader)
+	case v2Signature[0]:
+		c.remoteAddr, c.err = readV2(c.reader)
+	default:
+		c.err = fmt.Errorf("missing PROXY protocol header from %s", c.Conn.RemoteAddr())
+	}
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n"
+func readV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("PROXY protocol header too long")
+	} else if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary header, see section 2.2 of the spec
+func readV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, v2HeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(v2Signature)], v2Signature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, addrs); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0xF {
+	case v2CommandLocal:
+		// Health checks from the load balancer itself
+		return nil, nil
+	case v2CommandProxy:
+	default:
+		return nil, fmt.Errorf("invalid PROXY protocol command")
+	}
+	switch header[13] >> 4 {
+	case v2FamilyInet:
+		if len(addrs) < v2AddrSizeInet {
+			return nil, fmt.Errorf("invalid PROXY protocol address")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case v2FamilyInet6:
+		if len(addrs) < v2AddrSizeInet6 {
+			return nil, fmt.Errorf("invalid PROXY protocol address")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	}
+	// Unix sockets and unspecified addresses keep the connection's address
+	return nil, nil
+}
+
+// WriteHeader writes a PROXY protocol header for a connection from src to dst.
+// Addresses that aren't TCP are sent as unknown.
+func WriteHeader(w io.Writer, version Version, src, dst net.Addr) error {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	ipv4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	switch version {
+	case V1:
+		header := "PROXY UNKNOWN\r\n"
+		if known {
+			family, srcIP, dstIP := "TCP4", srcTCP.IP.String(), dstTCP.IP.String()
+			if !ipv4 {
+				family, srcIP, dstIP = "TCP6", formatIPv6(srcTCP.IP), formatIPv6(dstTCP.IP)
+			}
+			header = fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcTCP.Port, dstTCP.Port)
+		}
+		_, err := io.WriteString(w, header)
+		return err
+	case V2:
+		header := append([]byte{}, v2Signature...)
+		var addrs []byte
+		switch {
+		case !known:
+			header = append(header, 0x20|v2CommandLocal, 0x00)
+		case ipv4:
+			header = append(header, 0x20|v2CommandProxy, v2FamilyInet<<4|0x1)
+			addrs = append(append(addrs, srcTCP.IP.To4()...), dstTCP.IP.To4()...)
+		default:
+			header = append(header, 0x20|v2CommandProxy, v2FamilyInet6<<4|0x1)
+			addrs = append(append(addrs, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+		}
+		if known {
+			addrs = append(addrs, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(addrs[len(addrs)-4:], uint16(srcTCP.Port))
+			binary.BigEndian.PutUint16(addrs[len(addrs)-2:], uint16(dstTCP.Port))
+		}
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(addrs)))
+		_, err := w.Write(append(header, addrs...))
+		return err
+	}
+	return fmt.Errorf("unknown PROXY protocol version %q, expected v1 or v2", version)
+}
+
+// formatIPv6 formats an IP as IPv6, IPv4 addresses are IPv4-mapped
+func formatIPv6(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,198 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mothership/rds-auth-proxy/pkg/netutil"
+	. "github.com/mothership/rds-auth-proxy/pkg/proxyproto"
+)
+
+func tcpAddr(hostPort string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", hostPort)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func TestWriteHeader(t *testing.T) {
+	cases := []struct {
+		Version  Version
+		Src      net.Addr
+		Dst      net.Addr
+		Expected []byte
+		Error    error
+	}{
+		// Case 0: v1 IPv4
+		{
+			Version:  V1,
+			Src:      tcpAddr("192.0.2.1:56324"),
+			Dst:      tcpAddr("198.51.100.1:5432"),
+			Expected: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n"),
+		},
+		// Case 1: v1 IPv6, with an IPv4 destination mapped
+		{
+			Version:  V1,
+			Src:      tcpAddr("[2001:db8::1]:56324"),
+			Dst:      tcpAddr("198.51.100.1:5432"),
+			Expected: []byte("PROXY TCP6 2001:db8::1 ::ffff:198.51.100.1 56324 5432\r\n"),
+		},
+		// Case 2: v1 unix socket
+		{
+			Version:  V1,
+			Src:      &net.UnixAddr{Name: "@", Net: "unix"},
+			Dst:      tcpAddr("198.51.100.1:5432"),
+			Expected: []byte("PROXY UNKNOWN\r\n"),
+		},
+		// Case 3: v2 IPv4
+		{
+			Version: V2,
+			Src:     tcpAddr("192.0.2.1:56324"),
+			Dst:     tcpAddr("198.51.100.1:5432"),
+			Expected: append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"),
+				192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x15, 0x38),
+		},
+		// Case 4: v2 unix socket is sent as LOCAL
+		{
+			Version:  V2,
+			Src:      &net.UnixAddr{Name: "@", Net: "unix"},
+			Dst:      tcpAddr("198.51.100.1:5432"),
+			Expected: []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"),
+		},
+		// Case 5: unknown version
+		{
+			Version: Version("v3"),
+			Src:     tcpAddr("192.0.2.1:56324"),
+			Dst:     tcpAddr("198.51.100.1:5432"),
+			Error:   fmt.Errorf("unknown PROXY protocol version \"v3\""),
+		},
+	}
+
+	for idx, test := range cases {
+		buf := bytes.Buffer{}
+		err := WriteHeader(&buf, test.Version, test.Src, test.Dst)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if err == nil && !bytes.Equal(buf.Bytes(), test.Expected) {
+			t.Errorf("[Case %d] expected %q, got %q", idx, test.Expected, buf.Bytes())
+		}
+	}
+}
+
+// accept sends header then data over a new connection to the listener, and
+// returns the remote address and data the accepted side saw
+func accept(t *testing.T, trusted []string, header []byte) (string, string, error) {
+	nets, err := netutil.ParseCIDRs(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(inner, nets)
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(append(append([]byte{}, header...), []byte("select 1")...))
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, err := ioutil.ReadAll(conn)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return host, string(data), err
+}
+
+func TestListener(t *testing.T) {
+	v2Local := []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")
+	v2IPv6 := bytes.Buffer{}
+	_ = WriteHeader(&v2IPv6, V2, tcpAddr("[2001:db8::1]:56324"), tcpAddr("[2001:db8::2]:5432"))
+
+	cases := []struct {
+		Trusted      []string
+		Header       []byte
+		ExpectedHost string
+		ExpectedData string
+		Error        error
+	}{
+		// Case 0: v1 from a trusted source
+		{
+			Trusted:      []string{"127.0.0.0/8"},
+			Header:       []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n"),
+			ExpectedHost: "192.0.2.1",
+			ExpectedData: "select 1",
+		},
+		// Case 1: v2 from a trusted source
+		{
+			Trusted:      []string{"127.0.0.1"},
+			Header:       v2IPv6.Bytes(),
+			ExpectedHost: "2001:db8::1",
+			ExpectedData: "select 1",
+		},
+		// Case 2: v2 health check keeps the connection's address
+		{
+			Trusted:      []string{"127.0.0.1"},
+			Header:       v2Local,
+			ExpectedHost: "127.0.0.1",
+			ExpectedData: "select 1",
+		},
+		// Case 3: headers from untrusted sources aren't parsed
+		{
+			Trusted:      []string{"10.0.0.0/8"},
+			Header:       []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n"),
+			ExpectedHost: "127.0.0.1",
+			ExpectedData: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\nselect 1",
+		},
+		// Case 4: trusted sources must send a header
+		{
+			Trusted:      []string{"127.0.0.0/8"},
+			Header:       []byte{},
+			ExpectedHost: "127.0.0.1",
+			Error:        fmt.Errorf("missing PROXY protocol header"),
+		},
+		// Case 5: malformed header
+		{
+			Trusted:      []string{"127.0.0.0/8"},
+			Header:       []byte("PROXY TCP4 not-an-ip 198.51.100.1 56324 5432\r\n"),
+			ExpectedHost: "127.0.0.1",
+			Error:        fmt.Errorf("invalid PROXY protocol source address"),
+		},
+	}
+
+	for idx, test := range cases {
+		host, data, err := accept(t, test.Trusted, test.Header)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if host != test.ExpectedHost {
+			t.Errorf("[Case %d] expected host %q, got %q", idx, test.ExpectedHost, host)
+		}
+		if err == nil && data != test.ExpectedData {
+			t.Errorf("[Case %d] expected data %q, got %q", idx, test.ExpectedData, data)
+		}
+	}
+}
+
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
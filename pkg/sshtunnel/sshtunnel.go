@@ -0,0 +1,320 @@
+package sshtunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	"github.com/mothership/rds-auth-proxy/pkg/file"
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	defaultSSHPort = "22"
+	dialTimeout    = 15 * time.Second
+)
+
+// Hop is an SSH server on the way to the server proxy
+type Hop struct {
+	Addr string
+	User string
+}
+
+// ParseHop parses [user@]host[:port], using defaultUser and port 22 if they're not set
+func ParseHop(hop string, defaultUser string) Hop {
+	user := defaultUser
+	if idx := strings.LastIndex(hop, "@"); idx >= 0 {
+		user, hop = hop[:idx], hop[idx+1:]
+	}
+	if _, _, err := net.SplitHostPort(hop); err != nil {
+		hop = net.JoinHostPort(hop, defaultSSHPort)
+	}
+	return Hop{Addr: hop, User: user}
+}
+
+// Options for connecting to the bastion
+type Options struct {
+	// JumpHosts are connected through in order before the bastion
+	JumpHosts       []Hop
+	Bastion         Hop
+	Auth            []ssh.AuthMethod
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// FromConfig returns the options for an ssh config block, loading the key,
+// agent, and known hosts
+func FromConfig(cfg *config.SSHTunnel) (Options, error) {
+	if cfg.Host == "" {
+		return Options{}, fmt.Errorf("ssh host not set")
+	}
+	if cfg.User == "" {
+		return Options{}, fmt.Errorf("ssh user not set")
+	}
+
+	auth, err := authMethods(cfg)
+	if err != nil {
+		return Options{}, err
+	}
+
+	opts := Options{
+		Bastion: ParseHop(cfg.Host, cfg.User),
+		Auth:    auth,
+	}
+	for _, jumpHost := range cfg.JumpHosts {
+		opts.JumpHosts = append(opts.JumpHosts, ParseHop(jumpHost, cfg.User))
+	}
+
+	if cfg.KnownHostsPath == nil {
+		return opts, fmt.Errorf("ssh known_hosts not set")
+	}
+	knownHostsPath, err := file.ExpandPath(*cfg.KnownHostsPath)
+	if err != nil {
+		return opts, err
+	}
+	opts.HostKeyCallback, err = knownhosts.New(knownHostsPath)
+	if err != nil {
+		return opts, fmt.Errorf("failed to load ssh known_hosts: %w", err)
+	}
+	return opts, nil
+}
+
+// authMethods returns the private key and/or agent auth for the config
+func authMethods(cfg *config.SSHTunnel) ([]ssh.AuthMethod, error) {
+	methods := []ssh.AuthMethod{}
+	if cfg.PrivateKeyPath != nil {
+		keyPath, err := file.ExpandPath(*cfg.PrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		keyBytes, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, fmt.Errorf("ssh private key %s is encrypted, add it to your ssh agent and set agent: true instead", keyPath)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh private key %s: %w", keyPath, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if cfg.Agent || cfg.PrivateKeyPath == nil {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, fmt.Errorf("no ssh private_key set, and no ssh agent running (SSH_AUTH_SOCK is empty)")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach ssh agent: %w", err)
+		}
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	return methods, nil
+}
+
+func (o Options) clientConfig(hop Hop) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            hop.User,
+		Auth:            o.Auth,
+		HostKeyCallback: o.HostKeyCallback,
+		Timeout:         dialTimeout,
+	}
+}
+
+// Dial connects to the bastion, through the jump hosts
+func Dial(opts Options) (*ssh.Client, error) {
+	hops := append(append([]Hop{}, opts.JumpHosts...), opts.Bastion)
+	clients := make([]*ssh.Client, 0, len(hops))
+	closeAll := func() {
+		for idx := len(clients) - 1; idx >= 0; idx-- {
+			clients[idx].Close()
+		}
+	}
+
+	for idx, hop := range hops {
+		var client *ssh.Client
+		var err error
+		if idx == 0 {
+			client, err = ssh.Dial("tcp", hop.Addr, opts.clientConfig(hop))
+		} else {
+			client, err = dialThrough(clients[idx-1], hop, opts.clientConfig(hop))
+		}
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to connect to ssh host %s: %w", hop.Addr, err)
+		}
+		clients = append(clients, client)
+	}
+
+	// The jump host connections only carry the bastion's, close them with it
+	bastion := clients[len(clients)-1]
+	go func() {
+		_ = bastion.Wait()
+		closeAll()
+	}()
+	return bastion, nil
+}
+
+func dialThrough(jumpHost *ssh.Client, hop Hop, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := jumpHost.Dial("tcp", hop.Addr)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, hop.Addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// Tunnel forwards local connections to a remote address through an SSH bastion
+type Tunnel struct {
+	opts       Options
+	remoteAddr string
+	listener   net.Listener
+	lock       sync.Mutex
+	client     *ssh.Client
+	done       chan struct{}
+}
+
+// Start connects to the bastion, and forwards connections on localAddr to
+// remoteAddr until ctx is canceled. If the SSH connection drops, it's
+// reopened for the next local connection.
+func Start(ctx context.Context, opts Options, localAddr, remoteAddr string) (*Tunnel, error) {
+	t := &Tunnel{opts: opts, remoteAddr: remoteAddr, done: make(chan struct{})}
+	// Connect now so bad credentials fail on startup
+	if _, err := t.getClient(); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	t.listener = listener
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		t.close()
+		close(t.done)
+	}()
+	go t.serve(ctx)
+	return t, nil
+}
+
+// Done is closed once the listener and bastion connection have closed after
+// ctx was canceled
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Addr returns the local address of the tunnel
+func (t *Tunnel) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+func (t *Tunnel) serve(ctx context.Context) {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error("error accepting connection for ssh tunnel", zap.Error(err))
+			continue
+		}
+		go t.forward(conn)
+	}
+}
+
+func (t *Tunnel) forward(local net.Conn) {
+	defer local.Close()
+	remote, err := t.dialRemote()
+	if err != nil {
+		log.Error("ssh tunnel failed to reach the server proxy", zap.Error(err), zap.String("remote_addr", t.remoteAddr))
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	// Either side closing ends the connection
+	<-done
+}
+
+// dialRemote opens a connection to the remote address through the bastion,
+// reconnecting to the bastion once if the connection dropped
+func (t *Tunnel) dialRemote() (net.Conn, error) {
+	client, err := t.getClient()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial("tcp", t.remoteAddr)
+	if err == nil {
+		return conn, nil
+	}
+
+	log.Warn("ssh tunnel dial failed, reconnecting to the bastion", zap.Error(err))
+	t.resetClient(client)
+	client, err = t.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial("tcp", t.remoteAddr)
+}
+
+func (t *Tunnel) getClient() (*ssh.Client, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+	client, err := Dial(t.opts)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("connected to ssh bastion", zap.String("bastion", t.opts.Bastion.Addr))
+	t.client = client
+	return client, nil
+}
+
+// resetClient drops the bastion connection, unless another connection
+// already replaced it
+func (t *Tunnel) resetClient(client *ssh.Client) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.client == client {
+		t.client.Close()
+		t.client = nil
+	}
+}
+
+func (t *Tunnel) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+}
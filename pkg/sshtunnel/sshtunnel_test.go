@@ -0,0 +1,265 @@
+package sshtunnel_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mothership/rds-auth-proxy/pkg/config"
+	. "github.com/mothership/rds-auth-proxy/pkg/sshtunnel"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newSigner(t *testing.T) (ssh.Signer, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// startSSHServer starts an SSH server that only forwards direct-tcpip
+// channels, for the user with the authorized key
+func startSSHServer(t *testing.T, hostKey ssh.Signer, user string, authorized ssh.PublicKey) string {
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == user && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, serverConfig)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveSSH(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+		var payload struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelReqs, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelReqs)
+		go func() {
+			defer channel.Close()
+			defer target.Close()
+			go func() { _, _ = io.Copy(target, channel) }()
+			_, _ = io.Copy(channel, target)
+		}()
+	}
+}
+
+// startEchoServer stands in for the server proxy
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func writeFile(t *testing.T, dir, name string, content []byte) *string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &path
+}
+
+func TestTunnel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshtunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey, _ := newSigner(t)
+	otherHostKey, _ := newSigner(t)
+	userKey, userKeyPEM := newSigner(t)
+	_, otherUserKeyPEM := newSigner(t)
+
+	sshAddr := startSSHServer(t, hostKey, "proxy", userKey.PublicKey())
+	echoAddr := startEchoServer(t)
+
+	knownHosts := writeFile(t, dir, "known_hosts", []byte(knownhosts.Line([]string{knownhosts.Normalize(sshAddr)}, hostKey.PublicKey())+"\n"))
+	wrongKnownHosts := writeFile(t, dir, "wrong_known_hosts", []byte(knownhosts.Line([]string{knownhosts.Normalize(sshAddr)}, otherHostKey.PublicKey())+"\n"))
+	keyPath := writeFile(t, dir, "id_ecdsa", userKeyPEM)
+	otherKeyPath := writeFile(t, dir, "other_id_ecdsa", otherUserKeyPEM)
+
+	cases := []struct {
+		Config config.SSHTunnel
+		Error  error
+	}{
+		// Case 0: straight to the bastion
+		{
+			Config: config.SSHTunnel{Host: sshAddr, User: "proxy", PrivateKeyPath: keyPath, KnownHostsPath: knownHosts},
+		},
+		// Case 1: through a jump host (the same server, forwarding to itself)
+		{
+			Config: config.SSHTunnel{Host: sshAddr, User: "proxy", PrivateKeyPath: keyPath, KnownHostsPath: knownHosts, JumpHosts: []string{"proxy@" + sshAddr}},
+		},
+		// Case 2: host key doesn't match known_hosts
+		{
+			Config: config.SSHTunnel{Host: sshAddr, User: "proxy", PrivateKeyPath: keyPath, KnownHostsPath: wrongKnownHosts},
+			Error:  fmt.Errorf("key mismatch"),
+		},
+		// Case 3: key isn't authorized
+		{
+			Config: config.SSHTunnel{Host: sshAddr, User: "proxy", PrivateKeyPath: otherKeyPath, KnownHostsPath: knownHosts},
+			Error:  fmt.Errorf("unable to authenticate"),
+		},
+		// Case 4: wrong user on the jump host
+		{
+			Config: config.SSHTunnel{Host: sshAddr, User: "proxy", PrivateKeyPath: keyPath, KnownHostsPath: knownHosts, JumpHosts: []string{"root@" + sshAddr}},
+			Error:  fmt.Errorf("failed to connect to ssh host"),
+		},
+	}
+
+	for idx, test := range cases {
+		ctx, cancel := context.WithCancel(context.Background())
+		tunnel, err := startTunnel(ctx, &test.Config, echoAddr)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if err == nil {
+			if err := echo(tunnel.Addr().String(), "select 1"); err != nil {
+				t.Errorf("[Case %d] unexpected error through the tunnel: %+v", idx, err)
+			}
+		}
+		cancel()
+		if err == nil {
+			<-tunnel.Done()
+			if _, err := net.Dial("tcp", tunnel.Addr().String()); err == nil {
+				t.Errorf("[Case %d] expected the tunnel to be closed", idx)
+			}
+		}
+	}
+}
+
+func startTunnel(ctx context.Context, cfg *config.SSHTunnel, remoteAddr string) (*Tunnel, error) {
+	opts, err := FromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return Start(ctx, opts, "127.0.0.1:0", remoteAddr)
+}
+
+func echo(addr string, msg string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("expected %q, got %q", msg, buf)
+	}
+	return nil
+}
+
+func TestParseHop(t *testing.T) {
+	cases := []struct {
+		Hop      string
+		Expected Hop
+	}{
+		{Hop: "bastion.example.com", Expected: Hop{Addr: "bastion.example.com:22", User: "ec2-user"}},
+		{Hop: "admin@bastion.example.com:2222", Expected: Hop{Addr: "bastion.example.com:2222", User: "admin"}},
+		{Hop: "10.0.0.1:22", Expected: Hop{Addr: "10.0.0.1:22", User: "ec2-user"}},
+	}
+	for idx, test := range cases {
+		if hop := ParseHop(test.Hop, "ec2-user"); hop != test.Expected {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, hop)
+		}
+	}
+}
+
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}
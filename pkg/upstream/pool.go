@@ -0,0 +1,248 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/mothership/rds-auth-proxy/pkg/log"
+	"go.uber.org/zap"
+)
+
+// Strategy is how a pool orders its hosts
+type Strategy string
+
+const (
+	// StrategyFailover tries hosts in the order they're listed
+	StrategyFailover Strategy = "failover"
+	// StrategyRandom spreads connections across hosts at random
+	StrategyRandom Strategy = "random"
+	// StrategyLeastLatency tries the host with the fastest probe first
+	StrategyLeastLatency Strategy = "least-latency"
+)
+
+const (
+	// DefaultEjectionTime is how long a failing host is tried last for
+	DefaultEjectionTime = 30 * time.Second
+	// DefaultProbeInterval is the time between health probes
+	DefaultProbeInterval = 30 * time.Second
+	probeTimeout         = 5 * time.Second
+)
+
+type hostState struct {
+	addr          string
+	latency       time.Duration
+	ejectedUntil  time.Time
+	lastFailure   error
+	probedLatency bool
+}
+
+// Pool picks between several upstream hosts. Hosts that fail a connection or
+// a probe are ejected, and only tried after the healthy hosts until the
+// ejection ends.
+type Pool struct {
+	strategy     Strategy
+	EjectionTime time.Duration
+	// GetClientCertificate is presented to hosts asking for a client
+	// certificate during probes (ex: a server proxy with a client CA)
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	lock                 sync.Mutex
+	hosts                []*hostState
+}
+
+// NewPool returns a pool for hosts, ordered by strategy. An empty strategy is failover.
+func NewPool(hosts []string, strategy Strategy) (*Pool, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no upstream hosts")
+	}
+	switch strategy {
+	case "":
+		strategy = StrategyFailover
+	case StrategyFailover, StrategyRandom, StrategyLeastLatency:
+	default:
+		return nil, fmt.Errorf("unknown strategy %q, expected one of failover, random or least-latency", strategy)
+	}
+	pool := &Pool{strategy: strategy, EjectionTime: DefaultEjectionTime}
+	for _, host := range hosts {
+		pool.hosts = append(pool.hosts, &hostState{addr: host})
+	}
+	return pool, nil
+}
+
+// Hosts returns every host in the order they should be tried
+func (p *Pool) Hosts() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+
+	ordered := make([]*hostState, len(p.hosts))
+	copy(ordered, p.hosts)
+	switch p.strategy {
+	case StrategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	case StrategyLeastLatency:
+		// Hosts that haven't been probed yet go after those that have
+		sort.SliceStable(ordered, func(i, j int) bool {
+			if ordered[i].probedLatency != ordered[j].probedLatency {
+				return ordered[i].probedLatency
+			}
+			return ordered[i].latency < ordered[j].latency
+		})
+	}
+	// Ejected hosts are still tried, just last
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !ordered[i].isEjected(now) && ordered[j].isEjected(now)
+	})
+
+	hosts := make([]string, 0, len(ordered))
+	for _, host := range ordered {
+		hosts = append(hosts, host.addr)
+	}
+	return hosts
+}
+
+// IsEjected returns whether addr failed recently enough that it's tried last
+func (p *Pool) IsEjected(addr string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for _, host := range p.hosts {
+		if host.addr == addr {
+			return host.isEjected(now)
+		}
+	}
+	return false
+}
+
+// Report records the result of connecting to a host
+func (p *Pool) Report(addr string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, host := range p.hosts {
+		if host.addr != addr {
+			continue
+		}
+		if err == nil {
+			if host.lastFailure != nil {
+				log.Info("upstream host is healthy again", zap.String("host", addr))
+			}
+			host.ejectedUntil = time.Time{}
+			host.lastFailure = nil
+			return
+		}
+		if host.lastFailure == nil {
+			log.Warn("ejecting upstream host", zap.String("host", addr), zap.Error(err), zap.Duration("for", p.EjectionTime))
+		}
+		host.ejectedUntil = time.Now().Add(p.EjectionTime)
+		host.lastFailure = err
+		return
+	}
+}
+
+// Probe checks every host each interval until ctx is canceled, ejecting the
+// ones that fail and measuring latency for the least-latency strategy. An
+// interval of zero (ex: unset in the config) uses DefaultProbeInterval.
+func (p *Pool) Probe(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		p.ProbeOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// ProbeOnce checks every host once
+func (p *Pool) ProbeOnce(ctx context.Context) {
+	p.lock.Lock()
+	addrs := make([]string, 0, len(p.hosts))
+	for _, host := range p.hosts {
+		addrs = append(addrs, host.addr)
+	}
+	p.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			latency, err := p.probe(ctx, addr)
+			p.Report(addr, err)
+			if err == nil {
+				p.recordLatency(addr, latency)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) recordLatency(addr string, latency time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, host := range p.hosts {
+		if host.addr == addr {
+			host.latency = latency
+			host.probedLatency = true
+		}
+	}
+}
+
+// probe checks a host speaks the postgres protocol, by sending an SSLRequest
+// and waiting for the one byte answer. When the host accepts SSL, the TLS
+// handshake is finished before hanging up, postgres logs an error for every
+// connection dropped in the middle of it, but not for one closed cleanly
+// before the startup message.
+func (p *Pool) probe(ctx context.Context, addr string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	start := time.Now()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write((&pgproto3.SSLRequest{}).Encode(nil)); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 1)
+	if _, err := conn.Read(response); err != nil {
+		return 0, err
+	}
+	switch response[0] {
+	case 'N':
+	case 'S':
+		// Only checking the host is up, the certificate is verified by
+		// real connections
+		//nolint:gosec
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, GetClientCertificate: p.GetClientCertificate})
+		if err := tlsConn.Handshake(); err != nil {
+			return 0, err
+		}
+		// Sends close_notify, conn is closed again by the defer
+		defer tlsConn.Close()
+	default:
+		return 0, fmt.Errorf("unexpected response to SSL request from %s", addr)
+	}
+	return time.Since(start), nil
+}
+
+func (h *hostState) isEjected(now time.Time) bool {
+	return now.Before(h.ejectedUntil)
+}
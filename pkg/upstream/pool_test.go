@@ -0,0 +1,283 @@
+package upstream_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mothership/rds-auth-proxy/pkg/cert"
+	. "github.com/mothership/rds-auth-proxy/pkg/upstream"
+)
+
+func TestPoolHosts(t *testing.T) {
+	cases := []struct {
+		Hosts    []string
+		Strategy Strategy
+		Failures []string
+		Expected []string
+		Error    error
+	}{
+		// Case 0: failover keeps the listed order
+		{
+			Hosts:    []string{"a:8000", "b:8000", "c:8000"},
+			Expected: []string{"a:8000", "b:8000", "c:8000"},
+		},
+		// Case 1: failing hosts are tried last
+		{
+			Hosts:    []string{"a:8000", "b:8000", "c:8000"},
+			Strategy: StrategyFailover,
+			Failures: []string{"a:8000"},
+			Expected: []string{"b:8000", "c:8000", "a:8000"},
+		},
+		// Case 2: several failures keep their order
+		{
+			Hosts:    []string{"a:8000", "b:8000", "c:8000"},
+			Failures: []string{"b:8000", "a:8000"},
+			Expected: []string{"c:8000", "a:8000", "b:8000"},
+		},
+		// Case 3: unknown strategy
+		{
+			Hosts:    []string{"a:8000"},
+			Strategy: Strategy("round-robin"),
+			Error:    fmt.Errorf("unknown strategy \"round-robin\""),
+		},
+		// Case 4: no hosts
+		{
+			Hosts: []string{},
+			Error: fmt.Errorf("no upstream hosts"),
+		},
+	}
+
+	for idx, test := range cases {
+		pool, err := NewPool(test.Hosts, test.Strategy)
+		if !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+		if err != nil {
+			continue
+		}
+		for _, host := range test.Failures {
+			pool.Report(host, fmt.Errorf("connection refused"))
+		}
+		if hosts := pool.Hosts(); !reflect.DeepEqual(hosts, test.Expected) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Expected, hosts)
+		}
+	}
+}
+
+func TestPoolRecovers(t *testing.T) {
+	pool, _ := NewPool([]string{"a:8000", "b:8000"}, StrategyFailover)
+	pool.Report("a:8000", fmt.Errorf("connection refused"))
+	pool.Report("a:8000", nil)
+	if hosts := pool.Hosts(); hosts[0] != "a:8000" {
+		t.Errorf("expected a to be healthy again, got %+v", hosts)
+	}
+	if pool.IsEjected("a:8000") {
+		t.Errorf("expected a not to be ejected")
+	}
+
+	pool.EjectionTime = 50 * time.Millisecond
+	pool.Report("a:8000", fmt.Errorf("connection refused"))
+	if !pool.IsEjected("a:8000") {
+		t.Errorf("expected a to be ejected")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if pool.IsEjected("a:8000") {
+		t.Errorf("expected a's ejection to have ended")
+	}
+	if hosts := pool.Hosts(); hosts[0] != "a:8000" {
+		t.Errorf("expected a's ejection to have ended, got %+v", hosts)
+	}
+}
+
+func TestPoolRandomHasEveryHost(t *testing.T) {
+	pool, _ := NewPool([]string{"a:8000", "b:8000", "c:8000"}, StrategyRandom)
+	pool.Report("c:8000", fmt.Errorf("connection refused"))
+	for i := 0; i < 20; i++ {
+		hosts := pool.Hosts()
+		if len(hosts) != 3 || hosts[2] != "c:8000" {
+			t.Fatalf("expected every host, with the failing one last, got %+v", hosts)
+		}
+	}
+}
+
+// startPostgresLike answers SSL requests with 'N' after delay, like a
+// postgres server without SSL
+func startPostgresLike(t *testing.T, delay time.Duration) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 8)
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				time.Sleep(delay)
+				_, _ = conn.Write([]byte{'N'})
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func closedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestPoolProbe(t *testing.T) {
+	slow := startPostgresLike(t, 100*time.Millisecond)
+	fast := startPostgresLike(t, 0)
+	down := closedAddr(t)
+
+	pool, _ := NewPool([]string{down, slow, fast}, StrategyLeastLatency)
+	pool.ProbeOnce(context.Background())
+
+	expected := []string{fast, slow, down}
+	if hosts := pool.Hosts(); !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, hosts)
+	}
+}
+
+// startPostgresSSL answers SSL requests with 'S', like a postgres server with
+// SSL, and sends how each probe ended after the handshake. With clientCAs,
+// it requires a client certificate signed by one of them, like a server
+// proxy with a client CA.
+func startPostgresSSL(t *testing.T, closed chan<- error, clientCAs *x509.CertPool) string {
+	certBytes, keyBytes, err := cert.GenerateSelfSignedCert("localhost", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPair, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 8)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					closed <- err
+					return
+				}
+				_, _ = conn.Write([]byte{'S'})
+				tlsConfig := &tls.Config{Certificates: []tls.Certificate{keyPair}}
+				if clientCAs != nil {
+					tlsConfig.ClientCAs = clientCAs
+					tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+				tlsConn := tls.Server(conn, tlsConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					closed <- fmt.Errorf("handshake failed: %w", err)
+					return
+				}
+				// Where postgres reads the startup message
+				_, err := tlsConn.Read(buf)
+				closed <- err
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestPoolProbeSSL(t *testing.T) {
+	closed := make(chan error, 1)
+	addr := startPostgresSSL(t, closed, nil)
+	pool, _ := NewPool([]string{addr}, StrategyFailover)
+	pool.ProbeOnce(context.Background())
+
+	if pool.IsEjected(addr) {
+		t.Errorf("expected %s to be healthy", addr)
+	}
+	// A clean close, not a dropped handshake
+	if err := <-closed; err != io.EOF {
+		t.Errorf("expected the probe to close the connection cleanly, got %+v", err)
+	}
+}
+
+func TestPoolProbeClientCertificate(t *testing.T) {
+	caBytes, caKeyBytes, err := cert.GenerateCA(cert.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := cert.LoadCA(caBytes, caKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certBytes, keyBytes, err := ca.Issue(cert.Options{CommonName: "client-proxy", ClientAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Certificate)
+
+	cases := []struct {
+		Certificate *tls.Certificate
+		Error       error
+	}{
+		// Case 0: the server refuses a probe without a certificate
+		{Certificate: nil, Error: fmt.Errorf("handshake failed")},
+		// Case 1: a clean close with the client certificate
+		{Certificate: &clientCert, Error: io.EOF},
+	}
+
+	for idx, test := range cases {
+		closed := make(chan error, 1)
+		addr := startPostgresSSL(t, closed, clientCAs)
+		pool, _ := NewPool([]string{addr}, StrategyFailover)
+		if test.Certificate != nil {
+			certificate := test.Certificate
+			pool.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return certificate, nil
+			}
+		}
+		pool.ProbeOnce(context.Background())
+		if err := <-closed; !errorContains(err, test.Error) {
+			t.Errorf("[Case %d] expected %+v, got %+v", idx, test.Error, err)
+		}
+	}
+}
+
+func errorContains(out error, want error) bool {
+	if want == nil && out == nil {
+		return true
+	} else if want == nil || out == nil {
+		return false
+	}
+	return strings.Contains(out.Error(), want.Error())
+}